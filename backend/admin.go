@@ -0,0 +1,1077 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/gorilla/mux"
+	"github.com/lib/pq"
+)
+
+// Module ids are university style codes like CS0001
+var moduleIdRegex = regexp.MustCompile(`^[A-Z]{2,4}[0-9]{4}$`)
+
+// Languages are two letter ISO 639-1 codes
+var languageRegex = regexp.MustCompile(`^[a-z]{2}$`)
+
+var moduleDifficulties = map[string]bool{"beginner": true, "intermediate": true, "advanced": true}
+
+const maxModuleTags = 10
+
+type adminModule struct {
+	Id            string   `json:"id"`
+	Title         string   `json:"title"`
+	Image         string   `json:"image"`
+	Description   string   `json:"description"`
+	Duration      int      `json:"duration"`
+	MinAttendance int      `json:"min_attendance"`
+	MinLectures   int      `json:"min_lectures"`
+	MinMastery    int      `json:"min_mastery"`
+	Tags          []string `json:"tags"`
+	Difficulty    string   `json:"difficulty"`
+	Language      string   `json:"language"`
+}
+
+type adminLecture struct {
+	Id              string           `json:"id"`
+	ContentKey      string           `json:"content_key"`
+	Title           string           `json:"title"`
+	Description     string           `json:"description"`
+	VideoLink       string           `json:"video_link"`
+	DateOffset      int              `json:"date_offset"`
+	DurationSeconds int              `json:"duration_seconds"`
+	MinWatchPercent int              `json:"min_watch_percent"`
+	Flashcards      []adminFlashcard `json:"flashcards,omitempty"`
+}
+
+type adminTutorial struct {
+	Id          string `json:"id"`
+	ContentKey  string `json:"content_key"`
+	Week        int    `json:"week"`
+	Title       string `json:"title"`
+	Description string `json:"description"`
+}
+
+type adminFlashcard struct {
+	Id         string `json:"id"`
+	ContentKey string `json:"content_key"`
+	TopSide    string `json:"top_side"`
+	BottomSide string `json:"bottom_side"`
+}
+
+// Version is the draft when there is one, otherwise the published version
+type moduleContentRes struct {
+	Module           adminModule     `json:"module"`
+	Version          int             `json:"version"`
+	PublishedVersion *int            `json:"published_version"`
+	Draft            bool            `json:"draft"`
+	Lectures         []adminLecture  `json:"lectures"`
+	Tutorials        []adminTutorial `json:"tutorials"`
+}
+
+type auditEntry struct {
+	Id        string          `json:"id"`
+	Actor     string          `json:"actor"`
+	Action    string          `json:"action"`
+	Entity    string          `json:"entity"`
+	EntityId  string          `json:"entity_id"`
+	Payload   json.RawMessage `json:"payload"`
+	CreatedAt string          `json:"created_at"`
+}
+
+/******************* MODULES ********************************/
+
+func getAdminModules(w http.ResponseWriter, r *http.Request) {
+	var res []adminModule
+
+	sqlquery := `SELECT module_id, title, image, description, duration, min_attendance, min_lectures, min_mastery, tags, difficulty, language
+							FROM module ORDER BY module_id`
+	result, err := db.Query(sqlquery)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	defer result.Close()
+
+	for result.Next() {
+		var module adminModule
+		if err := result.Scan(&module.Id, &module.Title, &module.Image, &module.Description, &module.Duration, &module.MinAttendance, &module.MinLectures, &module.MinMastery, pq.Array(&module.Tags), &module.Difficulty, &module.Language); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		res = append(res, module)
+	}
+
+	writeAdminRes(w, http.StatusOK, res)
+}
+
+func createModule(w http.ResponseWriter, r *http.Request) {
+	lemail := r.Header.Get("X-User-Claim")
+
+	var req adminModule
+	if !decodeAdminRequest(w, r, &req) {
+		return
+	}
+
+	if !moduleIdRegex.MatchString(req.Id) {
+		http.Error(w, "Module id has to be a code like CS0001", http.StatusBadRequest)
+		return
+	}
+
+	req.normalize()
+	if msg := validateModule(req); msg != "" {
+		http.Error(w, msg, http.StatusBadRequest)
+		return
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	defer tx.Rollback()
+
+	// New modules start out with an empty draft and are hidden until it gets published
+	sqlquery := `INSERT INTO module(module_id, title, image, description, duration, min_attendance, min_lectures, min_mastery, tags, difficulty, language, published_version)
+							VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, NULL) ON CONFLICT DO NOTHING`
+	result, err := tx.Exec(sqlquery, req.Id, req.Title, req.Image, req.Description, req.Duration, req.MinAttendance, req.MinLectures, req.MinMastery,
+		pq.Array(req.Tags), req.Difficulty, req.Language)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	if affected, err := result.RowsAffected(); err != nil || affected == 0 {
+		http.Error(w, "Module already exists", http.StatusConflict)
+		return
+	}
+
+	if _, err := ensureDraftVersion(tx, req.Id); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	if !commitAudited(w, tx, lemail, "create", "module", req.Id, req) {
+		return
+	}
+
+	writeAdminRes(w, http.StatusCreated, req)
+}
+
+func updateModule(w http.ResponseWriter, r *http.Request) {
+	lemail := r.Header.Get("X-User-Claim")
+	moduleId := mux.Vars(r)["id"]
+
+	var req adminModule
+	if !decodeAdminRequest(w, r, &req) {
+		return
+	}
+
+	req.Id = moduleId
+	req.normalize()
+	if msg := validateModule(req); msg != "" {
+		http.Error(w, msg, http.StatusBadRequest)
+		return
+	}
+
+	// A shorter module still has to fit its lectures and tutorials
+	var lastOffset, lastWeek sql.NullInt32
+	sqlquery := `SELECT (SELECT MAX(date_offset) FROM lecture WHERE module = $1), (SELECT MAX(week) FROM tutorial WHERE module = $1)`
+	if err := db.QueryRow(sqlquery, moduleId).Scan(&lastOffset, &lastWeek); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	if (lastOffset.Valid && int(lastOffset.Int32) >= req.Duration) || (lastWeek.Valid && int(lastWeek.Int32)*7 >= req.Duration) {
+		http.Error(w, "Duration is too short for the module's lectures and tutorials", http.StatusBadRequest)
+		return
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	defer tx.Rollback()
+
+	sqlquery = `UPDATE module SET title = $1, image = $2, description = $3, duration = $4, min_attendance = $5, min_lectures = $6, min_mastery = $7,
+								tags = $8, difficulty = $9, language = $10
+							WHERE module_id = $11`
+	if !execAdminUpdate(w, tx, sqlquery, req.Title, req.Image, req.Description, req.Duration, req.MinAttendance, req.MinLectures, req.MinMastery,
+		pq.Array(req.Tags), req.Difficulty, req.Language, moduleId) {
+		return
+	}
+
+	if !commitAudited(w, tx, lemail, "update", "module", moduleId, req) {
+		return
+	}
+
+	writeAdminRes(w, http.StatusOK, req)
+}
+
+// Modules can only be deleted while nothing references them
+func deleteModule(w http.ResponseWriter, r *http.Request) {
+	lemail := r.Header.Get("X-User-Claim")
+	moduleId := mux.Vars(r)["id"]
+
+	var references int
+	sqlquery := `SELECT (SELECT COUNT(*) FROM lecture WHERE module = $1) + (SELECT COUNT(*) FROM tutorial WHERE module = $1)
+								+ (SELECT COUNT(*) FROM cohort WHERE module = $1) + (SELECT COUNT(*) FROM self_paced_enrollment WHERE module = $1)`
+	if err := db.QueryRow(sqlquery, moduleId).Scan(&references); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	if references > 0 {
+		http.Error(w, "Module still has content, cohorts or learners", http.StatusConflict)
+		return
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	defer tx.Rollback()
+
+	for _, sqlquery := range []string{
+		`DELETE FROM module_waitlist WHERE module = $1`,
+		`DELETE FROM module_version WHERE module = $1`,
+	} {
+		if _, err := tx.Exec(sqlquery, moduleId); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+	}
+
+	sqlquery = `DELETE FROM module WHERE module_id = $1`
+	if !execAdminUpdate(w, tx, sqlquery, moduleId) {
+		return
+	}
+
+	if !commitAudited(w, tx, lemail, "delete", "module", moduleId, nil) {
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+}
+
+func validateModule(module adminModule) string {
+	switch {
+	case strings.TrimSpace(module.Title) == "":
+		return "Title can't be empty"
+	case module.Duration <= 0:
+		return "Duration has to be at least a day"
+	case module.MinAttendance < 0 || module.MinAttendance > 100:
+		return "Minimum attendance has to be a percentage"
+	case module.MinLectures < 0 || module.MinLectures > 100:
+		return "Minimum lecture completion has to be a percentage"
+	case module.MinMastery < 0 || module.MinMastery > 100:
+		return "Minimum flashcard mastery has to be a percentage"
+	case !moduleDifficulties[module.Difficulty]:
+		return "Difficulty has to be beginner, intermediate or advanced"
+	case !languageRegex.MatchString(module.Language):
+		return "Language has to be a two letter code like en"
+	case len(module.Tags) > maxModuleTags:
+		return "A module can have at most 10 tags"
+	}
+
+	for _, tag := range module.Tags {
+		if tag == "" || len(tag) > 32 {
+			return "Tags have to be between 1 and 32 characters"
+		}
+	}
+
+	return ""
+}
+
+// Defaults to a beginner module in English, tags are matched lowercase so they are stored that way
+func (module *adminModule) normalize() {
+	if module.Difficulty == "" {
+		module.Difficulty = "beginner"
+	}
+
+	if module.Language == "" {
+		module.Language = "en"
+	}
+
+	tags := []string{}
+	seen := make(map[string]bool)
+	for _, tag := range module.Tags {
+		tag = strings.ToLower(strings.TrimSpace(tag))
+		if !seen[tag] {
+			seen[tag] = true
+			tags = append(tags, tag)
+		}
+	}
+	module.Tags = tags
+}
+
+// Returns a module with all its lectures, flashcards and tutorials
+// The version query parameter picks an older version, by default the draft is shown when there is one
+func getModuleContent(w http.ResponseWriter, r *http.Request) {
+	moduleId := mux.Vars(r)["id"]
+
+	var res moduleContentRes
+	var published sql.NullInt32
+
+	sqlquery := `SELECT module_id, title, image, description, duration, min_attendance, min_lectures, min_mastery, tags, difficulty, language, published_version,
+								COALESCE((SELECT MAX(version) FROM module_version WHERE module = module_id AND published_at IS NULL), published_version, 1)
+							FROM module WHERE module_id = $1`
+	if err := db.QueryRow(sqlquery, moduleId).Scan(&res.Module.Id, &res.Module.Title, &res.Module.Image, &res.Module.Description, &res.Module.Duration, &res.Module.MinAttendance, &res.Module.MinLectures, &res.Module.MinMastery, pq.Array(&res.Module.Tags), &res.Module.Difficulty, &res.Module.Language, &published, &res.Version); err != nil {
+		if err == sql.ErrNoRows {
+			http.Error(w, "Invalid module id", http.StatusNotFound)
+		} else {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+		}
+		return
+	}
+
+	if value := r.URL.Query().Get("version"); value != "" {
+		version, err := strconv.Atoi(value)
+		if err != nil {
+			http.Error(w, "Invalid query parameters", http.StatusBadRequest)
+			return
+		}
+
+		res.Version = version
+	}
+
+	res.PublishedVersion = nullIntPtr(published)
+	res.Draft = res.Version > int(published.Int32)
+
+	sqlquery = `SELECT lecture_id, content_key, title, description, video_link, date_offset, duration_seconds, min_watch_percent FROM lecture
+							WHERE module = $1 AND version = $2 ORDER BY date_offset`
+	result, err := db.Query(sqlquery, moduleId, res.Version)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	defer result.Close()
+
+	lectureIndex := make(map[string]int)
+	for result.Next() {
+		var lecture adminLecture
+		if err := result.Scan(&lecture.Id, &lecture.ContentKey, &lecture.Title, &lecture.Description, &lecture.VideoLink, &lecture.DateOffset, &lecture.DurationSeconds, &lecture.MinWatchPercent); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		lectureIndex[lecture.Id] = len(res.Lectures)
+		res.Lectures = append(res.Lectures, lecture)
+	}
+
+	sqlquery = `SELECT flashcard_id, flashcard.content_key, top_side, bottom_side, lecture FROM flashcard
+							INNER JOIN lecture ON lecture.lecture_id = flashcard.lecture
+							WHERE lecture.module = $1 AND lecture.version = $2 ORDER BY flashcard_id`
+	result, err = db.Query(sqlquery, moduleId, res.Version)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	defer result.Close()
+
+	for result.Next() {
+		var card adminFlashcard
+		var lectureId string
+		if err := result.Scan(&card.Id, &card.ContentKey, &card.TopSide, &card.BottomSide, &lectureId); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		lecture := &res.Lectures[lectureIndex[lectureId]]
+		lecture.Flashcards = append(lecture.Flashcards, card)
+	}
+
+	sqlquery = `SELECT tutorial_id, content_key, week, title, description FROM tutorial WHERE module = $1 AND version = $2 ORDER BY week`
+	result, err = db.Query(sqlquery, moduleId, res.Version)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	defer result.Close()
+
+	for result.Next() {
+		var tutorial adminTutorial
+		if err := result.Scan(&tutorial.Id, &tutorial.ContentKey, &tutorial.Week, &tutorial.Title, &tutorial.Description); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		res.Tutorials = append(res.Tutorials, tutorial)
+	}
+
+	writeAdminRes(w, http.StatusOK, res)
+}
+
+/******************* LECTURES *******************************/
+
+// Lectures are added to the module's draft
+func createLecture(w http.ResponseWriter, r *http.Request) {
+	lemail := r.Header.Get("X-User-Claim")
+	moduleId := mux.Vars(r)["id"]
+
+	var req adminLecture
+	if !decodeAdminRequest(w, r, &req) {
+		return
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	defer tx.Rollback()
+
+	version, err := ensureDraftVersion(tx, moduleId)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			http.Error(w, "Invalid module id", http.StatusNotFound)
+		} else {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+		}
+		return
+	}
+
+	if msg := validateLecture(tx, moduleId, version, "", req); msg != "" {
+		http.Error(w, msg, http.StatusBadRequest)
+		return
+	}
+
+	sqlquery := `INSERT INTO lecture(title, description, video_link, date_offset, module, duration_seconds, min_watch_percent, version)
+							VALUES ($1, $2, $3, $4, $5, $6, $7, $8) RETURNING lecture_id, content_key`
+	if err := tx.QueryRow(sqlquery, req.Title, req.Description, req.VideoLink, req.DateOffset, moduleId, req.DurationSeconds, req.MinWatchPercent, version).Scan(&req.Id, &req.ContentKey); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	if !commitAudited(w, tx, lemail, "create", "lecture", req.Id, req) {
+		return
+	}
+
+	writeAdminRes(w, http.StatusCreated, req)
+}
+
+// Edits the lecture's copy in the draft, learners only see the change once it is published
+func updateLecture(w http.ResponseWriter, r *http.Request) {
+	lemail := r.Header.Get("X-User-Claim")
+
+	var req adminLecture
+	if !decodeAdminRequest(w, r, &req) {
+		return
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	defer tx.Rollback()
+
+	lectureId, moduleId, version, err := draftLecture(tx, mux.Vars(r)["id"])
+	if err != nil {
+		if err == sql.ErrNoRows {
+			http.Error(w, "Invalid lecture id", http.StatusNotFound)
+		} else {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+		}
+		return
+	}
+
+	if msg := validateLecture(tx, moduleId, version, lectureId, req); msg != "" {
+		http.Error(w, msg, http.StatusBadRequest)
+		return
+	}
+
+	sqlquery := `UPDATE lecture SET title = $1, description = $2, video_link = $3, date_offset = $4, duration_seconds = $5, min_watch_percent = $6
+							WHERE lecture_id = $7 RETURNING lecture_id, content_key`
+	if err := tx.QueryRow(sqlquery, req.Title, req.Description, req.VideoLink, req.DateOffset, req.DurationSeconds, req.MinWatchPercent, lectureId).Scan(&req.Id, &req.ContentKey); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	if !commitAudited(w, tx, lemail, "update", "lecture", lectureId, req) {
+		return
+	}
+
+	writeAdminRes(w, http.StatusOK, req)
+}
+
+// Removes the lecture from the draft, together with its flashcards, quiz and prerequisites
+func deleteLecture(w http.ResponseWriter, r *http.Request) {
+	lemail := r.Header.Get("X-User-Claim")
+
+	tx, err := db.Begin()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	defer tx.Rollback()
+
+	lectureId, _, _, err := draftLecture(tx, mux.Vars(r)["id"])
+	if err != nil {
+		if err == sql.ErrNoRows {
+			http.Error(w, "Invalid lecture id", http.StatusNotFound)
+		} else {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+		}
+		return
+	}
+
+	var learners int
+	sqlquery := `SELECT COUNT(*) FROM learner_lecture WHERE lecture = $1`
+	if err := tx.QueryRow(sqlquery, lectureId).Scan(&learners); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	if learners > 0 {
+		http.Error(w, "Lecture is already scheduled for learners", http.StatusConflict)
+		return
+	}
+
+	// Everything hanging off the lecture goes with it
+	for _, sqlquery := range []string{
+		`DELETE FROM flashcard WHERE lecture = $1`,
+		`DELETE FROM quiz_question WHERE lecture = $1`,
+		`DELETE FROM quiz WHERE lecture = $1`,
+		`DELETE FROM lecture_prerequisite WHERE lecture = $1 OR prerequisite = $1`,
+	} {
+		if _, err := tx.Exec(sqlquery, lectureId); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+	}
+
+	sqlquery = `DELETE FROM lecture WHERE lecture_id = $1`
+	if !execAdminUpdate(w, tx, sqlquery, lectureId) {
+		return
+	}
+
+	if !commitAudited(w, tx, lemail, "delete", "lecture", lectureId, nil) {
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+}
+
+// Finds the copy of a lecture in the draft of its module, creating the draft when there is none
+// Returns the draft lecture id, the module and the draft version
+func draftLecture(tx *sql.Tx, lectureId string) (string, string, int, error) {
+	var moduleId, contentKey string
+	sqlquery := `SELECT module, content_key FROM lecture WHERE lecture_id = $1`
+	if err := tx.QueryRow(sqlquery, lectureId).Scan(&moduleId, &contentKey); err != nil {
+		return "", "", 0, err
+	}
+
+	version, err := ensureDraftVersion(tx, moduleId)
+	if err != nil {
+		return "", "", 0, err
+	}
+
+	sqlquery = `SELECT lecture_id FROM lecture WHERE module = $1 AND version = $2 AND content_key = $3`
+	err = tx.QueryRow(sqlquery, moduleId, version, contentKey).Scan(&lectureId)
+
+	return lectureId, moduleId, version, err
+}
+
+// Date offsets have to be unique within the module version and fall inside the module's duration
+func validateLecture(q queryRower, moduleId string, version int, lectureId string, lecture adminLecture) string {
+	switch {
+	case strings.TrimSpace(lecture.Title) == "":
+		return "Title can't be empty"
+	case lecture.DateOffset < 0:
+		return "Date offset can't be negative"
+	case lecture.DurationSeconds < 0:
+		return "Duration can't be negative"
+	case lecture.MinWatchPercent < 0 || lecture.MinWatchPercent > 100:
+		return "Minimum watch percent has to be a percentage"
+	case lecture.MinWatchPercent > 0 && lecture.DurationSeconds == 0:
+		// Watch progress can't be measured without a duration, so the requirement would never apply
+		return "Minimum watch percent needs the duration of the video"
+	}
+
+	if _, err := url.ParseRequestURI(lecture.VideoLink); err != nil {
+		return "Invalid video link"
+	}
+
+	var duration, clashes int
+	sqlquery := `SELECT duration, (SELECT COUNT(*) FROM lecture WHERE module = $1 AND version = $2 AND date_offset = $3 AND lecture_id::text <> $4)
+							FROM module WHERE module_id = $1`
+	if err := q.QueryRow(sqlquery, moduleId, version, lecture.DateOffset, lectureId).Scan(&duration, &clashes); err != nil {
+		return "Invalid module id"
+	}
+
+	if lecture.DateOffset >= duration {
+		return "Date offset has to fall within the module's duration"
+	}
+
+	if clashes > 0 {
+		return "Another lecture of the module already has the date offset"
+	}
+
+	return ""
+}
+
+/******************* TUTORIALS ******************************/
+
+// Tutorials are added to the module's draft
+func createTutorial(w http.ResponseWriter, r *http.Request) {
+	lemail := r.Header.Get("X-User-Claim")
+	moduleId := mux.Vars(r)["id"]
+
+	var req adminTutorial
+	if !decodeAdminRequest(w, r, &req) {
+		return
+	}
+
+	if msg := validateTutorial(moduleId, req); msg != "" {
+		http.Error(w, msg, http.StatusBadRequest)
+		return
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	defer tx.Rollback()
+
+	version, err := ensureDraftVersion(tx, moduleId)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	sqlquery := `INSERT INTO tutorial(week, title, description, module, version) VALUES ($1, $2, $3, $4, $5) RETURNING tutorial_id, content_key`
+	if err := tx.QueryRow(sqlquery, req.Week, req.Title, req.Description, moduleId, version).Scan(&req.Id, &req.ContentKey); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	if !commitAudited(w, tx, lemail, "create", "tutorial", req.Id, req) {
+		return
+	}
+
+	writeAdminRes(w, http.StatusCreated, req)
+}
+
+// Edits the tutorial's copy in the draft, learners only see the change once it is published
+func updateTutorial(w http.ResponseWriter, r *http.Request) {
+	lemail := r.Header.Get("X-User-Claim")
+
+	var req adminTutorial
+	if !decodeAdminRequest(w, r, &req) {
+		return
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	defer tx.Rollback()
+
+	tutorialId, moduleId, err := draftTutorial(tx, mux.Vars(r)["id"])
+	if err != nil {
+		if err == sql.ErrNoRows {
+			http.Error(w, "Invalid tutorial id", http.StatusNotFound)
+		} else {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+		}
+		return
+	}
+
+	if msg := validateTutorial(moduleId, req); msg != "" {
+		http.Error(w, msg, http.StatusBadRequest)
+		return
+	}
+
+	sqlquery := `UPDATE tutorial SET week = $1, title = $2, description = $3 WHERE tutorial_id = $4 RETURNING tutorial_id, content_key`
+	if err := tx.QueryRow(sqlquery, req.Week, req.Title, req.Description, tutorialId).Scan(&req.Id, &req.ContentKey); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	if !commitAudited(w, tx, lemail, "update", "tutorial", tutorialId, req) {
+		return
+	}
+
+	writeAdminRes(w, http.StatusOK, req)
+}
+
+// Removes the tutorial from the draft
+func deleteTutorial(w http.ResponseWriter, r *http.Request) {
+	lemail := r.Header.Get("X-User-Claim")
+
+	tx, err := db.Begin()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	defer tx.Rollback()
+
+	tutorialId, _, err := draftTutorial(tx, mux.Vars(r)["id"])
+	if err != nil {
+		if err == sql.ErrNoRows {
+			http.Error(w, "Invalid tutorial id", http.StatusNotFound)
+		} else {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+		}
+		return
+	}
+
+	var learners int
+	sqlquery := `SELECT COUNT(*) FROM learner_tutorial WHERE tutorial = $1`
+	if err := tx.QueryRow(sqlquery, tutorialId).Scan(&learners); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	if learners > 0 {
+		http.Error(w, "Tutorial is already scheduled for learners", http.StatusConflict)
+		return
+	}
+
+	sqlquery = `DELETE FROM tutorial WHERE tutorial_id = $1`
+	if !execAdminUpdate(w, tx, sqlquery, tutorialId) {
+		return
+	}
+
+	if !commitAudited(w, tx, lemail, "delete", "tutorial", tutorialId, nil) {
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+}
+
+// Finds the copy of a tutorial in the draft of its module, creating the draft when there is none
+// Returns the draft tutorial id and the module
+func draftTutorial(tx *sql.Tx, tutorialId string) (string, string, error) {
+	var moduleId, contentKey string
+	sqlquery := `SELECT module, content_key FROM tutorial WHERE tutorial_id = $1`
+	if err := tx.QueryRow(sqlquery, tutorialId).Scan(&moduleId, &contentKey); err != nil {
+		return "", "", err
+	}
+
+	version, err := ensureDraftVersion(tx, moduleId)
+	if err != nil {
+		return "", "", err
+	}
+
+	sqlquery = `SELECT tutorial_id FROM tutorial WHERE module = $1 AND version = $2 AND content_key = $3`
+	err = tx.QueryRow(sqlquery, moduleId, version, contentKey).Scan(&tutorialId)
+
+	return tutorialId, moduleId, err
+}
+
+// Weeks have to fall inside the module's duration
+func validateTutorial(moduleId string, tutorial adminTutorial) string {
+	switch {
+	case strings.TrimSpace(tutorial.Title) == "":
+		return "Title can't be empty"
+	case tutorial.Week < 0:
+		return "Week can't be negative"
+	}
+
+	var duration int
+	sqlquery := `SELECT duration FROM module WHERE module_id = $1`
+	if err := db.QueryRow(sqlquery, moduleId).Scan(&duration); err != nil {
+		return "Invalid module id"
+	}
+
+	if tutorial.Week*7 >= duration {
+		return "Week has to fall within the module's duration"
+	}
+
+	return ""
+}
+
+/******************* FLASHCARDS *****************************/
+
+// Flashcards are added to the draft copy of the lecture
+func createFlashcard(w http.ResponseWriter, r *http.Request) {
+	lemail := r.Header.Get("X-User-Claim")
+
+	var req adminFlashcard
+	if !decodeAdminRequest(w, r, &req) {
+		return
+	}
+
+	if msg := validateFlashcard(req); msg != "" {
+		http.Error(w, msg, http.StatusBadRequest)
+		return
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	defer tx.Rollback()
+
+	lectureId, _, _, err := draftLecture(tx, mux.Vars(r)["id"])
+	if err != nil {
+		if err == sql.ErrNoRows {
+			http.Error(w, "Invalid lecture id", http.StatusNotFound)
+		} else {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+		}
+		return
+	}
+
+	sqlquery := `INSERT INTO flashcard(top_side, bottom_side, lecture) VALUES ($1, $2, $3) RETURNING flashcard_id, content_key`
+	if err := tx.QueryRow(sqlquery, req.TopSide, req.BottomSide, lectureId).Scan(&req.Id, &req.ContentKey); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	if !commitAudited(w, tx, lemail, "create", "flashcard", req.Id, req) {
+		return
+	}
+
+	writeAdminRes(w, http.StatusCreated, req)
+}
+
+// Edits the flashcard's copy in the draft, learners only see the change once it is published
+func updateFlashcard(w http.ResponseWriter, r *http.Request) {
+	lemail := r.Header.Get("X-User-Claim")
+
+	var req adminFlashcard
+	if !decodeAdminRequest(w, r, &req) {
+		return
+	}
+
+	if msg := validateFlashcard(req); msg != "" {
+		http.Error(w, msg, http.StatusBadRequest)
+		return
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	defer tx.Rollback()
+
+	flashcardId, err := draftFlashcard(tx, mux.Vars(r)["id"])
+	if err != nil {
+		if err == sql.ErrNoRows {
+			http.Error(w, "Invalid flashcard id", http.StatusNotFound)
+		} else {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+		}
+		return
+	}
+
+	sqlquery := `UPDATE flashcard SET top_side = $1, bottom_side = $2 WHERE flashcard_id = $3 RETURNING flashcard_id, content_key`
+	if err := tx.QueryRow(sqlquery, req.TopSide, req.BottomSide, flashcardId).Scan(&req.Id, &req.ContentKey); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	if !commitAudited(w, tx, lemail, "update", "flashcard", flashcardId, req) {
+		return
+	}
+
+	writeAdminRes(w, http.StatusOK, req)
+}
+
+// Removes the flashcard from the draft
+func deleteFlashcard(w http.ResponseWriter, r *http.Request) {
+	lemail := r.Header.Get("X-User-Claim")
+
+	tx, err := db.Begin()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	defer tx.Rollback()
+
+	flashcardId, err := draftFlashcard(tx, mux.Vars(r)["id"])
+	if err != nil {
+		if err == sql.ErrNoRows {
+			http.Error(w, "Invalid flashcard id", http.StatusNotFound)
+		} else {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+		}
+		return
+	}
+
+	var learners int
+	sqlquery := `SELECT COUNT(*) FROM learner_flashcard WHERE flashcard = $1`
+	if err := tx.QueryRow(sqlquery, flashcardId).Scan(&learners); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	if learners > 0 {
+		http.Error(w, "Flashcard is already in learners' decks", http.StatusConflict)
+		return
+	}
+
+	sqlquery = `DELETE FROM flashcard WHERE flashcard_id = $1`
+	if !execAdminUpdate(w, tx, sqlquery, flashcardId) {
+		return
+	}
+
+	if !commitAudited(w, tx, lemail, "delete", "flashcard", flashcardId, nil) {
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+}
+
+// Finds the copy of a flashcard in the draft of its module, creating the draft when there is none
+func draftFlashcard(tx *sql.Tx, flashcardId string) (string, error) {
+	var lectureId, contentKey string
+	sqlquery := `SELECT lecture, content_key FROM flashcard WHERE flashcard_id = $1`
+	if err := tx.QueryRow(sqlquery, flashcardId).Scan(&lectureId, &contentKey); err != nil {
+		return "", err
+	}
+
+	lectureId, _, _, err := draftLecture(tx, lectureId)
+	if err != nil {
+		return "", err
+	}
+
+	sqlquery = `SELECT flashcard_id FROM flashcard WHERE lecture = $1 AND content_key = $2`
+	err = tx.QueryRow(sqlquery, lectureId, contentKey).Scan(&flashcardId)
+
+	return flashcardId, err
+}
+
+func validateFlashcard(card adminFlashcard) string {
+	if strings.TrimSpace(card.TopSide) == "" || strings.TrimSpace(card.BottomSide) == "" {
+		return "Both sides of the flashcard need content"
+	}
+
+	return ""
+}
+
+/******************* AUDIT **********************************/
+
+// Lists the latest audit entries, optionally for a single entity
+func getAuditLog(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	entity := query.Get("entity")
+	entityId := query.Get("entity_id")
+
+	var res []auditEntry
+
+	sqlquery := `SELECT audit_id, actor, action, entity, entity_id, payload, created_at FROM audit_log
+							WHERE ($1 = '' OR entity = $1) AND ($2 = '' OR entity_id = $2)
+							ORDER BY created_at DESC LIMIT 100`
+	result, err := db.Query(sqlquery, entity, entityId)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	defer result.Close()
+
+	for result.Next() {
+		var entry auditEntry
+		var payload []byte
+		if err := result.Scan(&entry.Id, &entry.Actor, &entry.Action, &entry.Entity, &entry.EntityId, &payload, &entry.CreatedAt); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		entry.Payload = payload
+		res = append(res, entry)
+	}
+
+	writeAdminRes(w, http.StatusOK, res)
+}
+
+// Records the change in the audit log and commits it, errors are written to the response
+func commitAudited(w http.ResponseWriter, tx *sql.Tx, actor string, action string, entity string, entityId string, payload interface{}) bool {
+	if err := writeAudit(tx, actor, action, entity, entityId, payload); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return false
+	}
+
+	if err := tx.Commit(); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return false
+	}
+
+	return true
+}
+
+func writeAudit(tx *sql.Tx, actor string, action string, entity string, entityId string, payload interface{}) error {
+	dpayload, err := json.Marshal(payload)
+	if err != nil {
+		return err
+	}
+
+	if payload == nil {
+		dpayload = []byte("{}")
+	}
+
+	sqlquery := `INSERT INTO audit_log(actor, action, entity, entity_id, payload) VALUES ($1, $2, $3, $4, $5)`
+	_, err = tx.Exec(sqlquery, actor, action, entity, entityId, string(dpayload))
+
+	return err
+}
+
+// Runs an update or delete that has to hit a row, errors are written to the response
+func execAdminUpdate(w http.ResponseWriter, tx *sql.Tx, sqlquery string, args ...interface{}) bool {
+	result, err := tx.Exec(sqlquery, args...)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return false
+	}
+
+	if affected, err := result.RowsAffected(); err != nil || affected == 0 {
+		http.Error(w, "Not found", http.StatusNotFound)
+		return false
+	}
+
+	return true
+}
+
+func decodeAdminRequest(w http.ResponseWriter, r *http.Request, req interface{}) bool {
+	decoder := json.NewDecoder(r.Body)
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return false
+	}
+
+	return true
+}
+
+func writeAdminRes(w http.ResponseWriter, status int, res interface{}) {
+	dres, err := json.Marshal(res)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(status)
+	w.Write(dres)
+}
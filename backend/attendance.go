@@ -0,0 +1,262 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"net/http"
+	"time"
+)
+
+// Attendance values, stored in learner_tutorial.attendance, NULL means not recorded yet
+const (
+	ATTENDANCE_PRESENT = iota
+	ATTENDANCE_ABSENT
+	ATTENDANCE_EXCUSED
+)
+
+type attendanceRecord struct {
+	Learner    string `json:"learner"`
+	Attendance *int   `json:"attendance"`
+}
+
+// Records attendance for the learners of a cohort at a tutorial
+func recordAttendance(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	tutorialId := query.Get("tutorial")
+	cohortId := query.Get("cohort")
+
+	if tutorialId == "" || cohortId == "" {
+		http.Error(w, "Invalid query parameters", http.StatusBadRequest)
+		return
+	}
+
+	var req []attendanceRecord
+
+	// Parsing request body
+	decoder := json.NewDecoder(r.Body)
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(&req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	for _, record := range req {
+		if record.Attendance == nil || *record.Attendance < ATTENDANCE_PRESENT || *record.Attendance > ATTENDANCE_EXCUSED {
+			http.Error(w, "Invalid attendance for "+record.Learner, http.StatusBadRequest)
+			return
+		}
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	defer tx.Rollback()
+
+	// Only learners of the cohort that are scheduled for the tutorial can be marked, once it has started
+	sqlquery := `UPDATE learner_tutorial SET attendance = $1
+							FROM learner_cohort
+							WHERE learner_cohort.learner = learner_tutorial.learner AND learner_cohort.cohort = $2
+							AND learner_tutorial.tutorial = $3 AND learner_tutorial.learner = $4 AND learner_tutorial.scheduled_datetime <= NOW()`
+	for _, record := range req {
+		result, err := tx.Exec(sqlquery, *record.Attendance, cohortId, tutorialId, record.Learner)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		if affected, err := result.RowsAffected(); err != nil || affected == 0 {
+			http.Error(w, "Learner not scheduled for the tutorial or it hasn't started: "+record.Learner, http.StatusBadRequest)
+			return
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusAccepted)
+}
+
+type cohortAttendanceRes struct {
+	Learner           string    `json:"learner"`
+	FirstName         string    `json:"first_name"`
+	LastName          string    `json:"last_name"`
+	ScheduledDateTime time.Time `json:"scheduled_time"`
+	Attendance        *int      `json:"attendance"`
+}
+
+// Lists the attendance roster of a cohort for a tutorial
+func getCohortAttendance(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	tutorialId := query.Get("tutorial")
+	cohortId := query.Get("cohort")
+
+	if tutorialId == "" || cohortId == "" {
+		http.Error(w, "Invalid query parameters", http.StatusBadRequest)
+		return
+	}
+
+	var res []cohortAttendanceRes
+
+	sqlquery := `SELECT learner.email, learner.first_name, learner.last_name, learner_tutorial.scheduled_datetime, learner_tutorial.attendance
+							FROM learner_tutorial
+							INNER JOIN learner_cohort ON learner_cohort.learner = learner_tutorial.learner AND learner_cohort.cohort = $1
+							INNER JOIN learner ON learner.email = learner_tutorial.learner
+							WHERE learner_tutorial.tutorial = $2
+							ORDER BY learner.email`
+	result, err := db.Query(sqlquery, cohortId, tutorialId)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	defer result.Close()
+
+	for result.Next() {
+		var record cohortAttendanceRes
+		var attendance sql.NullInt32
+		if err := result.Scan(&record.Learner, &record.FirstName, &record.LastName, &record.ScheduledDateTime, &attendance); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		record.Attendance = nullIntPtr(attendance)
+		res = append(res, record)
+	}
+
+	if len(res) == 0 {
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+
+	dres, err := json.Marshal(res)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Write(dres)
+}
+
+// Rate is the percentage of recorded tutorials attended, excused tutorials don't count against it
+// Required is the module's minimum attendance rate for completion
+type attendanceSummary struct {
+	Present    int  `json:"present"`
+	Absent     int  `json:"absent"`
+	Excused    int  `json:"excused"`
+	Unrecorded int  `json:"unrecorded"`
+	Rate       int  `json:"rate"`
+	Required   int  `json:"required"`
+	Meets      bool `json:"meets_requirement"`
+}
+
+func getAttendanceSummary(learnerId string, moduleId string) (attendanceSummary, error) {
+	var summary attendanceSummary
+
+	sqlquery := `SELECT min_attendance FROM module WHERE module_id = $1`
+	if err := db.QueryRow(sqlquery, moduleId).Scan(&summary.Required); err != nil {
+		return summary, err
+	}
+
+	sqlquery = `SELECT COUNT(*) FILTER (WHERE attendance = $3),
+								COUNT(*) FILTER (WHERE attendance = $4),
+								COUNT(*) FILTER (WHERE attendance = $5),
+								COUNT(*) FILTER (WHERE attendance IS NULL AND scheduled_datetime < NOW())
+							FROM learner_tutorial INNER JOIN tutorial ON tutorial.tutorial_id = learner_tutorial.tutorial
+							WHERE learner_tutorial.learner = $1 AND tutorial.module = $2`
+	if err := db.QueryRow(sqlquery, learnerId, moduleId, ATTENDANCE_PRESENT, ATTENDANCE_ABSENT, ATTENDANCE_EXCUSED).Scan(&summary.Present, &summary.Absent, &summary.Excused, &summary.Unrecorded); err != nil {
+		return summary, err
+	}
+
+	summary.Rate = 100
+	if summary.Present+summary.Absent > 0 {
+		summary.Rate = 100 * summary.Present / (summary.Present + summary.Absent)
+	}
+	summary.Meets = summary.Rate >= summary.Required
+
+	return summary, nil
+}
+
+type learnerAttendanceRes struct {
+	Summary   attendanceSummary       `json:"summary"`
+	Tutorials []tutorialAttendanceRes `json:"tutorials"`
+}
+
+type tutorialAttendanceRes struct {
+	Id            string    `json:"id"`
+	Title         string    `json:"title"`
+	ScheduledTime time.Time `json:"scheduled_time"`
+	Attendance    *int      `json:"attendance"`
+}
+
+// Returns the learner's own attendance record for a module
+func getSelfAttendance(w http.ResponseWriter, r *http.Request) {
+	lemail := r.Header.Get("X-User-Claim")
+	query := r.URL.Query()
+	moduleId := query.Get("module")
+
+	if moduleId == "" {
+		http.Error(w, "Invalid query parameters", http.StatusBadRequest)
+		return
+	}
+
+	var res learnerAttendanceRes
+
+	summary, err := getAttendanceSummary(lemail, moduleId)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			http.Error(w, "Invalid module id", http.StatusBadRequest)
+		} else {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+		}
+		return
+	}
+
+	res.Summary = summary
+
+	sqlquery := `SELECT tutorial_id, title, scheduled_datetime, attendance FROM tutorial
+							INNER JOIN learner_tutorial ON learner_tutorial.tutorial = tutorial.tutorial_id AND learner_tutorial.learner = $1
+							WHERE module = $2 AND scheduled_datetime < NOW()
+							ORDER BY scheduled_datetime`
+	result, err := db.Query(sqlquery, lemail, moduleId)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	defer result.Close()
+
+	for result.Next() {
+		var tutorial tutorialAttendanceRes
+		var attendance sql.NullInt32
+		if err := result.Scan(&tutorial.Id, &tutorial.Title, &tutorial.ScheduledTime, &attendance); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		tutorial.Attendance = nullIntPtr(attendance)
+		res.Tutorials = append(res.Tutorials, tutorial)
+	}
+
+	dres, err := json.Marshal(res)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Write(dres)
+}
+
+// Turns a nullable column into a pointer, so that NULL marshals to null
+func nullIntPtr(n sql.NullInt32) *int {
+	if !n.Valid {
+		return nil
+	}
+
+	value := int(n.Int32)
+	return &value
+}
@@ -0,0 +1,360 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// Tutorials don't store an end time, calendar entries assume they take tutorialDuration
+const tutorialDuration = time.Hour
+
+type calendarRes struct {
+	URL string `json:"url"`
+}
+
+// Returns the learner's calendar subscription url, creating the secret token on first use
+func getCalendar(w http.ResponseWriter, r *http.Request) {
+	lemail := r.Header.Get("X-User-Claim")
+
+	var token sql.NullString
+	sqlquery := `SELECT calendar_token FROM learner WHERE email = $1`
+	if err := db.QueryRow(sqlquery, lemail).Scan(&token); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	if !token.Valid {
+		newToken, err := setCalendarToken(lemail)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		token.String = newToken
+	}
+
+	writeCalendarRes(w, r, token.String)
+}
+
+// Replaces the learner's calendar token, so a leaked subscription url stops working
+func resetCalendar(w http.ResponseWriter, r *http.Request) {
+	lemail := r.Header.Get("X-User-Claim")
+
+	token, err := setCalendarToken(lemail)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	writeCalendarRes(w, r, token)
+}
+
+func setCalendarToken(learnerId string) (string, error) {
+	buf := make([]byte, 32)
+	if _, err := rand.Read(buf); err != nil {
+		return "", err
+	}
+
+	token := hex.EncodeToString(buf)
+
+	sqlquery := `UPDATE learner SET calendar_token = $1 WHERE email = $2`
+	_, err := db.Exec(sqlquery, token, learnerId)
+
+	return token, err
+}
+
+func writeCalendarRes(w http.ResponseWriter, r *http.Request, token string) {
+	res := calendarRes{URL: fmt.Sprintf("https://%s/api/v0.2/calendar/%s.ics", r.Host, token)}
+
+	dres, err := json.Marshal(res)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Write(dres)
+}
+
+type calendarEvent struct {
+	Kind        string
+	Id          string
+	Title       string
+	Description string
+	Sequence    int
+	Date        time.Time
+	DateTime    time.Time
+	Location    *time.Location
+}
+
+// Serves the iCalendar feed of a learner's lectures and tutorials, the token is the only authentication
+func getCalendarFeed(w http.ResponseWriter, r *http.Request) {
+	token := mux.Vars(r)["token"]
+
+	var lemail string
+	var timezone string
+	sqlquery := `SELECT email, timezone FROM learner WHERE calendar_token = $1`
+	if err := db.QueryRow(sqlquery, token).Scan(&lemail, &timezone); err != nil {
+		if err == sql.ErrNoRows {
+			http.Error(w, "Invalid calendar", http.StatusNotFound)
+		} else {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+		}
+		return
+	}
+
+	var events []calendarEvent
+
+	// Lectures are whole days in the learner's own calendar
+	sqlquery = `SELECT lecture_id, title, description, scheduled_date, sequence FROM lecture
+							INNER JOIN learner_lecture ON learner_lecture.lecture = lecture.lecture_id AND learner_lecture.learner = $1
+							ORDER BY scheduled_date`
+	result, err := db.Query(sqlquery, lemail)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	defer result.Close()
+
+	for result.Next() {
+		event := calendarEvent{Kind: "lecture"}
+		if err := result.Scan(&event.Id, &event.Title, &event.Description, &event.Date, &event.Sequence); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		event.Title = "Microlecture: " + event.Title
+		events = append(events, event)
+	}
+
+	// Tutorials are shown in the timezone of the learner's cohort
+	sqlquery = `SELECT tutorial_id, title, description, scheduled_datetime, sequence,
+								COALESCE((SELECT cohort.timezone FROM learner_cohort INNER JOIN cohort ON cohort.cohort_id = learner_cohort.cohort
+									WHERE learner_cohort.learner = $1 AND cohort.module = tutorial.module), 'UTC')
+							FROM tutorial
+							INNER JOIN learner_tutorial ON learner_tutorial.tutorial = tutorial.tutorial_id AND learner_tutorial.learner = $1
+							ORDER BY scheduled_datetime`
+	result, err = db.Query(sqlquery, lemail)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	defer result.Close()
+
+	for result.Next() {
+		event := calendarEvent{Kind: "tutorial"}
+		var cohortTimezone string
+		if err := result.Scan(&event.Id, &event.Title, &event.Description, &event.DateTime, &event.Sequence, &cohortTimezone); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		event.Location, err = time.LoadLocation(cohortTimezone)
+		if err != nil {
+			event.Location = time.UTC
+		}
+
+		event.Title = "Tutorial: " + event.Title
+		events = append(events, event)
+	}
+
+	w.Header().Set("Content-Type", "text/calendar; charset=utf-8")
+	w.Write([]byte(buildCalendar(lemail, timezone, events)))
+}
+
+// Builds the VCALENDAR document, with a VTIMEZONE for every timezone the tutorials use
+func buildCalendar(learnerId string, timezone string, events []calendarEvent) string {
+	var cal icalWriter
+
+	cal.line("BEGIN:VCALENDAR")
+	cal.line("VERSION:2.0")
+	cal.line("PRODID:-//Axiom Academy//Microuniversity//EN")
+	cal.line("CALSCALE:GREGORIAN")
+	cal.line("METHOD:PUBLISH")
+	cal.line("X-WR-CALNAME:" + icalEscape("Microuniversity"))
+	cal.line("X-WR-TIMEZONE:" + timezone)
+
+	// Collect the range each timezone is used in, so only the relevant transitions are written
+	type tzRange struct {
+		location *time.Location
+		from, to time.Time
+	}
+	ranges := make(map[string]*tzRange)
+	for _, event := range events {
+		if event.Location == nil {
+			continue
+		}
+
+		tz, ok := ranges[event.Location.String()]
+		if !ok {
+			tz = &tzRange{location: event.Location, from: event.DateTime, to: event.DateTime}
+			ranges[event.Location.String()] = tz
+		}
+
+		if event.DateTime.Before(tz.from) {
+			tz.from = event.DateTime
+		}
+		if event.DateTime.After(tz.to) {
+			tz.to = event.DateTime
+		}
+	}
+
+	var names []string
+	for name := range ranges {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		tz := ranges[name]
+		writeVTimezone(&cal, tz.location, tz.from.AddDate(-1, 0, 0), tz.to.AddDate(1, 0, 0))
+	}
+
+	// UIDs only depend on the learner and the lecture or tutorial, so reschedules update the same event
+	learnerKey := sha256.Sum256([]byte(learnerId))
+	stamp := time.Now().UTC().Format("20060102T150405Z")
+
+	for _, event := range events {
+		cal.line("BEGIN:VEVENT")
+		cal.line(fmt.Sprintf("UID:%s-%s-%s@microuniversity", event.Kind, event.Id, hex.EncodeToString(learnerKey[:8])))
+		cal.line("DTSTAMP:" + stamp)
+		cal.line(fmt.Sprintf("SEQUENCE:%d", event.Sequence))
+
+		if event.Location == nil {
+			cal.line("DTSTART;VALUE=DATE:" + event.Date.Format("20060102"))
+			cal.line("DTEND;VALUE=DATE:" + event.Date.AddDate(0, 0, 1).Format("20060102"))
+			cal.line("TRANSP:TRANSPARENT")
+		} else {
+			start := event.DateTime.In(event.Location)
+			end := start.Add(tutorialDuration)
+			cal.line(fmt.Sprintf("DTSTART;TZID=%s:%s", event.Location.String(), start.Format("20060102T150405")))
+			cal.line(fmt.Sprintf("DTEND;TZID=%s:%s", event.Location.String(), end.Format("20060102T150405")))
+		}
+
+		cal.line("SUMMARY:" + icalEscape(event.Title))
+		cal.line("DESCRIPTION:" + icalEscape(event.Description))
+		cal.line("END:VEVENT")
+	}
+
+	cal.line("END:VCALENDAR")
+
+	return cal.String()
+}
+
+// Writes the VTIMEZONE of a location, with every offset transition between from and to
+func writeVTimezone(cal *icalWriter, location *time.Location, from time.Time, to time.Time) {
+	cal.line("BEGIN:VTIMEZONE")
+	cal.line("TZID:" + location.String())
+
+	// The standard offset of a year is its lowest one, anything above it is daylight saving
+	standardOffset := func(t time.Time) int {
+		_, jan := time.Date(t.Year(), 1, 1, 0, 0, 0, 0, location).Zone()
+		_, jul := time.Date(t.Year(), 7, 1, 0, 0, 0, 0, location).Zone()
+		if jan < jul {
+			return jan
+		}
+		return jul
+	}
+
+	start := from.In(location)
+	name, offset := start.Zone()
+	writeTzComponent(cal, offset > standardOffset(start), start, name, offset, offset)
+
+	// Walk day by day and narrow down each offset change to the second
+	for day := start; day.Before(to); {
+		next := day.Add(24 * time.Hour)
+		_, nextOffset := next.Zone()
+
+		if nextOffset != offset {
+			lo, hi := day, next
+			for hi.Sub(lo) > time.Second {
+				mid := lo.Add(hi.Sub(lo) / 2)
+				if _, midOffset := mid.Zone(); midOffset == offset {
+					lo = mid
+				} else {
+					hi = mid
+				}
+			}
+
+			// DTSTART is the wall clock time of the transition in the offset before it
+			transition := hi.In(time.FixedZone("", offset))
+			newName, newOffset := hi.Zone()
+			writeTzComponent(cal, newOffset > standardOffset(hi), transition, newName, offset, newOffset)
+
+			offset = newOffset
+		}
+
+		day = next
+	}
+
+	cal.line("END:VTIMEZONE")
+}
+
+func writeTzComponent(cal *icalWriter, daylight bool, start time.Time, name string, offsetFrom int, offsetTo int) {
+	component := "STANDARD"
+	if daylight {
+		component = "DAYLIGHT"
+	}
+
+	cal.line("BEGIN:" + component)
+	cal.line("DTSTART:" + start.Format("20060102T150405"))
+	cal.line("TZOFFSETFROM:" + icalOffset(offsetFrom))
+	cal.line("TZOFFSETTO:" + icalOffset(offsetTo))
+	cal.line("TZNAME:" + icalEscape(name))
+	cal.line("END:" + component)
+}
+
+// Formats an offset in seconds east of UTC as +HHMM, with seconds only when needed
+func icalOffset(offset int) string {
+	sign := "+"
+	if offset < 0 {
+		sign = "-"
+		offset = -offset
+	}
+
+	res := fmt.Sprintf("%s%02d%02d", sign, offset/3600, offset%3600/60)
+	if offset%60 != 0 {
+		res += fmt.Sprintf("%02d", offset%60)
+	}
+
+	return res
+}
+
+func icalEscape(text string) string {
+	replacer := strings.NewReplacer(`\`, `\\`, ";", `\;`, ",", `\,`, "\r\n", `\n`, "\n", `\n`)
+	return replacer.Replace(text)
+}
+
+// icalWriter writes CRLF terminated content lines, folded at 75 octets
+// Continuation lines start with a space that counts toward the limit, so they carry 74 octets of content
+type icalWriter struct {
+	strings.Builder
+}
+
+func (c *icalWriter) line(content string) {
+	limit := 75
+	for len(content) > limit {
+		// Don't split in the middle of a UTF-8 sequence
+		cut := limit
+		for cut > 0 && content[cut]&0xC0 == 0x80 {
+			cut--
+		}
+
+		c.WriteString(content[:cut] + "\r\n ")
+		content = content[cut:]
+		limit = 74
+	}
+
+	c.WriteString(content + "\r\n")
+}
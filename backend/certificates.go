@@ -0,0 +1,459 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+const openBadgesContext = "https://w3id.org/openbadges/v2"
+
+type completionResult struct {
+	Learner        string `json:"learner"`
+	LectureRate    int    `json:"lecture_rate"`
+	AttendanceRate int    `json:"attendance_rate"`
+	MasteryRate    int    `json:"mastery_rate"`
+	Passed         bool   `json:"passed"`
+}
+
+type certificateData struct {
+	Id          string
+	Learner     string
+	FirstName   string
+	LastName    string
+	Module      string
+	ModuleTitle string
+	Cohort      string
+	IssuedAt    time.Time
+	Signature   string
+}
+
+type certificateRes struct {
+	Id          string    `json:"id"`
+	Module      string    `json:"module"`
+	ModuleTitle string    `json:"module_title"`
+	IssuedAt    time.Time `json:"issued_at"`
+	Url         string    `json:"url"`
+}
+
+type certificateVerification struct {
+	Valid       bool      `json:"valid"`
+	Id          string    `json:"id"`
+	Name        string    `json:"name"`
+	Module      string    `json:"module"`
+	ModuleTitle string    `json:"module_title"`
+	IssuedAt    time.Time `json:"issued_at"`
+}
+
+/******************* COMPLETION ****/
+
+// Ends a running cohort and evaluates every learner in it against the module's completion rules
+// Passing learners get a certificate, the results are kept in module_completion
+func endCohort(tx *sql.Tx, cohort cohortData) ([]completionResult, error) {
+	results := []completionResult{}
+
+	sqlquery := `UPDATE cohort SET status = 3 WHERE cohort_id = $1 AND status = 2`
+	result, err := tx.Exec(sqlquery, cohort.Id)
+	if err != nil {
+		return results, err
+	}
+
+	if count, err := result.RowsAffected(); err != nil || count == 0 {
+		return results, fmt.Errorf("Cohort isn't running")
+	}
+
+	var title string
+	var minLectures, minMastery int
+	sqlquery = `SELECT title, min_lectures, min_mastery FROM module WHERE module_id = $1`
+	if err := tx.QueryRow(sqlquery, cohort.Module).Scan(&title, &minLectures, &minMastery); err != nil {
+		return results, err
+	}
+
+	// A learner without lectures or flashcards has nothing left to complete
+	sqlquery = `SELECT learner_cohort.learner,
+								COALESCE((SELECT 100 * COUNT(*) FILTER (WHERE learner_lecture.completed) / NULLIF(COUNT(*), 0) FROM learner_lecture
+									INNER JOIN lecture ON lecture.lecture_id = learner_lecture.lecture
+									WHERE learner_lecture.learner = learner_cohort.learner AND lecture.module = $2), 100),
+								COALESCE((SELECT 100 * COUNT(*) FILTER (WHERE learner_flashcard.passes > 0 AND learner_flashcard.repeat = 0) / NULLIF(COUNT(*), 0)
+									FROM learner_flashcard
+									INNER JOIN flashcard ON flashcard.flashcard_id = learner_flashcard.flashcard
+									INNER JOIN lecture ON lecture.lecture_id = flashcard.lecture
+									WHERE learner_flashcard.learner = learner_cohort.learner AND lecture.module = $2), 100)
+							FROM learner_cohort WHERE learner_cohort.cohort = $1
+							ORDER BY learner_cohort.learner`
+	rows, err := tx.Query(sqlquery, cohort.Id, cohort.Module)
+	if err != nil {
+		return results, err
+	}
+
+	for rows.Next() {
+		var completion completionResult
+		if err := rows.Scan(&completion.Learner, &completion.LectureRate, &completion.MasteryRate); err != nil {
+			rows.Close()
+			return results, err
+		}
+
+		results = append(results, completion)
+	}
+	rows.Close()
+
+	issuedAt := time.Now().UTC().Truncate(time.Second)
+	passed := []string{}
+
+	for i := range results {
+		completion := &results[i]
+
+		attendance, err := getAttendanceSummary(completion.Learner, cohort.Module)
+		if err != nil {
+			return results, err
+		}
+
+		// Past tutorials that were never recorded count as absent, a certificate needs the attendance on record
+		completion.AttendanceRate = 100
+		if held := attendance.Present + attendance.Absent + attendance.Unrecorded; held > 0 {
+			completion.AttendanceRate = 100 * attendance.Present / held
+		}
+
+		completion.Passed = completion.LectureRate >= minLectures && completion.MasteryRate >= minMastery &&
+			completion.AttendanceRate >= attendance.Required
+
+		sqlquery = `INSERT INTO module_completion(learner, cohort, module, passed, lecture_rate, attendance_rate, mastery_rate)
+								VALUES ($1, $2, $3, $4, $5, $6, $7)
+								ON CONFLICT (learner, cohort) DO UPDATE SET passed = EXCLUDED.passed, lecture_rate = EXCLUDED.lecture_rate,
+									attendance_rate = EXCLUDED.attendance_rate, mastery_rate = EXCLUDED.mastery_rate, evaluated_at = NOW()`
+		if _, err := tx.Exec(sqlquery, completion.Learner, cohort.Id, cohort.Module, completion.Passed,
+			completion.LectureRate, completion.AttendanceRate, completion.MasteryRate); err != nil {
+			return results, err
+		}
+
+		if !completion.Passed {
+			continue
+		}
+
+		signature := signCertificate(completion.Learner, cohort.Module, cohort.Id, issuedAt)
+		sqlquery = `INSERT INTO certificate(learner, module, cohort, issued_at, signature) VALUES ($1, $2, $3, $4, $5)
+								ON CONFLICT (learner, cohort) DO NOTHING`
+		if _, err := tx.Exec(sqlquery, completion.Learner, cohort.Module, cohort.Id, issuedAt, signature); err != nil {
+			return results, err
+		}
+
+		passed = append(passed, completion.Learner)
+	}
+
+	payload := map[string]string{"module": cohort.Module, "cohort": cohort.Id}
+	if err := notifyLearners(tx, passed, "certificate_issued", "You completed "+title+", your certificate is ready", payload); err != nil {
+		return results, err
+	}
+
+	return results, nil
+}
+
+// Ends the running cohorts whose module duration is over in their timezone
+func endFinishedCohorts() error {
+	sqlquery := `SELECT cohort.cohort_id FROM cohort INNER JOIN module ON module.module_id = cohort.module
+							WHERE cohort.status = 2 AND cohort.start_date + module.duration <= (NOW() AT TIME ZONE cohort.timezone)::date`
+	result, err := db.Query(sqlquery)
+	if err != nil {
+		return err
+	}
+
+	var cohortIds []string
+	for result.Next() {
+		var cohortId string
+		if err := result.Scan(&cohortId); err != nil {
+			result.Close()
+			return err
+		}
+
+		cohortIds = append(cohortIds, cohortId)
+	}
+	result.Close()
+
+	// A cohort that fails to end is logged and retried on the next run, so it doesn't hold back the others
+	for _, cohortId := range cohortIds {
+		if err := endFinishedCohort(cohortId); err != nil {
+			log.Print("Ending cohort ", cohortId, " failed: ", err)
+		}
+	}
+
+	return nil
+}
+
+func endFinishedCohort(cohortId string) error {
+	cohort, err := getCohort(cohortId)
+	if err != nil {
+		return err
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+
+	defer tx.Rollback()
+
+	if _, err := endCohort(tx, cohort); err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// Ends a running cohort early and returns the completion of every learner
+func endCohortNow(w http.ResponseWriter, r *http.Request) {
+	lemail := r.Header.Get("X-User-Claim")
+	cohortId := mux.Vars(r)["id"]
+
+	cohort, err := getCohort(cohortId)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			http.Error(w, "Invalid cohort id", http.StatusNotFound)
+		} else {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+		}
+		return
+	}
+
+	if cohort.Status != 2 {
+		http.Error(w, "Cohort isn't running", http.StatusConflict)
+		return
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	defer tx.Rollback()
+
+	res, err := endCohort(tx, cohort)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	if !commitAudited(w, tx, lemail, "end", "cohort", cohortId, res) {
+		return
+	}
+
+	writeAdminRes(w, http.StatusOK, res)
+}
+
+/******************* CERTIFICATES ****/
+
+// Certificates are signed with CERTIFICATE_SECRET, so rotating the login secret doesn't invalidate them
+func signCertificate(learner string, module string, cohort string, issuedAt time.Time) string {
+	mac := hmac.New(sha256.New, []byte(CERTIFICATE_SECRET))
+	mac.Write([]byte(strings.Join([]string{learner, module, cohort, issuedAt.UTC().Format(time.RFC3339)}, "\n")))
+
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+func (certificate certificateData) valid() bool {
+	expected := signCertificate(certificate.Learner, certificate.Module, certificate.Cohort, certificate.IssuedAt)
+	return hmac.Equal([]byte(expected), []byte(certificate.Signature))
+}
+
+func getCertificate(certificateId string) (certificateData, error) {
+	var certificate certificateData
+	var firstName, lastName sql.NullString
+
+	sqlquery := `SELECT certificate.certificate_id, certificate.learner, learner.first_name, learner.last_name, certificate.module, module.title,
+								certificate.cohort, certificate.issued_at, certificate.signature
+							FROM certificate
+							INNER JOIN learner ON learner.email = certificate.learner
+							INNER JOIN module ON module.module_id = certificate.module
+							WHERE certificate.certificate_id::text = $1`
+	err := db.QueryRow(sqlquery, certificateId).Scan(&certificate.Id, &certificate.Learner, &firstName, &lastName, &certificate.Module,
+		&certificate.ModuleTitle, &certificate.Cohort, &certificate.IssuedAt, &certificate.Signature)
+	certificate.FirstName, certificate.LastName = firstName.String, lastName.String
+
+	return certificate, err
+}
+
+// Links in the badges point back at this server, PUBLIC_URL overrides the host of the request
+func publicBaseURL(r *http.Request) string {
+	if base := os.Getenv("PUBLIC_URL"); base != "" {
+		return strings.TrimSuffix(base, "/")
+	}
+
+	scheme := "http"
+	if r.TLS != nil || r.Header.Get("X-Forwarded-Proto") == "https" {
+		scheme = "https"
+	}
+
+	return scheme + "://" + r.Host
+}
+
+// Lists the certificates of the learner
+func getSelfCertificates(w http.ResponseWriter, r *http.Request) {
+	lemail := r.Header.Get("X-User-Claim")
+
+	var res []certificateRes
+
+	sqlquery := `SELECT certificate.certificate_id, certificate.module, module.title, certificate.issued_at
+							FROM certificate INNER JOIN module ON module.module_id = certificate.module
+							WHERE certificate.learner = $1 ORDER BY certificate.issued_at DESC`
+	result, err := db.Query(sqlquery, lemail)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	defer result.Close()
+
+	base := publicBaseURL(r)
+	for result.Next() {
+		var certificate certificateRes
+		if err := result.Scan(&certificate.Id, &certificate.Module, &certificate.ModuleTitle, &certificate.IssuedAt); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		certificate.Url = base + "/api/v0.2/certificates/" + certificate.Id
+		res = append(res, certificate)
+	}
+
+	if len(res) == 0 {
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+
+	dres, err := json.Marshal(res)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Write(dres)
+}
+
+// Returns the certificate as a hosted Open Badges assertion
+// The recipient is the learner's email, hashed with the certificate id as the salt
+func getCertificateBadge(w http.ResponseWriter, r *http.Request) {
+	certificate, err := getCertificate(mux.Vars(r)["id"])
+	if err != nil {
+		if err == sql.ErrNoRows {
+			http.Error(w, "Invalid certificate id", http.StatusNotFound)
+		} else {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+		}
+		return
+	}
+
+	// Tampered certificates are treated as if they never existed
+	if !certificate.valid() {
+		http.Error(w, "Invalid certificate id", http.StatusNotFound)
+		return
+	}
+
+	base := publicBaseURL(r)
+	identity := sha256.Sum256([]byte(certificate.Learner + certificate.Id))
+
+	writeBadgeRes(w, map[string]interface{}{
+		"@context": openBadgesContext,
+		"type":     "Assertion",
+		"id":       base + "/api/v0.2/certificates/" + certificate.Id,
+		"recipient": map[string]interface{}{
+			"type":     "email",
+			"hashed":   true,
+			"salt":     certificate.Id,
+			"identity": "sha256$" + hex.EncodeToString(identity[:]),
+		},
+		"badge":        base + "/api/v0.2/badges/" + certificate.Module,
+		"issuedOn":     certificate.IssuedAt.UTC().Format(time.RFC3339),
+		"verification": map[string]string{"type": "hosted"},
+	})
+}
+
+// Checks a certificate for anyone holding its id, such as an employer
+func verifyCertificate(w http.ResponseWriter, r *http.Request) {
+	certificate, err := getCertificate(mux.Vars(r)["id"])
+	if err != nil {
+		if err == sql.ErrNoRows {
+			http.Error(w, "Invalid certificate id", http.StatusNotFound)
+		} else {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+		}
+		return
+	}
+
+	res := certificateVerification{
+		Valid:       certificate.valid(),
+		Id:          certificate.Id,
+		Name:        strings.TrimSpace(certificate.FirstName + " " + certificate.LastName),
+		Module:      certificate.Module,
+		ModuleTitle: certificate.ModuleTitle,
+		IssuedAt:    certificate.IssuedAt,
+	}
+
+	writeAdminRes(w, http.StatusOK, res)
+}
+
+// Returns the Open Badges badge class of a module
+func getModuleBadge(w http.ResponseWriter, r *http.Request) {
+	moduleId := mux.Vars(r)["id"]
+
+	var title, image, description string
+	var minAttendance, minLectures, minMastery int
+
+	sqlquery := `SELECT title, image, description, min_attendance, min_lectures, min_mastery FROM module WHERE module_id = $1`
+	if err := db.QueryRow(sqlquery, moduleId).Scan(&title, &image, &description, &minAttendance, &minLectures, &minMastery); err != nil {
+		if err == sql.ErrNoRows {
+			http.Error(w, "Invalid module id", http.StatusNotFound)
+		} else {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+		}
+		return
+	}
+
+	base := publicBaseURL(r)
+	criteria := fmt.Sprintf("Completed at least %d%% of the lectures, attended at least %d%% of the tutorials and mastered at least %d%% of the flashcards",
+		minLectures, minAttendance, minMastery)
+
+	writeBadgeRes(w, map[string]interface{}{
+		"@context":    openBadgesContext,
+		"type":        "BadgeClass",
+		"id":          base + "/api/v0.2/badges/" + moduleId,
+		"name":        title,
+		"description": description,
+		"image":       image,
+		"criteria":    map[string]string{"narrative": criteria},
+		"issuer":      base + "/api/v0.2/issuer",
+	})
+}
+
+// Returns the Open Badges profile of the issuer
+func getBadgeIssuer(w http.ResponseWriter, r *http.Request) {
+	base := publicBaseURL(r)
+
+	writeBadgeRes(w, map[string]interface{}{
+		"@context": openBadgesContext,
+		"type":     "Issuer",
+		"id":       base + "/api/v0.2/issuer",
+		"name":     "Axiom Microuniversity",
+		"url":      base,
+	})
+}
+
+func writeBadgeRes(w http.ResponseWriter, res interface{}) {
+	dres, err := json.Marshal(res)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/ld+json")
+	w.Write(dres)
+}
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestSignCertificate(t *testing.T) {
+	CERTIFICATE_SECRET = "secret"
+	defer func() { CERTIFICATE_SECRET = "" }()
+
+	learner, module, cohort := "ada@example.com", "CS0001", "0b7c3b9e-4d7c-4a53-9a51-2f4f8f0e6b11"
+	issuedAt := time.Date(2021, 6, 1, 12, 0, 0, 0, time.UTC)
+	signature := signCertificate(learner, module, cohort, issuedAt)
+
+	if want := "685a5598f694c39b250f90c9e977b42919f547edf0f860487a7c5ecdfde6d8c8"; signature != want {
+		t.Fatalf("got %s, want %s", signature, want)
+	}
+
+	singapore := time.FixedZone("SGT", 8*60*60)
+	if got := signCertificate(learner, module, cohort, issuedAt.In(singapore)); got != signature {
+		t.Errorf("signature depends on the timezone of the issue time")
+	}
+
+	tests := []struct {
+		name     string
+		learner  string
+		module   string
+		cohort   string
+		issuedAt time.Time
+	}{
+		{"other learner", "grace@example.com", module, cohort, issuedAt},
+		{"other module", learner, "CS0002", cohort, issuedAt},
+		{"other cohort", learner, module, "5d4c2a0e-1f3b-4c8e-9a7d-6b5e4f3a2c1b", issuedAt},
+		{"other issue time", learner, module, cohort, issuedAt.Add(time.Second)},
+		{"fields run together", learner + "\n" + module, "", cohort, issuedAt},
+	}
+
+	for _, test := range tests {
+		if got := signCertificate(test.learner, test.module, test.cohort, test.issuedAt); got == signature {
+			t.Errorf("%s: signature didn't change", test.name)
+		}
+	}
+
+	CERTIFICATE_SECRET = "rotated"
+	if got := signCertificate(learner, module, cohort, issuedAt); got == signature {
+		t.Errorf("signature didn't change with the secret")
+	}
+}
+
+func TestCertificateValid(t *testing.T) {
+	CERTIFICATE_SECRET = "secret"
+	defer func() { CERTIFICATE_SECRET = "" }()
+
+	certificate := certificateData{
+		Learner:  "ada@example.com",
+		Module:   "CS0001",
+		Cohort:   "0b7c3b9e-4d7c-4a53-9a51-2f4f8f0e6b11",
+		IssuedAt: time.Date(2021, 6, 1, 12, 0, 0, 0, time.UTC),
+	}
+	certificate.Signature = signCertificate(certificate.Learner, certificate.Module, certificate.Cohort, certificate.IssuedAt)
+
+	if !certificate.valid() {
+		t.Errorf("signed certificate isn't valid")
+	}
+
+	certificate.Module = "CS0002"
+	if certificate.valid() {
+		t.Errorf("edited certificate is still valid")
+	}
+}
@@ -0,0 +1,452 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/lib/pq"
+)
+
+// start_date is a date like 2006-01-02 in the cohort's timezone
+type adminCohortRequest struct {
+	Module       string `json:"module"`
+	StartDate    string `json:"start_date"`
+	TutorialDay  int    `json:"tutorial_day"`
+	TutorialTime int    `json:"tutorial_time"`
+	Timezone     string `json:"timezone"`
+}
+
+type adminSlotRequest struct {
+	TutorialDay  int    `json:"tutorial_day"`
+	TutorialTime int    `json:"tutorial_time"`
+	Timezone     string `json:"timezone"`
+}
+
+type cancelCohortRequest struct {
+	Reason string `json:"reason"`
+}
+
+type rosterEntry struct {
+	Email     string `json:"email"`
+	FirstName string `json:"first_name"`
+	LastName  string `json:"last_name"`
+}
+
+type adminCohortRes struct {
+	Id             string        `json:"id"`
+	Module         string        `json:"module"`
+	Status         int           `json:"status"`
+	StartDate      time.Time     `json:"start_date"`
+	TutorialDay    int           `json:"tutorial_day"`
+	TutorialTime   int           `json:"tutorial_time"`
+	Timezone       string        `json:"timezone"`
+	ContentVersion *int          `json:"content_version"`
+	Learners       []rosterEntry `json:"learners"`
+}
+
+// Lists the cohorts with their rosters, optionally only of a module or with a status
+// Cancelled cohorts have an empty roster, their learners were released
+func getAdminCohorts(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	moduleId := query.Get("module")
+	status := query.Get("status")
+
+	res := []adminCohortRes{}
+
+	sqlquery := `SELECT cohort_id, module, status, start_date, weekly_tutorial_day, weekly_tutorial_time, timezone, content_version FROM cohort
+							WHERE ($1 = '' OR module = $1) AND ($2 = '' OR status::text = $2)
+							ORDER BY start_date DESC, cohort_id`
+	result, err := db.Query(sqlquery, moduleId, status)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	defer result.Close()
+
+	cohortIndex := make(map[string]int)
+	for result.Next() {
+		var cohort adminCohortRes
+		var contentVersion sql.NullInt32
+		if err := result.Scan(&cohort.Id, &cohort.Module, &cohort.Status, &cohort.StartDate, &cohort.TutorialDay, &cohort.TutorialTime, &cohort.Timezone, &contentVersion); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		cohort.ContentVersion = nullIntPtr(contentVersion)
+		cohort.Learners = []rosterEntry{}
+		cohortIndex[cohort.Id] = len(res)
+		res = append(res, cohort)
+	}
+
+	sqlquery = `SELECT learner_cohort.cohort, email, first_name, last_name FROM learner_cohort
+							INNER JOIN learner ON learner.email = learner_cohort.learner
+							INNER JOIN cohort ON cohort.cohort_id = learner_cohort.cohort
+							WHERE ($1 = '' OR cohort.module = $1) AND ($2 = '' OR cohort.status::text = $2)
+							ORDER BY email`
+	result, err = db.Query(sqlquery, moduleId, status)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	defer result.Close()
+
+	for result.Next() {
+		var cohortId string
+		var learner rosterEntry
+		var firstName, lastName sql.NullString
+		if err := result.Scan(&cohortId, &learner.Email, &firstName, &lastName); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		learner.FirstName, learner.LastName = firstName.String, lastName.String
+		cohort := &res[cohortIndex[cohortId]]
+		cohort.Learners = append(cohort.Learners, learner)
+	}
+
+	writeAdminRes(w, http.StatusOK, res)
+}
+
+// Creates a new cohort of a module and lets the learners waiting for one know
+func createCohort(w http.ResponseWriter, r *http.Request) {
+	lemail := r.Header.Get("X-User-Claim")
+
+	var req adminCohortRequest
+	if !decodeAdminRequest(w, r, &req) {
+		return
+	}
+
+	location, msg := validateSlot(req.TutorialDay, req.TutorialTime, req.Timezone)
+	if msg != "" {
+		http.Error(w, msg, http.StatusBadRequest)
+		return
+	}
+
+	startDate, err := time.Parse("2006-01-02", req.StartDate)
+	if err != nil {
+		http.Error(w, "Start date has to be a date like 2006-01-02", http.StatusBadRequest)
+		return
+	}
+
+	if startDate.Weekday() != time.Monday {
+		http.Error(w, "Start date has to be a Monday", http.StatusBadRequest)
+		return
+	}
+
+	local := time.Now().In(location)
+	if startDate.Before(time.Date(local.Year(), local.Month(), local.Day(), 0, 0, 0, 0, time.UTC)) {
+		http.Error(w, "Start date can't be in the past", http.StatusBadRequest)
+		return
+	}
+
+	var title string
+	sqlquery := `SELECT title FROM module WHERE module_id = $1`
+	if err := db.QueryRow(sqlquery, req.Module).Scan(&title); err != nil {
+		if err == sql.ErrNoRows {
+			http.Error(w, "Invalid module id", http.StatusBadRequest)
+		} else {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+		}
+		return
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	defer tx.Rollback()
+
+	var res adminCohortRes
+	sqlquery = `INSERT INTO cohort(module, start_date, weekly_tutorial_day, weekly_tutorial_time, timezone) VALUES ($1, $2, $3, $4, $5)
+							RETURNING cohort_id, module, status, start_date, weekly_tutorial_day, weekly_tutorial_time, timezone`
+	if err := tx.QueryRow(sqlquery, req.Module, req.StartDate, req.TutorialDay, req.TutorialTime, req.Timezone).Scan(&res.Id, &res.Module, &res.Status,
+		&res.StartDate, &res.TutorialDay, &res.TutorialTime, &res.Timezone); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	res.Learners = []rosterEntry{}
+
+	waiting, err := getWaitlistedLearners(tx, req.Module)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	message := fmt.Sprintf("A new cohort of %s starts on %s", title, startDate.Format("2 January 2006"))
+	if err := notifyLearners(tx, waiting, "cohort_created", message, map[string]string{"module": req.Module, "cohort": res.Id}); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	if !commitAudited(w, tx, lemail, "create", "cohort", res.Id, req) {
+		return
+	}
+
+	writeAdminRes(w, http.StatusCreated, res)
+}
+
+// Moves the weekly tutorial slot of a cohort
+// Upcoming tutorials of a running cohort are rescheduled, past ones stay as they happened
+// and upcoming ones whose new slot is already past are dropped
+func updateCohortSlot(w http.ResponseWriter, r *http.Request) {
+	lemail := r.Header.Get("X-User-Claim")
+	cohortId := mux.Vars(r)["id"]
+
+	var req adminSlotRequest
+	if !decodeAdminRequest(w, r, &req) {
+		return
+	}
+
+	if _, msg := validateSlot(req.TutorialDay, req.TutorialTime, req.Timezone); msg != "" {
+		http.Error(w, msg, http.StatusBadRequest)
+		return
+	}
+
+	cohort, err := getCohort(cohortId)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			http.Error(w, "Invalid cohort id", http.StatusNotFound)
+		} else {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+		}
+		return
+	}
+
+	if cohort.Status > 2 {
+		http.Error(w, "Cohort has already ended", http.StatusConflict)
+		return
+	}
+
+	cohort.WeeklyTutorialDay = req.TutorialDay
+	cohort.WeeklyTutorialTime = req.TutorialTime
+	cohort.Timezone = req.Timezone
+
+	learnerIds, err := getCohortLearners(cohortId)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	defer tx.Rollback()
+
+	sqlquery := `UPDATE cohort SET weekly_tutorial_day = $1, weekly_tutorial_time = $2, timezone = $3 WHERE cohort_id = $4`
+	if !execAdminUpdate(w, tx, sqlquery, req.TutorialDay, req.TutorialTime, req.Timezone, cohortId) {
+		return
+	}
+
+	if cohort.Status == 2 {
+		tutorialDates, err := calculateTutorialDates(cohort)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		// A tutorial whose new slot has already passed, like this week's moved to an earlier day, is dropped for this week
+		// Moving it into the past would count it as missed, and keeping the old time would hold a session that no longer happens
+		var tutorials []tutorialDate
+		var passed []string
+		for _, tutorial := range tutorialDates {
+			if tutorial.AbsoluteDateTime.After(time.Now()) {
+				tutorials = append(tutorials, tutorial)
+			} else {
+				passed = append(passed, tutorial.Id)
+			}
+		}
+
+		sqlquery = `DELETE FROM learner_tutorial WHERE tutorial = ANY($1) AND learner = ANY($2) AND scheduled_datetime > NOW()`
+		if _, err := tx.Exec(sqlquery, pq.Array(passed), pq.Array(learnerIds)); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		for _, learnerId := range learnerIds {
+			if err := enrollLearnerSchedule(tx, learnerId, nil, tutorials); err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+		}
+	}
+
+	message := "The weekly tutorial of your cohort has moved, check your schedule for the new time"
+	if err := notifyLearners(tx, learnerIds, "cohort_rescheduled", message, map[string]string{"module": cohort.Module, "cohort": cohortId}); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	if !commitAudited(w, tx, lemail, "update", "cohort", cohortId, req) {
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+}
+
+// Cancels a cohort that hasn't ended yet
+// The learners are released from the cohort and put on the module's waitlist, completed lectures and flashcards stay theirs
+func cancelCohort(w http.ResponseWriter, r *http.Request) {
+	lemail := r.Header.Get("X-User-Claim")
+	cohortId := mux.Vars(r)["id"]
+
+	// The reason is optional, so an empty body is fine
+	var req cancelCohortRequest
+	decoder := json.NewDecoder(r.Body)
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(&req); err != nil && err != io.EOF {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	cohort, err := getCohort(cohortId)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			http.Error(w, "Invalid cohort id", http.StatusNotFound)
+		} else {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+		}
+		return
+	}
+
+	if cohort.Status > 2 {
+		http.Error(w, "Cohort has already ended", http.StatusConflict)
+		return
+	}
+
+	learnerIds, err := getCohortLearners(cohortId)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	defer tx.Rollback()
+
+	// Only one cancellation gets through when two admins race
+	sqlquery := `UPDATE cohort SET status = 4 WHERE cohort_id = $1 AND status <= 2`
+	if !execAdminUpdate(w, tx, sqlquery, cohortId) {
+		return
+	}
+
+	for _, sqlquery := range []string{
+		`DELETE FROM learner_tutorial USING tutorial
+			WHERE learner_tutorial.tutorial = tutorial.tutorial_id AND tutorial.module = $1
+			AND learner_tutorial.learner = ANY($2) AND learner_tutorial.scheduled_datetime > NOW()`,
+		`DELETE FROM learner_lecture USING lecture
+			WHERE learner_lecture.lecture = lecture.lecture_id AND lecture.module = $1
+			AND learner_lecture.learner = ANY($2) AND learner_lecture.completed = false`,
+		`INSERT INTO module_waitlist(learner, module) SELECT learner, $1 FROM unnest($2::varchar[]) AS learner ON CONFLICT DO NOTHING`,
+	} {
+		if _, err := tx.Exec(sqlquery, cohort.Module, pq.Array(learnerIds)); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+	}
+
+	sqlquery = `DELETE FROM learner_cohort WHERE cohort = $1`
+	if _, err := tx.Exec(sqlquery, cohortId); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	message := "Your cohort has been cancelled, you are on the waitlist for the next one"
+	if req.Reason != "" {
+		message = fmt.Sprintf("Your cohort has been cancelled: %s. You are on the waitlist for the next one", req.Reason)
+	}
+
+	if err := notifyLearners(tx, learnerIds, "cohort_cancelled", message, map[string]string{"module": cohort.Module, "cohort": cohortId}); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	// The roster is gone after this, so the audit log keeps it
+	payload := map[string]interface{}{"reason": req.Reason, "learners": learnerIds}
+	if !commitAudited(w, tx, lemail, "cancel", "cohort", cohortId, payload) {
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+}
+
+// Tutorial day and time are local to the timezone, which has to be a IANA name
+func validateSlot(day int, minutes int, timezone string) (*time.Location, string) {
+	switch {
+	case day < 0 || day > 6:
+		return nil, "Tutorial day has to be between 0 (Monday) and 6 (Sunday)"
+	case minutes < 0 || minutes >= 24*60:
+		return nil, "Tutorial time has to be in minutes from midnight"
+	case timezone == "" || timezone == "Local":
+		return nil, "Invalid timezone"
+	}
+
+	location, err := time.LoadLocation(timezone)
+	if err != nil {
+		return nil, "Invalid timezone"
+	}
+
+	return location, ""
+}
+
+func getCohortLearners(cohortId string) ([]string, error) {
+	var learnerIds []string
+
+	sqlquery := `SELECT learner FROM learner_cohort WHERE cohort = $1`
+	result, err := db.Query(sqlquery, cohortId)
+	if err != nil {
+		return nil, err
+	}
+
+	defer result.Close()
+
+	for result.Next() {
+		var learnerId string
+		if err := result.Scan(&learnerId); err != nil {
+			return nil, err
+		}
+
+		learnerIds = append(learnerIds, learnerId)
+	}
+
+	return learnerIds, result.Err()
+}
+
+func getWaitlistedLearners(tx *sql.Tx, moduleId string) ([]string, error) {
+	var learnerIds []string
+
+	sqlquery := `SELECT learner FROM module_waitlist WHERE module = $1`
+	result, err := tx.Query(sqlquery, moduleId)
+	if err != nil {
+		return nil, err
+	}
+
+	defer result.Close()
+
+	for result.Next() {
+		var learnerId string
+		if err := result.Scan(&learnerId); err != nil {
+			return nil, err
+		}
+
+		learnerIds = append(learnerIds, learnerId)
+	}
+
+	return learnerIds, result.Err()
+}
@@ -0,0 +1,247 @@
+package main
+
+import (
+	"database/sql"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// Rates are percentages, retention is nil until the learner reviewed a card
+type learnerProgressRes struct {
+	Email             string    `json:"email"`
+	FirstName         string    `json:"first_name"`
+	LastName          string    `json:"last_name"`
+	LecturesTotal     int       `json:"lectures_total"`
+	LecturesCompleted int       `json:"lectures_completed"`
+	CompletionRate    int       `json:"completion_rate"`
+	OverdueLectures   int       `json:"overdue_lectures"`
+	Streak            int       `json:"streak"`
+	LastReview        time.Time `json:"last_review"`
+	CardsTotal        int       `json:"cards_total"`
+	CardsMastered     int       `json:"cards_mastered"`
+	Retention         *int      `json:"retention"`
+}
+
+type lectureFunnelStep struct {
+	LectureId      string `json:"lecture_id"`
+	Title          string `json:"title"`
+	DateOffset     int    `json:"date_offset"`
+	Scheduled      int    `json:"scheduled"`
+	Completed      int    `json:"completed"`
+	CompletionRate int    `json:"completion_rate"`
+}
+
+type hardCardRes struct {
+	FlashcardId  string `json:"flashcard_id"`
+	TopSide      string `json:"top_side"`
+	LectureTitle string `json:"lecture_title"`
+	Learners     int    `json:"learners"`
+	Passes       int    `json:"passes"`
+	Fails        int    `json:"fails"`
+	FailRate     int    `json:"fail_rate"`
+}
+
+type cohortSummaryRes struct {
+	LearnerCount int                 `json:"learner_count"`
+	Funnel       []lectureFunnelStep `json:"funnel"`
+	HardestCards []hardCardRes       `json:"hardest_cards"`
+}
+
+// Returns the progress of every learner in a cohort
+// Everything is aggregated in one query, so it stays a single round trip however big the cohort is
+func getCohortLearnerProgress(w http.ResponseWriter, r *http.Request) {
+	cohort, ok := getDashboardCohort(w, mux.Vars(r)["id"])
+	if !ok {
+		return
+	}
+
+	// Lectures are overdue once their day has passed in the cohort's timezone
+	location, err := time.LoadLocation(cohort.Timezone)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	local := time.Now().In(location)
+	today := time.Date(local.Year(), local.Month(), local.Day(), 0, 0, 0, 0, time.UTC)
+
+	res := []learnerProgressRes{}
+
+	sqlquery := `WITH roster AS (
+								SELECT learner FROM learner_cohort WHERE cohort = $1
+							), lectures AS (
+								SELECT learner_lecture.learner, COUNT(*) AS total, COUNT(*) FILTER (WHERE completed) AS completed,
+									COUNT(*) FILTER (WHERE NOT completed AND scheduled_date < $3) AS overdue
+								FROM learner_lecture
+								INNER JOIN roster ON roster.learner = learner_lecture.learner
+								INNER JOIN lecture ON lecture.lecture_id = learner_lecture.lecture
+								WHERE lecture.module = $2
+								GROUP BY learner_lecture.learner
+							), cards AS (
+								SELECT learner_flashcard.learner, COUNT(*) AS total, COUNT(*) FILTER (WHERE repeat = 0 AND passes > 0) AS mastered,
+									SUM(passes) AS passes, SUM(fails) AS fails
+								FROM learner_flashcard
+								INNER JOIN roster ON roster.learner = learner_flashcard.learner
+								INNER JOIN flashcard ON flashcard.flashcard_id = learner_flashcard.flashcard
+								INNER JOIN lecture ON lecture.lecture_id = flashcard.lecture
+								WHERE lecture.module = $2
+								GROUP BY learner_flashcard.learner
+							)
+							SELECT learner.email, learner.first_name, learner.last_name, learner.streak, COALESCE(learner.last_completed, NOW()),
+								COALESCE(lectures.total, 0), COALESCE(lectures.completed, 0), COALESCE(lectures.overdue, 0),
+								COALESCE(cards.total, 0), COALESCE(cards.mastered, 0), COALESCE(cards.passes, 0), COALESCE(cards.fails, 0)
+							FROM roster
+							INNER JOIN learner ON learner.email = roster.learner
+							LEFT JOIN lectures ON lectures.learner = roster.learner
+							LEFT JOIN cards ON cards.learner = roster.learner
+							ORDER BY learner.email`
+	result, err := db.Query(sqlquery, cohort.Id, cohort.Module, today)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	defer result.Close()
+
+	for result.Next() {
+		var learner learnerProgressRes
+		var firstName, lastName sql.NullString
+		var passes, fails int
+		if err := result.Scan(&learner.Email, &firstName, &lastName, &learner.Streak, &learner.LastReview,
+			&learner.LecturesTotal, &learner.LecturesCompleted, &learner.OverdueLectures,
+			&learner.CardsTotal, &learner.CardsMastered, &passes, &fails); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		learner.FirstName, learner.LastName = firstName.String, lastName.String
+		learner.CompletionRate = percentOf(learner.LecturesCompleted, learner.LecturesTotal)
+
+		// Same rule as getSelf, a streak is broken after two days without a review
+		if time.Since(learner.LastReview) > 48*time.Hour {
+			learner.Streak = 0
+		}
+
+		if passes+fails > 0 {
+			retention := percentOf(passes, passes+fails)
+			learner.Retention = &retention
+		}
+
+		res = append(res, learner)
+	}
+
+	writeAdminRes(w, http.StatusOK, res)
+}
+
+// Returns how far the cohort got through each lecture and which flashcards it fails most
+func getCohortSummary(w http.ResponseWriter, r *http.Request) {
+	cohort, ok := getDashboardCohort(w, mux.Vars(r)["id"])
+	if !ok {
+		return
+	}
+
+	limit := 10
+	if l := r.URL.Query().Get("limit"); l != "" {
+		var err error
+		limit, err = strconv.Atoi(l)
+		if err != nil || limit <= 0 {
+			http.Error(w, "Invalid query parameters", http.StatusBadRequest)
+			return
+		}
+	}
+
+	res := cohortSummaryRes{Funnel: []lectureFunnelStep{}, HardestCards: []hardCardRes{}}
+
+	sqlquery := `SELECT COUNT(*) FROM learner_cohort WHERE cohort = $1`
+	if err := db.QueryRow(sqlquery, cohort.Id).Scan(&res.LearnerCount); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	sqlquery = `SELECT lecture.lecture_id, lecture.title, lecture.date_offset,
+								COUNT(learner_lecture.learner), COUNT(learner_lecture.learner) FILTER (WHERE learner_lecture.completed)
+							FROM lecture
+							LEFT JOIN learner_lecture ON learner_lecture.lecture = lecture.lecture_id
+								AND learner_lecture.learner IN (SELECT learner FROM learner_cohort WHERE cohort = $1)
+							WHERE lecture.module = $2 AND lecture.version = $3
+							GROUP BY lecture.lecture_id, lecture.title, lecture.date_offset
+							ORDER BY lecture.date_offset`
+	result, err := db.Query(sqlquery, cohort.Id, cohort.Module, cohort.ContentVersion)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	defer result.Close()
+
+	for result.Next() {
+		var step lectureFunnelStep
+		if err := result.Scan(&step.LectureId, &step.Title, &step.DateOffset, &step.Scheduled, &step.Completed); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		step.CompletionRate = percentOf(step.Completed, res.LearnerCount)
+		res.Funnel = append(res.Funnel, step)
+	}
+
+	// Cards are ranked by the share of failed reviews, ties go to the card failed most often
+	sqlquery = `SELECT flashcard.flashcard_id, flashcard.top_side, lecture.title,
+								COUNT(*), SUM(learner_flashcard.passes), SUM(learner_flashcard.fails)
+							FROM learner_flashcard
+							INNER JOIN learner_cohort ON learner_cohort.learner = learner_flashcard.learner AND learner_cohort.cohort = $1
+							INNER JOIN flashcard ON flashcard.flashcard_id = learner_flashcard.flashcard
+							INNER JOIN lecture ON lecture.lecture_id = flashcard.lecture
+							WHERE lecture.module = $2
+							GROUP BY flashcard.flashcard_id, flashcard.top_side, lecture.title
+							HAVING SUM(learner_flashcard.fails) > 0
+							ORDER BY SUM(learner_flashcard.fails)::float / SUM(learner_flashcard.passes + learner_flashcard.fails) DESC,
+								SUM(learner_flashcard.fails) DESC
+							LIMIT $3`
+	result, err = db.Query(sqlquery, cohort.Id, cohort.Module, limit)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	defer result.Close()
+
+	for result.Next() {
+		var card hardCardRes
+		if err := result.Scan(&card.FlashcardId, &card.TopSide, &card.LectureTitle, &card.Learners, &card.Passes, &card.Fails); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		card.FailRate = percentOf(card.Fails, card.Passes+card.Fails)
+		res.HardestCards = append(res.HardestCards, card)
+	}
+
+	writeAdminRes(w, http.StatusOK, res)
+}
+
+// Loads the cohort of a dashboard request, errors are written to the response
+func getDashboardCohort(w http.ResponseWriter, cohortId string) (cohortData, bool) {
+	cohort, err := getCohort(cohortId)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			http.Error(w, "Invalid cohort id", http.StatusNotFound)
+		} else {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+		}
+		return cohort, false
+	}
+
+	return cohort, true
+}
+
+func percentOf(part int, total int) int {
+	if total == 0 {
+		return 0
+	}
+
+	return 100 * part / total
+}
@@ -1,58 +1,144 @@
--- clear up old stuff
-DROP TABLE IF EXISTS learner CASCADE;
-DROP TABLE IF EXISTS module CASCADE;
-DROP TABLE IF EXISTS cohort CASCADE;
-DROP TABLE IF EXISTS learner_cohort CASCADE;
-DROP TABLE IF EXISTS lecture CASCADE;
-DROP TABLE IF EXISTS tutorial CASCADE;
-DROP TABLE IF EXISTS flashcard CASCADE;
-DROP TABLE IF EXISTS learner_flashcard CASCADE;
-DROP TABLE IF EXISTS learner_lecture CASCADE;
-DROP TABLE IF EXISTS learner_tutorial CASCADE;
+-- define.sql creates the tables that don't exist yet, so it is safe to run on every start
+-- Tables that changed after they were first created are followed by their upgrades, which only change what is missing,
+-- so running it again also brings a database created by an older define.sql up to date
+-- Postgres only runs it by itself on an empty database, existing ones need psql -f define.sql after an update
+-- use reset.sql to clear up old stuff first
 
 --UUID support
 CREATE EXTENSION IF NOT EXISTS "uuid-ossp";
 
 -- learner table hols the data about the users
-CREATE TABLE learner (
+-- role: 0 = LEARNER, 1 = INSTRUCTOR, 2 = ADMIN
+CREATE TABLE IF NOT EXISTS learner (
   email VARCHAR UNIQUE NOT NULL,
   first_name VARCHAR DEFAULT '',
   last_name VARCHAR DEFAULT '',
   last_completed TIMESTAMPTZ DEFAULT NOW(),
   streak INT NOT NULL DEFAULT 0,
   timezone VARCHAR DEFAULT 'Asia/Singapore',
+  role INT NOT NULL CHECK (role >= 0 AND role <= 2) DEFAULT 0,
+  calendar_token VARCHAR UNIQUE,
 
   PRIMARY KEY (email)
 );
 
+-- Upgrades for learners created before roles and calendar feeds
+ALTER TABLE learner ADD COLUMN IF NOT EXISTS role INT NOT NULL CHECK (role >= 0 AND role <= 2) DEFAULT 0;
+DO $$
+BEGIN
+  IF NOT EXISTS (SELECT 1 FROM information_schema.columns WHERE table_name = 'learner' AND column_name = 'calendar_token') THEN
+    ALTER TABLE learner ADD COLUMN calendar_token VARCHAR UNIQUE;
+  END IF;
+END $$;
+
 -- module ID is codes like CS0001 etc, based on the university
 -- duration is in days
-CREATE TABLE module (
+-- min_attendance is the percentage of tutorials a learner has to attend to complete the module
+-- min_lectures and min_mastery are the percentages of lectures completed and flashcards mastered to complete it
+-- tags are lowercase, language is a two letter ISO 639-1 code
+-- search is the full text of the title and description, used by the catalog search
+-- published_version is the content version new cohorts start on, NULL until the first publish
+CREATE TABLE IF NOT EXISTS module (
   module_id VARCHAR UNIQUE NOT NULL,
   title VARCHAR NOT NULL,
   image VARCHAR NOT NULL,
   description TEXT NOT NULL,
   duration INT NOT NULL,
+  min_attendance INT NOT NULL CHECK (min_attendance >= 0 AND min_attendance <= 100) DEFAULT 0,
+  min_lectures INT NOT NULL CHECK (min_lectures >= 0 AND min_lectures <= 100) DEFAULT 0,
+  min_mastery INT NOT NULL CHECK (min_mastery >= 0 AND min_mastery <= 100) DEFAULT 0,
+  tags VARCHAR[] NOT NULL DEFAULT '{}',
+  difficulty VARCHAR NOT NULL CHECK (difficulty IN ('beginner', 'intermediate', 'advanced')) DEFAULT 'beginner',
+  language VARCHAR NOT NULL DEFAULT 'en',
+  search tsvector GENERATED ALWAYS AS (setweight(to_tsvector('english', title), 'A') || setweight(to_tsvector('english', description), 'B')) STORED,
+  published_version INT,
 
   PRIMARY KEY (module_id)
 );
 
+-- Upgrade for modules created before attendance tracking
+ALTER TABLE module ADD COLUMN IF NOT EXISTS min_attendance INT NOT NULL CHECK (min_attendance >= 0 AND min_attendance <= 100) DEFAULT 0;
+
+-- Upgrades for modules created before content versions, they were all live on version 1
+DO $$
+BEGIN
+  IF NOT EXISTS (SELECT 1 FROM information_schema.columns WHERE table_name = 'module' AND column_name = 'published_version') THEN
+    ALTER TABLE module ADD COLUMN published_version INT;
+    UPDATE module SET published_version = 1;
+  END IF;
+END $$;
+ALTER TABLE module ALTER COLUMN published_version DROP DEFAULT;
+
+-- Upgrade for modules created before completion rules, existing modules keep completing on attendance alone
+ALTER TABLE module ADD COLUMN IF NOT EXISTS min_lectures INT NOT NULL CHECK (min_lectures >= 0 AND min_lectures <= 100) DEFAULT 0;
+ALTER TABLE module ADD COLUMN IF NOT EXISTS min_mastery INT NOT NULL CHECK (min_mastery >= 0 AND min_mastery <= 100) DEFAULT 0;
+
+-- Upgrade for modules created before the catalog search
+ALTER TABLE module ADD COLUMN IF NOT EXISTS tags VARCHAR[] NOT NULL DEFAULT '{}';
+ALTER TABLE module ADD COLUMN IF NOT EXISTS difficulty VARCHAR NOT NULL CHECK (difficulty IN ('beginner', 'intermediate', 'advanced')) DEFAULT 'beginner';
+ALTER TABLE module ADD COLUMN IF NOT EXISTS language VARCHAR NOT NULL DEFAULT 'en';
+ALTER TABLE module ADD COLUMN IF NOT EXISTS search tsvector GENERATED ALWAYS AS (setweight(to_tsvector('english', title), 'A') || setweight(to_tsvector('english', description), 'B')) STORED;
+
+CREATE INDEX IF NOT EXISTS module_search ON module USING GIN (search);
+CREATE INDEX IF NOT EXISTS module_tags ON module USING GIN (tags);
+
+-- module_version holds the content versions of a module
+-- lectures, tutorials, flashcards and quiz questions are copied into a new version, keeping their content_key
+-- the version after the published one is the draft, published_at is NULL until it is published
+CREATE TABLE IF NOT EXISTS module_version (
+  module VARCHAR,
+  version INT CHECK (version >= 1),
+  created_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+  published_at TIMESTAMPTZ,
+
+  PRIMARY KEY (module, version),
+  CONSTRAINT fk_module
+    FOREIGN KEY (module) REFERENCES module(module_id)
+);
+
+INSERT INTO module_version(module, version, published_at)
+  SELECT module_id, published_version, NOW() FROM module WHERE published_version IS NOT NULL
+  ON CONFLICT DO NOTHING;
+
 -- cohort_start_date is always a Monday
 -- weekly tutorial starts the week before the cohort_start_date with the module orientation session
 -- weekly_tutorial_day starts at 0 for Monday and 6 for Sunday
--- status: 0 = NOT_STARTED, 1 = ENROLLMENT FULL, 2 = ONGOING, 3 = DONE
-CREATE TABLE cohort (
+-- weekly_tutorial_time is in minutes from midnight
+-- weekly_tutorial_day and weekly_tutorial_time are local to the IANA timezone of the cohort
+-- status: 0 = NOT_STARTED, 1 = ENROLLMENT FULL, 2 = ONGOING, 3 = DONE, 4 = CANCELLED
+-- content_version is the module version the cohort was started on
+CREATE TABLE IF NOT EXISTS cohort (
   cohort_id uuid DEFAULT uuid_generate_v4 (),
   module VARCHAR NOT NULL,
-  status int NOT NULL CHECK (status >= 0 AND status <=3) DEFAULT 0,
+  status int NOT NULL CHECK (status >= 0 AND status <=4) DEFAULT 0,
   start_date DATE NOT NULL DEFAULT NOW(),
   weekly_tutorial_day INT NOT NULL CHECK (weekly_tutorial_day >= 0 AND weekly_tutorial_day <=6),
-  weekly_tutorial_time INT NOT NULL CHECK (weekly_tutorial_time >= 0 AND weekly_tutorial_time < 1400),
+  weekly_tutorial_time INT NOT NULL CHECK (weekly_tutorial_time >= 0 AND weekly_tutorial_time < 1440),
+  timezone VARCHAR NOT NULL DEFAULT 'Asia/Singapore',
+  content_version INT,
 
   PRIMARY KEY (cohort_id)
 );
 
-CREATE TABLE learner_cohort (
+-- Upgrades for cohorts created before timezones, the tutorial time used to stop at 1400 minutes
+ALTER TABLE cohort ADD COLUMN IF NOT EXISTS timezone VARCHAR NOT NULL DEFAULT 'Asia/Singapore';
+ALTER TABLE cohort DROP CONSTRAINT IF EXISTS cohort_weekly_tutorial_time_check;
+ALTER TABLE cohort ADD CONSTRAINT cohort_weekly_tutorial_time_check CHECK (weekly_tutorial_time >= 0 AND weekly_tutorial_time < 1440);
+
+-- Upgrades for cohorts created before content versions, the ones already started run on version 1
+DO $$
+BEGIN
+  IF NOT EXISTS (SELECT 1 FROM information_schema.columns WHERE table_name = 'cohort' AND column_name = 'content_version') THEN
+    ALTER TABLE cohort ADD COLUMN content_version INT;
+    UPDATE cohort SET content_version = 1 WHERE status >= 2;
+  END IF;
+END $$;
+
+-- Upgrade for cohorts created before they could be cancelled
+ALTER TABLE cohort DROP CONSTRAINT IF EXISTS cohort_status_check;
+ALTER TABLE cohort ADD CONSTRAINT cohort_status_check CHECK (status >= 0 AND status <=4);
+
+CREATE TABLE IF NOT EXISTS learner_cohort (
   learner VARCHAR,
   cohort uuid,
 
@@ -64,25 +150,141 @@ CREATE TABLE learner_cohort (
     FOREIGN KEY (cohort) REFERENCES cohort(cohort_id)
 );
 
+CREATE INDEX IF NOT EXISTS learner_cohort_cohort ON learner_cohort (cohort);
+
+-- cohort_shift records every reschedule of a running cohort
+-- all lectures and tutorials on or after from_date are moved by days, in the order the shifts were created
+CREATE TABLE IF NOT EXISTS cohort_shift (
+  shift_id uuid DEFAULT uuid_generate_v4 (),
+  cohort uuid NOT NULL,
+  from_date DATE NOT NULL,
+  days INT NOT NULL,
+  created_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+
+  PRIMARY KEY (shift_id),
+  CONSTRAINT fk_cohort
+    FOREIGN KEY (cohort) REFERENCES cohort(cohort_id)
+);
+
+-- module_waitlist holds learners waiting for a new cohort of a module
+CREATE TABLE IF NOT EXISTS module_waitlist (
+  learner VARCHAR,
+  module VARCHAR,
+  created_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+
+  PRIMARY KEY (learner, module),
+
+  CONSTRAINT fk_learner
+    FOREIGN KEY (learner) REFERENCES learner(email),
+  CONSTRAINT fk_module
+    FOREIGN KEY (module) REFERENCES module(module_id)
+);
+
+-- self_paced_enrollment holds learners taking a module without a cohort
+-- lectures are scheduled one every pace_days from start_date, and there are no tutorials
+-- content_version is the module version that was published when the learner enrolled
+CREATE TABLE IF NOT EXISTS self_paced_enrollment (
+  learner VARCHAR,
+  module VARCHAR,
+  start_date DATE NOT NULL,
+  pace_days INT NOT NULL CHECK (pace_days >= 1) DEFAULT 1,
+  content_version INT NOT NULL DEFAULT 1,
+  created_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+
+  PRIMARY KEY (learner, module),
+
+  CONSTRAINT fk_learner
+    FOREIGN KEY (learner) REFERENCES learner(email),
+  CONSTRAINT fk_module
+    FOREIGN KEY (module) REFERENCES module(module_id)
+);
+
+ALTER TABLE self_paced_enrollment ADD COLUMN IF NOT EXISTS content_version INT NOT NULL DEFAULT 1;
+
 -- lecture table holds the lectures in a module
-CREATE TABLE lecture (
+-- duration_seconds is the length of the video, 0 when unknown
+-- min_watch_percent is how much of the video has to be watched before the lecture can be completed
+-- content_key identifies the lecture across the versions of its module
+-- unique_lecture_date_offset can be deferred, so package imports can reorder lectures
+CREATE TABLE IF NOT EXISTS lecture (
   lecture_id uuid DEFAULT uuid_generate_v4 (),
   title VARCHAR NOT NULL,
   description TEXT NOT NULL,
   video_link VARCHAR NOT NULL,
-  date_offset INT NOT NULL,
+  date_offset INT NOT NULL CHECK (date_offset >= 0),
   module VARCHAR NOT NULL,
+  duration_seconds INT NOT NULL CHECK (duration_seconds >= 0) DEFAULT 0,
+  min_watch_percent INT NOT NULL CHECK (min_watch_percent >= 0 AND min_watch_percent <= 100) DEFAULT 0,
+  version INT NOT NULL DEFAULT 1,
+  content_key uuid NOT NULL DEFAULT uuid_generate_v4 (),
 
   PRIMARY KEY (lecture_id),
+  CONSTRAINT unique_lecture_date_offset
+    UNIQUE (module, version, date_offset) DEFERRABLE INITIALLY IMMEDIATE,
+  UNIQUE (module, version, content_key),
   CONSTRAINT fk_module
     FOREIGN KEY (module) REFERENCES module(module_id)
 );
 
-CREATE TABLE learner_lecture (
+-- Upgrades for lectures created before watch progress, date offsets can't be negative
+ALTER TABLE lecture ADD COLUMN IF NOT EXISTS duration_seconds INT NOT NULL CHECK (duration_seconds >= 0) DEFAULT 0;
+ALTER TABLE lecture ADD COLUMN IF NOT EXISTS min_watch_percent INT NOT NULL CHECK (min_watch_percent >= 0 AND min_watch_percent <= 100) DEFAULT 0;
+ALTER TABLE lecture DROP CONSTRAINT IF EXISTS lecture_date_offset_check;
+ALTER TABLE lecture ADD CONSTRAINT lecture_date_offset_check CHECK (date_offset >= 0);
+
+-- Upgrades for lectures created before content versions, date offsets became unique per version
+ALTER TABLE lecture ADD COLUMN IF NOT EXISTS version INT NOT NULL DEFAULT 1;
+ALTER TABLE lecture ADD COLUMN IF NOT EXISTS content_key uuid NOT NULL DEFAULT uuid_generate_v4 ();
+ALTER TABLE lecture DROP CONSTRAINT IF EXISTS lecture_module_date_offset_key;
+DO $$
+BEGIN
+  IF NOT EXISTS (SELECT 1 FROM pg_constraint WHERE conname IN ('lecture_module_version_date_offset_key', 'unique_lecture_date_offset')) THEN
+    ALTER TABLE lecture ADD CONSTRAINT lecture_module_version_date_offset_key UNIQUE (module, version, date_offset);
+  END IF;
+  IF NOT EXISTS (SELECT 1 FROM pg_constraint WHERE conname = 'lecture_module_version_content_key_key') THEN
+    ALTER TABLE lecture ADD CONSTRAINT lecture_module_version_content_key_key UNIQUE (module, version, content_key);
+  END IF;
+END $$;
+
+-- Upgrade for lectures created before package imports, the date offset constraint became deferrable
+DO $$
+BEGIN
+  IF NOT EXISTS (SELECT 1 FROM pg_constraint WHERE conname = 'unique_lecture_date_offset') THEN
+    ALTER TABLE lecture DROP CONSTRAINT IF EXISTS lecture_module_version_date_offset_key;
+    ALTER TABLE lecture ADD CONSTRAINT unique_lecture_date_offset UNIQUE (module, version, date_offset) DEFERRABLE INITIALLY IMMEDIATE;
+  END IF;
+END $$;
+
+-- lecture_prerequisite holds the lectures that have to be done before a lecture unlocks
+-- without a mastery_threshold the prerequisite has to be completed
+-- with one, that percentage of the prerequisite's flashcards has to be mastered as well
+CREATE TABLE IF NOT EXISTS lecture_prerequisite (
+  lecture uuid,
+  prerequisite uuid,
+  mastery_threshold INT CHECK (mastery_threshold >= 0 AND mastery_threshold <= 100),
+
+  PRIMARY KEY (lecture, prerequisite),
+  CHECK (lecture <> prerequisite),
+
+  CONSTRAINT fk_lecture
+    FOREIGN KEY (lecture) REFERENCES lecture(lecture_id),
+  CONSTRAINT fk_prerequisite
+    FOREIGN KEY (prerequisite) REFERENCES lecture(lecture_id)
+);
+
+-- sequence counts the reschedules, so calendar clients pick up the changes
+-- position_seconds is where playback was last, watched_seconds the total time watched
+-- watched_seconds never goes past the time since first_heartbeat
+CREATE TABLE IF NOT EXISTS learner_lecture (
   learner VARCHAR,
   lecture uuid,
   scheduled_date DATE NOT NULL,
   completed bool NOT NULL DEFAULT FALSE,
+  sequence INT NOT NULL DEFAULT 0,
+  position_seconds INT NOT NULL DEFAULT 0,
+  watched_seconds INT NOT NULL DEFAULT 0,
+  first_heartbeat TIMESTAMPTZ,
+  last_heartbeat TIMESTAMPTZ,
   
   PRIMARY KEY (learner, lecture),
   
@@ -92,23 +294,68 @@ CREATE TABLE learner_lecture (
     FOREIGN KEY (lecture) REFERENCES lecture(lecture_id)
 );
 
+-- Upgrades for lecture schedules created before calendar feeds and watch progress
+ALTER TABLE learner_lecture ADD COLUMN IF NOT EXISTS sequence INT NOT NULL DEFAULT 0;
+ALTER TABLE learner_lecture ADD COLUMN IF NOT EXISTS position_seconds INT NOT NULL DEFAULT 0;
+ALTER TABLE learner_lecture ADD COLUMN IF NOT EXISTS watched_seconds INT NOT NULL DEFAULT 0;
+ALTER TABLE learner_lecture ADD COLUMN IF NOT EXISTS last_heartbeat TIMESTAMPTZ;
+
+-- Upgrade for watch progress recorded before first heartbeats were, the time already watched stays within the cap
+DO $$
+BEGIN
+  IF NOT EXISTS (SELECT 1 FROM information_schema.columns WHERE table_name = 'learner_lecture' AND column_name = 'first_heartbeat') THEN
+    ALTER TABLE learner_lecture ADD COLUMN first_heartbeat TIMESTAMPTZ;
+    UPDATE learner_lecture SET first_heartbeat = last_heartbeat - make_interval(secs => watched_seconds) WHERE last_heartbeat IS NOT NULL;
+  END IF;
+END $$;
+
+CREATE INDEX IF NOT EXISTS learner_lecture_lecture ON learner_lecture (lecture);
+
 -- tutorial table holds the tutorials for a module
-CREATE TABLE tutorial (
+-- meeting_provider is one of jitsi, link or local, empty when the tutorial has no room yet
+-- content_key identifies the tutorial across the versions of its module
+CREATE TABLE IF NOT EXISTS tutorial (
   tutorial_id uuid DEFAULT uuid_generate_v4 (),
-  week INT NOT NULL,
+  week INT NOT NULL CHECK (week >= 0),
   title VARCHAR NOT NULL,
   description TEXT NOT NULL,
   module VARCHAR NOT NULL,
+  meeting_provider VARCHAR NOT NULL DEFAULT '',
+  room_url VARCHAR NOT NULL DEFAULT '',
+  passcode VARCHAR NOT NULL DEFAULT '',
+  version INT NOT NULL DEFAULT 1,
+  content_key uuid NOT NULL DEFAULT uuid_generate_v4 (),
 
   PRIMARY KEY (tutorial_id),
+  UNIQUE (module, version, content_key),
   CONSTRAINT fk_module
     FOREIGN KEY (module) REFERENCES module(module_id)
 );
 
-CREATE TABLE learner_tutorial (
+-- Upgrades for tutorials created before meeting rooms, weeks can't be negative
+ALTER TABLE tutorial ADD COLUMN IF NOT EXISTS meeting_provider VARCHAR NOT NULL DEFAULT '';
+ALTER TABLE tutorial ADD COLUMN IF NOT EXISTS room_url VARCHAR NOT NULL DEFAULT '';
+ALTER TABLE tutorial ADD COLUMN IF NOT EXISTS passcode VARCHAR NOT NULL DEFAULT '';
+ALTER TABLE tutorial DROP CONSTRAINT IF EXISTS tutorial_week_check;
+ALTER TABLE tutorial ADD CONSTRAINT tutorial_week_check CHECK (week >= 0);
+
+-- Upgrades for tutorials created before content versions
+ALTER TABLE tutorial ADD COLUMN IF NOT EXISTS version INT NOT NULL DEFAULT 1;
+ALTER TABLE tutorial ADD COLUMN IF NOT EXISTS content_key uuid NOT NULL DEFAULT uuid_generate_v4 ();
+DO $$
+BEGIN
+  IF NOT EXISTS (SELECT 1 FROM pg_constraint WHERE conname = 'tutorial_module_version_content_key_key') THEN
+    ALTER TABLE tutorial ADD CONSTRAINT tutorial_module_version_content_key_key UNIQUE (module, version, content_key);
+  END IF;
+END $$;
+
+-- attendance: NULL = NOT_RECORDED, 0 = PRESENT, 1 = ABSENT, 2 = EXCUSED
+CREATE TABLE IF NOT EXISTS learner_tutorial (
   learner VARCHAR,
   tutorial uuid,
   scheduled_datetime TIMESTAMPTZ NOT NULL,
+  attendance INT CHECK (attendance >= 0 AND attendance <= 2),
+  sequence INT NOT NULL DEFAULT 0,
 
   PRIMARY KEY (learner, tutorial),
 
@@ -118,23 +365,78 @@ CREATE TABLE learner_tutorial (
     FOREIGN KEY (tutorial) REFERENCES tutorial(tutorial_id)
 );
 
+-- Upgrades for tutorial schedules created before attendance and calendar feeds
+ALTER TABLE learner_tutorial ADD COLUMN IF NOT EXISTS attendance INT CHECK (attendance >= 0 AND attendance <= 2);
+ALTER TABLE learner_tutorial ADD COLUMN IF NOT EXISTS sequence INT NOT NULL DEFAULT 0;
+
+-- cohort_tutorial holds what is kept of a tutorial after it ran for a cohort
+CREATE TABLE IF NOT EXISTS cohort_tutorial (
+  cohort uuid,
+  tutorial uuid,
+  recording_url VARCHAR NOT NULL DEFAULT '',
+
+  PRIMARY KEY (cohort, tutorial),
+
+  CONSTRAINT fk_cohort
+    FOREIGN KEY (cohort) REFERENCES cohort(cohort_id),
+  CONSTRAINT fk_tutorial
+    FOREIGN KEY (tutorial) REFERENCES tutorial(tutorial_id)
+);
+
+-- tutorial_material holds the files uploaded for a tutorial that ran for a cohort
+-- kind: 0 = SLIDES, 1 = OTHER
+-- storage_key is where the file store keeps the content
+CREATE TABLE IF NOT EXISTS tutorial_material (
+  material_id uuid DEFAULT uuid_generate_v4 (),
+  cohort uuid NOT NULL,
+  tutorial uuid NOT NULL,
+  kind INT NOT NULL CHECK (kind >= 0 AND kind <= 1),
+  filename VARCHAR NOT NULL,
+  content_type VARCHAR NOT NULL,
+  size BIGINT NOT NULL,
+  storage_key VARCHAR NOT NULL,
+  created_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+
+  PRIMARY KEY (material_id),
+
+  CONSTRAINT fk_cohort
+    FOREIGN KEY (cohort) REFERENCES cohort(cohort_id),
+  CONSTRAINT fk_tutorial
+    FOREIGN KEY (tutorial) REFERENCES tutorial(tutorial_id)
+);
+
 -- flashcards table holds the associated flashcards for a module
-CREATE TABLE flashcard (
+-- flashcards belong to the version of their lecture, content_key identifies them across versions
+CREATE TABLE IF NOT EXISTS flashcard (
   flashcard_id uuid DEFAULT uuid_generate_v4 (),
   top_side TEXT NOT NULL,
   bottom_side TEXT NOT NULL,
   lecture uuid NOT NULL,
+  content_key uuid NOT NULL DEFAULT uuid_generate_v4 (),
 
   PRIMARY KEY (flashcard_id),
+  UNIQUE (lecture, content_key),
   CONSTRAINT fk_lecture
     FOREIGN KEY (lecture) REFERENCES lecture(lecture_id)
 );
 
+-- Upgrades for flashcards created before content versions
+ALTER TABLE flashcard ADD COLUMN IF NOT EXISTS content_key uuid NOT NULL DEFAULT uuid_generate_v4 ();
+DO $$
+BEGIN
+  IF NOT EXISTS (SELECT 1 FROM pg_constraint WHERE conname = 'flashcard_lecture_content_key_key') THEN
+    ALTER TABLE flashcard ADD CONSTRAINT flashcard_lecture_content_key_key UNIQUE (lecture, content_key);
+  END IF;
+END $$;
+
 -- Relationship between flashcard and learner
-CREATE TABLE learner_flashcard (
+-- passes and fails count the reviews of the learner, a passed card without repeats left is mastered
+CREATE TABLE IF NOT EXISTS learner_flashcard (
   learner VARCHAR,
   flashcard uuid,
   repeat INT DEFAULT 0 NOT NULL,
+  passes INT DEFAULT 0 NOT NULL,
+  fails INT DEFAULT 0 NOT NULL,
   selected DATE,
 
   PRIMARY KEY (learner, flashcard),
@@ -144,3 +446,174 @@ CREATE TABLE learner_flashcard (
   CONSTRAINT fk_flashcard
     FOREIGN KEY (flashcard) REFERENCES flashcard(flashcard_id)
 );
+
+-- Upgrades for reviews counted before passed and failed ones were
+ALTER TABLE learner_flashcard ADD COLUMN IF NOT EXISTS passes INT DEFAULT 0 NOT NULL;
+ALTER TABLE learner_flashcard ADD COLUMN IF NOT EXISTS fails INT DEFAULT 0 NOT NULL;
+
+CREATE INDEX IF NOT EXISTS learner_flashcard_flashcard ON learner_flashcard (flashcard);
+
+-- quiz holds the graded quiz at the end of a lecture
+-- max_attempts of 0 allows unlimited attempts
+CREATE TABLE IF NOT EXISTS quiz (
+  lecture uuid,
+  pass_percent INT NOT NULL CHECK (pass_percent >= 0 AND pass_percent <= 100) DEFAULT 50,
+  max_attempts INT NOT NULL CHECK (max_attempts >= 0) DEFAULT 3,
+
+  PRIMARY KEY (lecture),
+  CONSTRAINT fk_lecture
+    FOREIGN KEY (lecture) REFERENCES lecture(lecture_id)
+);
+
+-- kind: 0 = MULTIPLE_CHOICE, 1 = NUMERIC, 2 = SHORT_TEXT
+-- choices and correct_choice are for multiple choice, numeric_answer and tolerance for numeric
+-- accepted_answers are for short text, compared case insensitively
+-- content_key identifies the question across versions, so the answers of earlier attempts can follow it
+CREATE TABLE IF NOT EXISTS quiz_question (
+  question_id uuid DEFAULT uuid_generate_v4 (),
+  lecture uuid NOT NULL,
+  position INT NOT NULL,
+  kind INT NOT NULL CHECK (kind >= 0 AND kind <= 2),
+  prompt TEXT NOT NULL,
+  choices TEXT[] NOT NULL DEFAULT '{}',
+  correct_choice INT,
+  numeric_answer DOUBLE PRECISION,
+  tolerance DOUBLE PRECISION NOT NULL DEFAULT 0,
+  accepted_answers TEXT[] NOT NULL DEFAULT '{}',
+  content_key uuid NOT NULL DEFAULT uuid_generate_v4 (),
+
+  PRIMARY KEY (question_id),
+  UNIQUE (lecture, content_key),
+  CONSTRAINT fk_quiz
+    FOREIGN KEY (lecture) REFERENCES quiz(lecture)
+);
+
+-- Upgrades for questions created before they were matched across versions
+ALTER TABLE quiz_question ADD COLUMN IF NOT EXISTS content_key uuid NOT NULL DEFAULT uuid_generate_v4 ();
+DO $$
+BEGIN
+  IF NOT EXISTS (SELECT 1 FROM pg_constraint WHERE conname = 'quiz_question_lecture_content_key_key') THEN
+    ALTER TABLE quiz_question ADD CONSTRAINT quiz_question_lecture_content_key_key UNIQUE (lecture, content_key);
+  END IF;
+END $$;
+
+-- quiz_attempt holds every graded submission of a learner
+CREATE TABLE IF NOT EXISTS quiz_attempt (
+  attempt_id uuid DEFAULT uuid_generate_v4 (),
+  learner VARCHAR NOT NULL,
+  lecture uuid NOT NULL,
+  score INT NOT NULL,
+  max_score INT NOT NULL,
+  passed bool NOT NULL,
+  answers JSONB NOT NULL,
+  submitted_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+
+  PRIMARY KEY (attempt_id),
+
+  CONSTRAINT fk_learner
+    FOREIGN KEY (learner) REFERENCES learner(email),
+  CONSTRAINT fk_lecture
+    FOREIGN KEY (lecture) REFERENCES lecture(lecture_id)
+);
+
+-- audit_log records every change made through the admin endpoints
+-- action: create, update, delete, cancel, end, publish, upgrade or import, entity: module, lecture, tutorial, flashcard, quiz, prerequisites or cohort
+-- payload holds the request that made the change
+CREATE TABLE IF NOT EXISTS audit_log (
+  audit_id uuid DEFAULT uuid_generate_v4 (),
+  actor VARCHAR NOT NULL,
+  action VARCHAR NOT NULL,
+  entity VARCHAR NOT NULL,
+  entity_id VARCHAR NOT NULL,
+  payload JSONB NOT NULL DEFAULT '{}',
+  created_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+
+  PRIMARY KEY (audit_id),
+
+  CONSTRAINT fk_actor
+    FOREIGN KEY (actor) REFERENCES learner(email)
+);
+
+-- notification holds the messages shown to a learner in the app
+-- kind: cohort_created, cohort_rescheduled, cohort_cancelled or certificate_issued
+-- payload holds the ids the message is about, like the module and cohort
+CREATE TABLE IF NOT EXISTS notification (
+  notification_id uuid DEFAULT uuid_generate_v4 (),
+  learner VARCHAR NOT NULL,
+  kind VARCHAR NOT NULL,
+  message TEXT NOT NULL,
+  payload JSONB NOT NULL DEFAULT '{}',
+  created_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+  read_at TIMESTAMPTZ,
+
+  PRIMARY KEY (notification_id),
+
+  CONSTRAINT fk_learner
+    FOREIGN KEY (learner) REFERENCES learner(email)
+);
+
+CREATE INDEX IF NOT EXISTS notification_learner_created ON notification (learner, created_at);
+
+-- learner_risk holds the latest risk score of each learner in a running cohort, refreshed by the risk job
+-- days_inactive counts the days since the last flashcard review, reviews and failed_reviews cover the module's cards
+CREATE TABLE IF NOT EXISTS learner_risk (
+  learner VARCHAR,
+  cohort uuid,
+  score INT NOT NULL,
+  missed_lectures INT NOT NULL DEFAULT 0,
+  days_inactive INT NOT NULL DEFAULT 0,
+  reviews INT NOT NULL DEFAULT 0,
+  failed_reviews INT NOT NULL DEFAULT 0,
+  computed_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+
+  PRIMARY KEY (learner, cohort),
+
+  CONSTRAINT fk_learner
+    FOREIGN KEY (learner) REFERENCES learner(email),
+  CONSTRAINT fk_cohort
+    FOREIGN KEY (cohort) REFERENCES cohort(cohort_id)
+);
+
+CREATE INDEX IF NOT EXISTS learner_risk_cohort_score ON learner_risk (cohort, score);
+
+-- module_completion holds the evaluation of each learner when their cohort ends, rates are percentages
+CREATE TABLE IF NOT EXISTS module_completion (
+  learner VARCHAR,
+  cohort uuid,
+  module VARCHAR NOT NULL,
+  passed bool NOT NULL,
+  lecture_rate INT NOT NULL,
+  attendance_rate INT NOT NULL,
+  mastery_rate INT NOT NULL,
+  evaluated_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+
+  PRIMARY KEY (learner, cohort),
+
+  CONSTRAINT fk_learner
+    FOREIGN KEY (learner) REFERENCES learner(email),
+  CONSTRAINT fk_cohort
+    FOREIGN KEY (cohort) REFERENCES cohort(cohort_id),
+  CONSTRAINT fk_module
+    FOREIGN KEY (module) REFERENCES module(module_id)
+);
+
+-- certificate is issued to the learners that passed a module
+-- signature is an HMAC over the learner, module, cohort and issue time, so edited rows stop verifying
+CREATE TABLE IF NOT EXISTS certificate (
+  certificate_id uuid DEFAULT uuid_generate_v4 (),
+  learner VARCHAR NOT NULL,
+  module VARCHAR NOT NULL,
+  cohort uuid NOT NULL,
+  issued_at TIMESTAMPTZ NOT NULL,
+  signature VARCHAR NOT NULL,
+
+  PRIMARY KEY (certificate_id),
+  UNIQUE (learner, cohort),
+
+  CONSTRAINT fk_learner
+    FOREIGN KEY (learner) REFERENCES learner(email),
+  CONSTRAINT fk_module
+    FOREIGN KEY (module) REFERENCES module(module_id),
+  CONSTRAINT fk_cohort
+    FOREIGN KEY (cohort) REFERENCES cohort(cohort_id)
+);
@@ -5,10 +5,11 @@ go 1.16
 require (
 	cloud.google.com/go/firestore v1.5.0 // indirect
 	cloud.google.com/go/storage v1.15.0 // indirect
-	firebase.google.com/go v3.13.0+incompatible // indirect
-	github.com/dgrijalva/jwt-go v3.2.0+incompatible // indirect
-	github.com/gorilla/mux v1.8.0 // indirect
-	github.com/lib/pq v1.10.1 // indirect
+	firebase.google.com/go v3.13.0+incompatible
+	github.com/dgrijalva/jwt-go v3.2.0+incompatible
+	github.com/gorilla/mux v1.8.0
+	github.com/lib/pq v1.10.1
 	golang.org/x/crypto v0.0.0-20210503195802-e9a32991a82e // indirect
-	google.golang.org/api v0.47.0 // indirect
+	google.golang.org/api v0.47.0
+	gopkg.in/yaml.v3 v3.0.1
 )
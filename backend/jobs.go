@@ -0,0 +1,31 @@
+package main
+
+import (
+	"log"
+	"os"
+	"strconv"
+	"time"
+)
+
+// Runs the periodic jobs every interval, set with JOB_INTERVAL in minutes
+// Cohorts are ended first, so the risk scores don't cover learners that just finished
+func startBackgroundJobs() {
+	interval := time.Hour
+	if minutes, err := strconv.Atoi(os.Getenv("JOB_INTERVAL")); err == nil && minutes > 0 {
+		interval = time.Duration(minutes) * time.Minute
+	}
+
+	go func() {
+		for {
+			if err := endFinishedCohorts(); err != nil {
+				log.Print("Ending finished cohorts failed: ", err)
+			}
+
+			if err := scoreLearnerRisk(); err != nil {
+				log.Print("Scoring learner risk failed: ", err)
+			}
+
+			time.Sleep(interval)
+		}
+	}()
+}
@@ -2,17 +2,21 @@ package main
 
 import (
 	"database/sql"
+	"encoding/base64"
 	"encoding/json"
 	"math/rand"
 	"net/http"
 	"regexp"
+	"strconv"
+	"strings"
 	"time"
 
 	"github.com/gorilla/mux"
-	_ "github.com/lib/pq"
+	"github.com/lib/pq"
 
 	"context"
 	"fmt"
+	"io"
 	"log"
 	"os"
 
@@ -21,16 +25,34 @@ import (
 	"google.golang.org/api/option"
 )
 
+// Learner roles, stored in learner.role
+const (
+	ROLE_LEARNER = iota
+	ROLE_INSTRUCTOR
+	ROLE_ADMIN
+)
+
 // Global environmental variables
 var DB_URL string
 var JWT_SECRET string
+var CERTIFICATE_SECRET string
+
+// Jitsi rooms can only be used when JITSI_APP_SECRET is set
+var JITSI_APP_SECRET string
 
 // Global handlers for simplicity
 var db *sql.DB
 
+var files fileStore
+
 var fb *firebase.App
 
 func main() {
+	// Module packages are synced from the command line instead of running the server
+	if len(os.Args) > 1 {
+		os.Exit(runCommand(os.Args[1:]))
+	}
+
 	fmt.Println("Server initialising...")
 
 	// Getting all the environmental variables
@@ -38,6 +60,14 @@ func main() {
 	checkEnvVariable(DB_URL)
 	JWT_SECRET = os.Getenv("JWT_SECRET")
 	checkEnvVariable(JWT_SECRET)
+	CERTIFICATE_SECRET = os.Getenv("CERTIFICATE_SECRET")
+	checkEnvVariable(CERTIFICATE_SECRET)
+	JITSI_APP_SECRET = os.Getenv("JITSI_APP_SECRET")
+
+	// The fake meeting provider is only there for local development
+	if os.Getenv("LOCAL_MEETINGS") != "" {
+		meetingProviders["local"] = &localMeetingProvider{}
+	}
 
 	// Loading up firebase
 	var err error
@@ -45,6 +75,13 @@ func main() {
 	fb, err = firebase.NewApp(context.Background(), nil, opt)
 	PanicOnError(err)
 
+	// Uploaded files are kept on the local disk
+	storageDir := os.Getenv("STORAGE_DIR")
+	if storageDir == "" {
+		storageDir = "./uploads"
+	}
+	files = localFileStore{Root: storageDir}
+
 	// Initialise the database
 	db, err = sql.Open("postgres", DB_URL)
 	PanicOnError(err)
@@ -54,6 +91,9 @@ func main() {
 	err = db.Ping()
 	PanicOnError(err)
 
+	// Ending finished cohorts and scoring the learners at risk of dropping out in the background
+	startBackgroundJobs()
+
 	// Initialise the router
 	r := mux.NewRouter()
 
@@ -62,6 +102,16 @@ func main() {
 
 	// Retrieve all the existing modules
 	r.HandleFunc("/api/v0.2/modules", getModules).Methods("GET", "OPTIONS")
+	r.HandleFunc("/api/v0.2/modules/{id:[A-Z]{2,4}[0-9]{4}}", getModuleDetail).Methods("GET", "OPTIONS")
+
+	// Calendar feeds are authenticated by their secret token
+	r.HandleFunc("/api/v0.2/calendar/{token:[0-9a-f]+}.ics", getCalendarFeed).Methods("GET", "OPTIONS")
+
+	// Certificates are public so that anyone can verify them
+	r.HandleFunc("/api/v0.2/certificates/{id}", getCertificateBadge).Methods("GET", "OPTIONS")
+	r.HandleFunc("/api/v0.2/certificates/{id}/verify", verifyCertificate).Methods("GET", "OPTIONS")
+	r.HandleFunc("/api/v0.2/badges/{id}", getModuleBadge).Methods("GET", "OPTIONS")
+	r.HandleFunc("/api/v0.2/issuer", getBadgeIssuer).Methods("GET", "OPTIONS")
 
 	auth := r.PathPrefix("/api/v0.2").Subrouter()
 
@@ -69,14 +119,34 @@ func main() {
 	auth.HandleFunc("/cohorts", getSelfCohorts).Methods("GET", "OPTIONS")
 	auth.HandleFunc("/cohorts/available", getCohortsForModule).Methods("GET", "OPTIONS")
 	auth.HandleFunc("/cohort/join", joinCohort).Methods("POST", "OPTIONS")
+	auth.HandleFunc("/cohort/join/late", joinCohortLate).Methods("POST", "OPTIONS")
 	auth.HandleFunc("/cohort/self", getModuleCohort).Methods("GET", "OPTIONS")
 	auth.HandleFunc("/cohort/leave", leaveModuleCohort).Methods("DELETE", "OPTIONS")
+	auth.HandleFunc("/cohort/transfer", transferCohort).Methods("POST", "OPTIONS")
+
+	// Related to completing modules
+	auth.HandleFunc("/certificates", getSelfCertificates).Methods("GET", "OPTIONS")
+
+	// Related to the waitlist for new cohorts
+	auth.HandleFunc("/modules/waitlist", joinModuleWaitlist).Methods("POST", "OPTIONS")
+	auth.HandleFunc("/modules/waitlist", leaveModuleWaitlist).Methods("DELETE", "OPTIONS")
+
+	// Taking a module at your own pace
+	auth.HandleFunc("/modules/selfpaced", enrollSelfPaced).Methods("POST", "OPTIONS")
+	auth.HandleFunc("/modules/selfpaced", updateSelfPaced).Methods("PUT", "OPTIONS")
+	auth.HandleFunc("/modules/{id}/progress", getModuleProgress).Methods("GET", "OPTIONS")
 
 	// Related to lectures
 	auth.HandleFunc("/lectures/today", getLectureToday).Methods("GET", "OPTIONS")
 	auth.HandleFunc("/lectures/past", getLecturesPast).Methods("GET", "OPTIONS")
+	auth.HandleFunc("/lectures/queue", getLectureQueue).Methods("GET", "OPTIONS")
 	auth.HandleFunc("/lectures/complete", completeLecture).Methods("POST", "OPTIONS")
 	auth.HandleFunc("/lectures/flashcards", getLectureFlashcards).Methods("GET", "OPTIONS")
+	auth.HandleFunc("/lectures/progress", getWatchProgress).Methods("GET", "OPTIONS")
+	auth.HandleFunc("/lectures/progress", recordHeartbeat).Methods("POST", "OPTIONS")
+	auth.HandleFunc("/lectures/quiz", getLearnerQuiz).Methods("GET", "OPTIONS")
+	auth.HandleFunc("/lectures/quiz", submitQuiz).Methods("POST", "OPTIONS")
+	auth.HandleFunc("/lectures/quiz/results", getQuizResults).Methods("GET", "OPTIONS")
 
 	// Related to daily review
 	auth.HandleFunc("/review", getDailyReview).Methods("GET", "OPTIONS")
@@ -88,12 +158,73 @@ func main() {
 	auth.HandleFunc("/self", getSelf).Methods("GET", "OPTIONS")
 	auth.HandleFunc("/self", updateSelf).Methods("PUT", "OPTIONS")
 
+	// Messages for the learner
+	auth.HandleFunc("/notifications", getNotifications).Methods("GET", "OPTIONS")
+	auth.HandleFunc("/notifications/read", readNotifications).Methods("POST", "OPTIONS")
+
+	// Calendar subscription
+	auth.HandleFunc("/calendar", getCalendar).Methods("GET", "OPTIONS")
+	auth.HandleFunc("/calendar/reset", resetCalendar).Methods("POST", "OPTIONS")
+
 	// Get tutorial schedule
-	auth.HandleFunc("/tutorials", getUpcomingTutorials).Methods("GET", "OPTIONS")
+	auth.HandleFunc("/tutorials", getTutorials).Methods("GET", "OPTIONS")
+	auth.HandleFunc("/tutorials/attendance", getSelfAttendance).Methods("GET", "OPTIONS")
+	auth.HandleFunc("/tutorials/{id}/join", joinTutorial).Methods("GET", "OPTIONS")
+	auth.HandleFunc("/tutorials/{id}/materials", getTutorialMaterials).Methods("GET", "OPTIONS")
+	auth.HandleFunc("/tutorials/{id}/materials/{material}", downloadTutorialMaterial).Methods("GET", "OPTIONS")
+
+	// Instructor only endpoints
+	instructor := auth.PathPrefix("/instructor").Subrouter()
+	instructor.HandleFunc("/cohort/reschedule", rescheduleCohort).Methods("POST", "OPTIONS")
+	instructor.HandleFunc("/lectures/uncomplete", uncompleteLecture).Methods("POST", "OPTIONS")
+	instructor.HandleFunc("/lectures/quiz", getQuiz).Methods("GET", "OPTIONS")
+	instructor.HandleFunc("/cohorts/{id}/learners", getCohortLearnerProgress).Methods("GET", "OPTIONS")
+	instructor.HandleFunc("/cohorts/{id}/summary", getCohortSummary).Methods("GET", "OPTIONS")
+	instructor.HandleFunc("/cohorts/{id}/risk", getCohortRisk).Methods("GET", "OPTIONS")
+	instructor.HandleFunc("/tutorials/attendance", getCohortAttendance).Methods("GET", "OPTIONS")
+	instructor.HandleFunc("/tutorials/attendance", recordAttendance).Methods("PUT", "OPTIONS")
+	instructor.HandleFunc("/tutorials/meeting", updateTutorialMeeting).Methods("PUT", "OPTIONS")
+	instructor.HandleFunc("/tutorials/{id}/recording", updateTutorialRecording).Methods("PUT", "OPTIONS")
+	instructor.HandleFunc("/tutorials/{id}/materials", uploadTutorialMaterial).Methods("POST", "OPTIONS")
+	instructor.HandleFunc("/tutorials/{id}/materials/{material}", deleteTutorialMaterial).Methods("DELETE", "OPTIONS")
+
+	// Admin only endpoints
+	admin := auth.PathPrefix("/admin").Subrouter()
+	admin.HandleFunc("/cohorts/suggest", suggestCohortSlots).Methods("GET", "OPTIONS")
+	admin.HandleFunc("/cohorts", getAdminCohorts).Methods("GET", "OPTIONS")
+	admin.HandleFunc("/cohorts", createCohort).Methods("POST", "OPTIONS")
+	admin.HandleFunc("/cohorts/{id}", updateCohortSlot).Methods("PUT", "OPTIONS")
+	admin.HandleFunc("/cohorts/{id}/cancel", cancelCohort).Methods("POST", "OPTIONS")
+	admin.HandleFunc("/cohorts/{id}/end", endCohortNow).Methods("POST", "OPTIONS")
+
+	// Content management
+	admin.HandleFunc("/modules", getAdminModules).Methods("GET", "OPTIONS")
+	admin.HandleFunc("/modules", createModule).Methods("POST", "OPTIONS")
+	admin.HandleFunc("/modules/{id}", getModuleContent).Methods("GET", "OPTIONS")
+	admin.HandleFunc("/modules/{id}", updateModule).Methods("PUT", "OPTIONS")
+	admin.HandleFunc("/modules/{id}", deleteModule).Methods("DELETE", "OPTIONS")
+	admin.HandleFunc("/modules/{id}/lectures", createLecture).Methods("POST", "OPTIONS")
+	admin.HandleFunc("/modules/{id}/tutorials", createTutorial).Methods("POST", "OPTIONS")
+	admin.HandleFunc("/lectures/{id}", updateLecture).Methods("PUT", "OPTIONS")
+	admin.HandleFunc("/lectures/{id}", deleteLecture).Methods("DELETE", "OPTIONS")
+	admin.HandleFunc("/lectures/{id}/flashcards", createFlashcard).Methods("POST", "OPTIONS")
+	admin.HandleFunc("/lectures/{id}/quiz", updateQuiz).Methods("PUT", "OPTIONS")
+	admin.HandleFunc("/lectures/{id}/prerequisites", updateLecturePrerequisites).Methods("PUT", "OPTIONS")
+	admin.HandleFunc("/tutorials/{id}", updateTutorial).Methods("PUT", "OPTIONS")
+	admin.HandleFunc("/tutorials/{id}", deleteTutorial).Methods("DELETE", "OPTIONS")
+	admin.HandleFunc("/flashcards/{id}", updateFlashcard).Methods("PUT", "OPTIONS")
+	admin.HandleFunc("/flashcards/{id}", deleteFlashcard).Methods("DELETE", "OPTIONS")
+	admin.HandleFunc("/modules/{id}/publish", publishModule).Methods("POST", "OPTIONS")
+	admin.HandleFunc("/modules/{id}/diff", getModuleDiff).Methods("GET", "OPTIONS")
+	admin.HandleFunc("/cohorts/{id}/upgrade", getCohortUpgrade).Methods("GET", "OPTIONS")
+	admin.HandleFunc("/cohorts/{id}/upgrade", upgradeCohort).Methods("POST", "OPTIONS")
+	admin.HandleFunc("/audit", getAuditLog).Methods("GET", "OPTIONS")
 
 	// Enabling middlewares
 	r.Use(corsMiddleware)
 	auth.Use(authMiddleware)
+	instructor.Use(instructorMiddleware)
+	admin.Use(adminMiddleware)
 
 	log.Print("All setup running, and available on port 8000")
 	log.Fatal(http.ListenAndServe(":8000", r))
@@ -187,19 +318,123 @@ func updateSelf(w http.ResponseWriter, r *http.Request) {
 
 /************** MODULE HANDLERS ******************************/
 type moduleResponse struct {
-	Id          string `json:"id"`
-	Title       string `json:"title"`
-	Image       string `json:"image"`
-	Description string `json:"description"`
-	Duration    int    `json:"duration"`
+	Id          string   `json:"id"`
+	Title       string   `json:"title"`
+	Image       string   `json:"image"`
+	Description string   `json:"description"`
+	Duration    int      `json:"duration"`
+	Tags        []string `json:"tags"`
+	Difficulty  string   `json:"difficulty"`
+	Language    string   `json:"language"`
+	OpenCohorts int      `json:"open_cohorts"`
 }
 
+// Page size of the catalog, unless the limit query parameter asks for less
+const maxCatalogPage = 100
+const defaultCatalogPage = 20
+
+// Lists the published modules of the catalog
+// q searches the title and description, tag (repeatable), difficulty and language filter the modules
+// and has_open_cohorts=true keeps the modules with a cohort still open for enrollment
+// sort is title (default), duration or relevance (default when searching), the X-Next-Cursor header holds the cursor for the next page
 func getModules(w http.ResponseWriter, r *http.Request) {
 	var res []moduleResponse
 
-	sqlquery := `SELECT module_id, title, image, description, duration FROM module`
+	query := r.URL.Query()
+
+	limit := defaultCatalogPage
+	if l := query.Get("limit"); l != "" {
+		var err error
+		limit, err = strconv.Atoi(l)
+		if err != nil || limit <= 0 || limit > maxCatalogPage {
+			http.Error(w, "Invalid limit", http.StatusBadRequest)
+			return
+		}
+	}
+
+	var args []interface{}
+	conditions := []string{"published_version IS NOT NULL"}
+	rank := "0::real"
+
+	search := strings.TrimSpace(query.Get("q"))
+	if search != "" {
+		args = append(args, search)
+		conditions = append(conditions, fmt.Sprintf("search @@ websearch_to_tsquery('english', $%d)", len(args)))
+		rank = fmt.Sprintf("ts_rank(search, websearch_to_tsquery('english', $%d))", len(args))
+	}
+
+	if tags := query["tag"]; len(tags) > 0 {
+		for i := range tags {
+			tags[i] = strings.ToLower(strings.TrimSpace(tags[i]))
+		}
+
+		args = append(args, pq.Array(tags))
+		conditions = append(conditions, fmt.Sprintf("tags @> $%d", len(args)))
+	}
+
+	if difficulty := query.Get("difficulty"); difficulty != "" {
+		if !moduleDifficulties[difficulty] {
+			http.Error(w, "Invalid difficulty", http.StatusBadRequest)
+			return
+		}
+
+		args = append(args, difficulty)
+		conditions = append(conditions, fmt.Sprintf("difficulty = $%d", len(args)))
+	}
+
+	if language := query.Get("language"); language != "" {
+		args = append(args, language)
+		conditions = append(conditions, fmt.Sprintf("language = $%d", len(args)))
+	}
+
+	// Only cohorts that haven't started or filled up yet take new learners
+	if query.Get("has_open_cohorts") == "true" {
+		conditions = append(conditions, "EXISTS (SELECT 1 FROM cohort WHERE cohort.module = module.module_id AND cohort.status = 0)")
+	}
+
+	sort := query.Get("sort")
+	if sort == "" {
+		sort = "title"
+		if search != "" {
+			sort = "relevance"
+		}
+	}
+
+	// Ties are broken by the module id, so every module has a single place in the order
+	var key, direction, comparison string
+	switch {
+	case sort == "title":
+		key, direction, comparison = "title", "ASC", ">"
+	case sort == "duration":
+		key, direction, comparison = "duration", "ASC", ">"
+	case sort == "relevance" && search != "":
+		key, direction, comparison = rank, "DESC", "<"
+	default:
+		http.Error(w, "Invalid sort", http.StatusBadRequest)
+		return
+	}
 
-	result, err := db.Query(sqlquery)
+	if cursor := query.Get("cursor"); cursor != "" {
+		cursorId, cursorValue, err := decodeCatalogCursor(cursor, sort)
+		if err != nil {
+			http.Error(w, "Invalid cursor", http.StatusBadRequest)
+			return
+		}
+
+		args = append(args, cursorValue, cursorId)
+		conditions = append(conditions, fmt.Sprintf("(%s %s $%d OR (%s = $%d AND module_id > $%d))", key, comparison, len(args)-1, key, len(args)-1, len(args)))
+	}
+
+	// Fetch one extra to know if there is a next page
+	args = append(args, limit+1)
+
+	sqlquery := fmt.Sprintf(`SELECT module_id, title, image, description, duration, tags, difficulty, language,
+			(SELECT COUNT(*) FROM cohort WHERE cohort.module = module.module_id AND cohort.status = 0), %s
+		FROM module
+		WHERE %s
+		ORDER BY %s %s, module_id ASC LIMIT $%d`, rank, strings.Join(conditions, " AND "), key, direction, len(args))
+
+	result, err := db.Query(sqlquery, args...)
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
@@ -207,14 +442,32 @@ func getModules(w http.ResponseWriter, r *http.Request) {
 
 	defer result.Close()
 
+	var ranks []float32
 	for result.Next() {
 		var module moduleResponse
-		if err := result.Scan(&module.Id, &module.Title, &module.Image, &module.Description, &module.Duration); err != nil {
+		var moduleRank float32
+		if err := result.Scan(&module.Id, &module.Title, &module.Image, &module.Description, &module.Duration, pq.Array(&module.Tags),
+			&module.Difficulty, &module.Language, &module.OpenCohorts, &moduleRank); err != nil {
 			http.Error(w, err.Error(), http.StatusInternalServerError)
 			return
 		}
 
 		res = append(res, module)
+		ranks = append(ranks, moduleRank)
+	}
+
+	if len(res) > limit {
+		res = res[:limit]
+		last := res[limit-1]
+
+		value := last.Title
+		switch sort {
+		case "duration":
+			value = strconv.Itoa(last.Duration)
+		case "relevance":
+			value = strconv.FormatFloat(float64(ranks[limit-1]), 'g', -1, 32)
+		}
+		w.Header().Set("X-Next-Cursor", encodeCatalogCursor(last.Id, value))
 	}
 
 	// Marshal to JSON and return
@@ -227,7 +480,177 @@ func getModules(w http.ResponseWriter, r *http.Request) {
 	w.Write(dres)
 }
 
+// Cursors point at the last module of a page, by its id and the value it is sorted by
+// The id goes first since module ids never contain the separator
+func encodeCatalogCursor(id string, value string) string {
+	return base64.RawURLEncoding.EncodeToString([]byte(id + "|" + value))
+}
+
+// The value is parsed by the sort of the listing, so a cursor from another sort is rejected
+func decodeCatalogCursor(cursor string, sort string) (string, interface{}, error) {
+	raw, err := base64.RawURLEncoding.DecodeString(cursor)
+	if err != nil {
+		return "", nil, err
+	}
+
+	parts := strings.SplitN(string(raw), "|", 2)
+	if len(parts) != 2 {
+		return "", nil, fmt.Errorf("malformed cursor")
+	}
+
+	switch sort {
+	case "duration":
+		duration, err := strconv.Atoi(parts[1])
+		return parts[0], duration, err
+	case "relevance":
+		rank, err := strconv.ParseFloat(parts[1], 32)
+		return parts[0], rank, err
+	}
+
+	return parts[0], parts[1], nil
+}
+
+type syllabusLecture struct {
+	Day         int    `json:"day"`
+	Title       string `json:"title"`
+	Description string `json:"description"`
+}
+
+type syllabusWeek struct {
+	Week      int      `json:"week"`
+	Tutorials []string `json:"tutorials"`
+}
+
+// Seats are what is left until the cohort is full
+type upcomingCohort struct {
+	Id           string    `json:"id"`
+	StartDate    time.Time `json:"start_date"`
+	TutorialDay  int       `json:"tutorial_day"`
+	TutorialTime int       `json:"tutorial_time"`
+	Timezone     string    `json:"timezone"`
+	Seats        int       `json:"seats"`
+}
+
+type moduleDetailRes struct {
+	moduleResponse
+	Lectures       []syllabusLecture `json:"lectures"`
+	Weeks          []syllabusWeek    `json:"weeks"`
+	Cohorts        []upcomingCohort  `json:"cohorts"`
+	FlashcardCount int               `json:"flashcard_count"`
+}
+
+// Returns a published module with its syllabus and upcoming cohorts, for learners deciding whether to join
+// The syllabus shows the published version, the one new cohorts start on
+func getModuleDetail(w http.ResponseWriter, r *http.Request) {
+	moduleId := mux.Vars(r)["id"]
+
+	res := moduleDetailRes{Lectures: []syllabusLecture{}, Weeks: []syllabusWeek{}, Cohorts: []upcomingCohort{}}
+
+	var version int
+	sqlquery := `SELECT module_id, title, image, description, duration, tags, difficulty, language, published_version
+							FROM module WHERE module_id = $1 AND published_version IS NOT NULL`
+	if err := db.QueryRow(sqlquery, moduleId).Scan(&res.Id, &res.Title, &res.Image, &res.Description, &res.Duration,
+		pq.Array(&res.Tags), &res.Difficulty, &res.Language, &version); err != nil {
+		if err == sql.ErrNoRows {
+			http.Error(w, "Invalid module id", http.StatusNotFound)
+		} else {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+		}
+		return
+	}
+
+	sqlquery = `SELECT date_offset, title, description FROM lecture WHERE module = $1 AND version = $2 ORDER BY date_offset`
+	result, err := db.Query(sqlquery, moduleId, version)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	defer result.Close()
+
+	for result.Next() {
+		var lecture syllabusLecture
+		if err := result.Scan(&lecture.Day, &lecture.Title, &lecture.Description); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		res.Lectures = append(res.Lectures, lecture)
+	}
+
+	sqlquery = `SELECT week, title FROM tutorial WHERE module = $1 AND version = $2 ORDER BY week, title`
+	result, err = db.Query(sqlquery, moduleId, version)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	defer result.Close()
+
+	for result.Next() {
+		var week int
+		var title string
+		if err := result.Scan(&week, &title); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		if len(res.Weeks) == 0 || res.Weeks[len(res.Weeks)-1].Week != week {
+			res.Weeks = append(res.Weeks, syllabusWeek{Week: week, Tutorials: []string{}})
+		}
+		res.Weeks[len(res.Weeks)-1].Tutorials = append(res.Weeks[len(res.Weeks)-1].Tutorials, title)
+	}
+
+	// Cohorts that haven't started yet, including the full ones so learners can join the waitlist instead
+	sqlquery = `SELECT cohort_id, status, start_date, weekly_tutorial_day, weekly_tutorial_time, timezone, COUNT(learner_cohort.learner)
+							FROM cohort LEFT JOIN learner_cohort ON learner_cohort.cohort = cohort.cohort_id
+							WHERE cohort.module = $1 AND cohort.status <= 1
+							GROUP BY cohort_id, status
+							ORDER BY start_date`
+	result, err = db.Query(sqlquery, moduleId)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	defer result.Close()
+
+	for result.Next() {
+		var cohort upcomingCohort
+		var status, learnerCount int
+		if err := result.Scan(&cohort.Id, &status, &cohort.StartDate, &cohort.TutorialDay, &cohort.TutorialTime, &cohort.Timezone, &learnerCount); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		// Enrollment also closes when a transfer fills the cohort, so status decides over the count
+		if status == 0 && learnerCount < cohortCapacity {
+			cohort.Seats = cohortCapacity - learnerCount
+			res.OpenCohorts++
+		}
+		res.Cohorts = append(res.Cohorts, cohort)
+	}
+
+	sqlquery = `SELECT COUNT(*) FROM flashcard INNER JOIN lecture ON lecture.lecture_id = flashcard.lecture
+							WHERE lecture.module = $1 AND lecture.version = $2`
+	if err := db.QueryRow(sqlquery, moduleId, version).Scan(&res.FlashcardCount); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	dres, err := json.Marshal(res)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Write(dres)
+}
+
 /*************** COHORT HANDLERS ***************************/
+// Cohorts close enrollment once they have cohortCapacity learners
+const cohortCapacity = 15
+
 type cohortResponse struct {
 	ModuleId    string    `json:"id"`
 	Title       string    `json:"title"`
@@ -296,6 +719,8 @@ type cohortData struct {
 	StartDate          time.Time
 	WeeklyTutorialDay  int
 	WeeklyTutorialTime int
+	Timezone           string
+	ContentVersion     int
 }
 
 // Relative date is the number of days from the cohort start date
@@ -313,23 +738,37 @@ type tutorialDate struct {
 	AbsoluteDateTime time.Time
 }
 
+// Tutorial day and time are in the cohort's timezone
+// Local tutorial day and time are the same slot in the learner's timezone
 type moduleCohortRes struct {
-	Id           string `json:"id"`
-	TutorialDay  int    `json:"tutorial_day"`
-	TutorialTime int    `json:"tutorial_time"`
-	LearnerCount int    `json:"learner_count"`
+	Id                string    `json:"id"`
+	StartDate         time.Time `json:"start_date"`
+	TutorialDay       int       `json:"tutorial_day"`
+	TutorialTime      int       `json:"tutorial_time"`
+	Timezone          string    `json:"timezone"`
+	LocalTutorialDay  int       `json:"local_tutorial_day"`
+	LocalTutorialTime int       `json:"local_tutorial_time"`
+	FitScore          int       `json:"fit_score"`
+	LearnerCount      int       `json:"learner_count"`
 }
 
 func getCohortsForModule(w http.ResponseWriter, r *http.Request) {
 	query := r.URL.Query()
 	moduleId := query.Get("module")
 	lemail := r.Header.Get("X-User-Claim")
+	timezone := r.Header.Get("X-Timezone-Claim")
 
 	if moduleId == "" {
 		http.Error(w, "Invalid query parameters", http.StatusBadRequest)
 		return
 	}
 
+	learnerLocation, err := time.LoadLocation(timezone)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
 	var dummy string
 	// Check if learner is already enrolled in a cohort for the module
 	sqlquery := `SELECT cohort FROM learner_cohort INNER JOIN cohort ON learner_cohort.cohort = cohort.cohort_id
@@ -343,10 +782,10 @@ func getCohortsForModule(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	sqlquery = `SELECT cohort_id, weekly_tutorial_day, weekly_tutorial_time, COUNT(learner_cohort.learner) learner_count
+	sqlquery = `SELECT cohort_id, start_date, weekly_tutorial_day, weekly_tutorial_time, timezone, COUNT(learner_cohort.learner) learner_count
 							FROM cohort LEFT JOIN learner_cohort ON learner_cohort.cohort = cohort.cohort_id
 							WHERE cohort.module = $1 AND cohort.status = 0
-							GROUP BY cohort_id, cohort.weekly_tutorial_day, cohort.weekly_tutorial_time`
+							GROUP BY cohort_id, cohort.start_date, cohort.weekly_tutorial_day, cohort.weekly_tutorial_time, cohort.timezone`
 
 	var res []moduleCohortRes
 
@@ -361,14 +800,28 @@ func getCohortsForModule(w http.ResponseWriter, r *http.Request) {
 
 	for result.Next() {
 		var cohort moduleCohortRes
-		if err := result.Scan(&cohort.Id, &cohort.TutorialDay, &cohort.TutorialTime, &cohort.LearnerCount); err != nil {
+		if err := result.Scan(&cohort.Id, &cohort.StartDate, &cohort.TutorialDay, &cohort.TutorialTime, &cohort.Timezone, &cohort.LearnerCount); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		location, err := time.LoadLocation(cohort.Timezone)
+		if err != nil {
 			http.Error(w, err.Error(), http.StatusInternalServerError)
 			return
 		}
 
+		// Convert the first tutorial of the cohort, the offset can differ between zones over DST changes
+		local := tutorialDateTime(cohort.StartDate, cohort.TutorialDay, cohort.TutorialTime, location).In(learnerLocation)
+		cohort.LocalTutorialDay = (int(local.Weekday()) + 6) % 7
+		cohort.LocalTutorialTime = local.Hour()*60 + local.Minute()
+		cohort.FitScore = slotFitScore(cohort.LocalTutorialTime)
+
 		res = append(res, cohort)
 	}
 
+	rankCohortsByFit(res)
+
 	// Marshal to JSON and return
 	dres, err := json.Marshal(res)
 	if err != nil {
@@ -402,6 +855,15 @@ func joinCohort(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	if selfPaced, err := isSelfPaced(lemail, cohort.Module); err != nil || selfPaced {
+		if err == nil {
+			http.Error(w, "Already enrolled in the module at your own pace", http.StatusBadRequest)
+		} else {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+		}
+		return
+	}
+
 	var dummy string
 	// Check if learner is already enrolled in a cohort for the module
 	sqlquery = `SELECT cohort FROM learner_cohort INNER JOIN cohort ON learner_cohort.cohort = cohort.cohort_id
@@ -421,6 +883,11 @@ func joinCohort(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	if err := removeFromWaitlist(db, lemail, cohort.Module); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
 	var cohortLearnerCount int
 	// Check total count
 	sqlquery = `SELECT COUNT(learner_cohort.learner) learner_count
@@ -433,7 +900,7 @@ func joinCohort(w http.ResponseWriter, r *http.Request) {
 	}
 
 	// Close enrollment into the cohort oonce full
-	if cohortLearnerCount >= 15 {
+	if cohortLearnerCount >= cohortCapacity {
 		// Close enrollment
 		sqlquery = `UPDATE cohort SET status=1 WHERE cohort_id=$1`
 		if _, err := db.Exec(sqlquery, cohort.Id); err != nil {
@@ -485,148 +952,256 @@ func leaveModuleCohort(w http.ResponseWriter, r *http.Request) {
 	w.WriteHeader(http.StatusOK)
 }
 
-type getModuleCohortRes struct {
-	Id                 string    `json:"id"`
-	Module             string    `json:"module"`
-	Status             int       `json:"status"`
-	StartDate          time.Time `json:"start_date"`
-	WeeklyTutorialDay  int       `json:"tutorial_day"`
-	WeeklyTutorialTime int       `json:"tutorial_time"`
-	LearnerCount       int       `json:"learner_count"`
-}
-
-func getModuleCohort(w http.ResponseWriter, r *http.Request) {
-	// First retrieve the cohort
+// Moves the learner from their cohort of a module into another cohort of the same module
+// Completed lectures and flashcards are kept, the remaining schedule follows the target cohort
+func transferCohort(w http.ResponseWriter, r *http.Request) {
 	lemail := r.Header.Get("X-User-Claim")
+	query := r.URL.Query()
+	targetId := query.Get("cohort")
 
-	// Check if they're even enrolled in any cohort should only be one cohort
-	sqlquery := `SELECT cohort_id, module, status, start_date, weekly_tutorial_day, weekly_tutorial_time FROM learner_cohort INNER JOIN cohort ON learner_cohort.cohort = cohort.cohort_id WHERE learner_cohort.learner = $1`
+	if targetId == "" {
+		http.Error(w, "Invalid query parameters", http.StatusBadRequest)
+		return
+	}
 
-	var res getModuleCohortRes
+	target, err := getCohort(targetId)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	// Only cohorts that are still open or running can take in a learner
+	if target.Status != 0 && target.Status != 2 {
+		http.Error(w, "Invalid cohort id", http.StatusBadRequest)
+		return
+	}
 
-	if err := db.QueryRow(sqlquery, lemail).Scan(&res.Id, &res.Module, &res.Status, &res.StartDate, &res.WeeklyTutorialDay, &res.WeeklyTutorialTime); err != nil {
+	var sourceId string
+	var sourceStatus int
+	sqlquery := `SELECT cohort_id, status FROM learner_cohort INNER JOIN cohort ON learner_cohort.cohort = cohort.cohort_id
+								WHERE learner_cohort.learner = $1 AND cohort.module = $2`
+	if err := db.QueryRow(sqlquery, lemail, target.Module).Scan(&sourceId, &sourceStatus); err != nil {
 		if err == sql.ErrNoRows {
-			w.WriteHeader(http.StatusNoContent)
-			return
+			http.Error(w, "Not enrolled in a cohort for the module", http.StatusBadRequest)
 		} else {
 			http.Error(w, err.Error(), http.StatusInternalServerError)
-			return
 		}
+		return
 	}
 
-	// Get the count
-	sqlquery = `SELECT COUNT(learner_cohort.learner) learner_count
-							FROM cohort LEFT JOIN learner_cohort ON learner_cohort.cohort = cohort.cohort_id
-							WHERE cohort_id = $1
-							GROUP BY cohort_id, cohort.weekly_tutorial_day, cohort.weekly_tutorial_time`
+	if sourceId == target.Id {
+		http.Error(w, "Already enrolled in the cohort", http.StatusBadRequest)
+		return
+	}
 
-	if err := db.QueryRow(sqlquery, res.Id).Scan(&res.LearnerCount); err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+	// Learners of a finished cohort are done with the module, transferring would hand them a fresh schedule
+	if sourceStatus > 2 {
+		http.Error(w, "Cohort has already ended", http.StatusBadRequest)
 		return
 	}
 
-	dres, err := json.Marshal(res)
-	if err != nil {
+	var targetLearnerCount int
+	sqlquery = `SELECT COUNT(learner) FROM learner_cohort WHERE cohort = $1`
+	if err := db.QueryRow(sqlquery, target.Id).Scan(&targetLearnerCount); err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
 
-	w.Write(dres)
-}
-
-func startCohort(w http.ResponseWriter, r *http.Request) {
-	// First retrieve the cohort
-	query := r.URL.Query()
-	cohortId := query.Get("cohort")
-
-	if cohortId == "" {
-		http.Error(w, "Invalid query parameters", http.StatusBadRequest)
+	if targetLearnerCount >= cohortCapacity {
+		http.Error(w, "Cohort is full", http.StatusBadRequest)
 		return
 	}
 
-	var cohort cohortData
-	cohort.Id = cohortId
+	tx, err := db.Begin()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
 
-	cohortQuery := `SELECT module, status, start_date, weekly_tutorial_day, weekly_tutorial_time FROM cohort WHERE cohort_id=$1`
+	defer tx.Rollback()
 
-	if err := db.QueryRow(cohortQuery, cohort.Id).Scan(&cohort.Module, &cohort.Status, &cohort.StartDate, &cohort.WeeklyTutorialDay, &cohort.WeeklyTutorialTime); err != nil {
+	sqlquery = `DELETE FROM learner_cohort WHERE learner = $1 AND cohort = $2`
+	if _, err := tx.Exec(sqlquery, lemail, sourceId); err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
 
-	// Calculating absolute lecture dates
-	var lectureDates []lectureDate
-	lectureQuery := `SELECT lecture_id, date_offset FROM lecture WHERE module=$1`
-	result, err := db.Query(lectureQuery, cohort.Module)
-	if err != nil {
+	sqlquery = `INSERT INTO learner_cohort(learner, cohort) VALUES ($1, $2)`
+	if _, err := tx.Exec(sqlquery, lemail, target.Id); err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
 
-	defer result.Close()
-
-	for result.Next() {
-		var lDate lectureDate
-		if err := result.Scan(&lDate.Id, &lDate.RelativeDate); err != nil {
+	// A full cohort that isn't running yet opens up again for enrollment
+	if sourceStatus == 1 {
+		sqlquery = `UPDATE cohort SET status=0 WHERE cohort_id=$1`
+		if _, err := tx.Exec(sqlquery, sourceId); err != nil {
 			http.Error(w, err.Error(), http.StatusInternalServerError)
 			return
 		}
-
-		// Calculate the absolute date
-		lDate.AbsoluteDate = cohort.StartDate.AddDate(0, 0, lDate.RelativeDate)
-
-		lectureDates = append(lectureDates, lDate)
 	}
 
-	// Calculating absolute tutorial dates
-	var tutorialDates []tutorialDate
-
-	// Weekly Tutorial Day is relative to Monday, being 0 and 6 on Sunday
-	firstTutorialDate := cohort.StartDate.AddDate(0, 0, cohort.WeeklyTutorialDay)
-	firstTutorialDateTime := firstTutorialDate.Add(time.Minute * time.Duration(cohort.WeeklyTutorialTime))
+	if target.Status == 0 && targetLearnerCount+1 >= cohortCapacity {
+		sqlquery = `UPDATE cohort SET status=1 WHERE cohort_id=$1`
+		if _, err := tx.Exec(sqlquery, target.Id); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+	}
 
-	tutorialQuery := `SELECT tutorial_id, week FROM tutorial WHERE module=$1`
-	result, err = db.Query(tutorialQuery, cohort.Module)
-	if err != nil {
+	// Drop the upcoming tutorials of the old cohort, past ones stay as the learner's history
+	sqlquery = `DELETE FROM learner_tutorial USING tutorial
+							WHERE learner_tutorial.tutorial = tutorial.tutorial_id AND tutorial.module = $1
+							AND learner_tutorial.learner = $2 AND learner_tutorial.scheduled_datetime > NOW()`
+	if _, err := tx.Exec(sqlquery, target.Module, lemail); err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
 
-	defer result.Close()
-
-	for result.Next() {
-		var tDate tutorialDate
-		if err := result.Scan(&tDate.Id, &tDate.Week); err != nil {
+	if target.Status == 2 {
+		// The target is already running, so re-materialize the schedule against it
+		lectureDates, err := calculateLectureDates(target)
+		if err != nil {
 			http.Error(w, err.Error(), http.StatusInternalServerError)
 			return
 		}
 
-		// Calculate the absolute date
-		tDate.AbsoluteDateTime = firstTutorialDateTime.AddDate(0, 0, tDate.Week*7)
-		tutorialDates = append(tutorialDates, tDate)
+		tutorialDates, err := calculateTutorialDates(target)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		var tutorials []tutorialDate
+		for _, tutorial := range tutorialDates {
+			if tutorial.AbsoluteDateTime.After(time.Now()) {
+				tutorials = append(tutorials, tutorial)
+			}
+		}
+
+		// The target may run on another version of the module
+		if err := remapLearnerContent(tx, target.Module, target.ContentVersion, []string{lemail}); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		if err := enrollLearnerSchedule(tx, lemail, lectureDates, tutorials); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+	} else {
+		// The schedule gets materialized when the target cohort starts
+		sqlquery = `DELETE FROM learner_lecture USING lecture
+								WHERE learner_lecture.lecture = lecture.lecture_id AND lecture.module = $1
+								AND learner_lecture.learner = $2 AND learner_lecture.completed = false`
+		if _, err := tx.Exec(sqlquery, target.Module, lemail); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
 	}
 
-	// Get the learners in the cohort
-	learnerQuery := `SELECT learner FROM learner_cohort WHERE cohort=$1`
-	enrollLectureQuery := `INSERT INTO learner_lecture(learner, lecture, scheduled_date) VALUES ($1, $2, $3)`
-	enrollTutorialQuery := `INSERT INTO learner_tutorial(learner, tutorial, scheduled_datetime) VALUES ($1, $2, $3)`
+	if err := tx.Commit(); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+}
+
+type getModuleCohortRes struct {
+	Id                 string    `json:"id"`
+	Module             string    `json:"module"`
+	Status             int       `json:"status"`
+	StartDate          time.Time `json:"start_date"`
+	WeeklyTutorialDay  int       `json:"tutorial_day"`
+	WeeklyTutorialTime int       `json:"tutorial_time"`
+	Timezone           string    `json:"timezone"`
+	LearnerCount       int       `json:"learner_count"`
+}
+
+func getModuleCohort(w http.ResponseWriter, r *http.Request) {
+	// First retrieve the cohort
+	lemail := r.Header.Get("X-User-Claim")
+
+	// Check if they're even enrolled in any cohort should only be one cohort
+	sqlquery := `SELECT cohort_id, module, status, start_date, weekly_tutorial_day, weekly_tutorial_time, timezone FROM learner_cohort INNER JOIN cohort ON learner_cohort.cohort = cohort.cohort_id WHERE learner_cohort.learner = $1`
+
+	var res getModuleCohortRes
+
+	if err := db.QueryRow(sqlquery, lemail).Scan(&res.Id, &res.Module, &res.Status, &res.StartDate, &res.WeeklyTutorialDay, &res.WeeklyTutorialTime, &res.Timezone); err != nil {
+		if err == sql.ErrNoRows {
+			w.WriteHeader(http.StatusNoContent)
+			return
+		} else {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+	}
+
+	// Get the count
+	sqlquery = `SELECT COUNT(learner_cohort.learner) learner_count
+							FROM cohort LEFT JOIN learner_cohort ON learner_cohort.cohort = cohort.cohort_id
+							WHERE cohort_id = $1
+							GROUP BY cohort_id, cohort.weekly_tutorial_day, cohort.weekly_tutorial_time`
+
+	if err := db.QueryRow(sqlquery, res.Id).Scan(&res.LearnerCount); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	dres, err := json.Marshal(res)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Write(dres)
+}
+
+func startCohort(w http.ResponseWriter, r *http.Request) {
+	// First retrieve the cohort
+	query := r.URL.Query()
+	cohortId := query.Get("cohort")
+
+	if cohortId == "" {
+		http.Error(w, "Invalid query parameters", http.StatusBadRequest)
+		return
+	}
 
-	// Preparing the statements
-	enrollLectureStmt, err := db.Prepare(enrollLectureQuery)
+	cohort, err := getCohort(cohortId)
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
-	defer enrollLectureStmt.Close()
 
-	enrollTutorialStmt, err := db.Prepare(enrollTutorialQuery)
+	// Cohorts that are already running, done or cancelled can't be started again
+	if cohort.Status > 1 {
+		http.Error(w, "Cohort can't be started", http.StatusConflict)
+		return
+	}
+
+	if cohort.ContentVersion == 0 {
+		http.Error(w, "Module has no published content yet", http.StatusConflict)
+		return
+	}
+
+	// Calculating absolute lecture and tutorial dates
+	lectureDates, err := calculateLectureDates(cohort)
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
-	defer enrollTutorialStmt.Close()
 
-	result, err = db.Query(learnerQuery, cohort.Id)
+	tutorialDates, err := calculateTutorialDates(cohort)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	// Get the learners in the cohort
+	var learnerIds []string
+	learnerQuery := `SELECT learner FROM learner_cohort WHERE cohort=$1`
+	result, err := db.Query(learnerQuery, cohort.Id)
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
@@ -641,22 +1216,415 @@ func startCohort(w http.ResponseWriter, r *http.Request) {
 			return
 		}
 
-		// Enrolling them into the lecture
-		for _, lecture := range lectureDates {
-			if _, err := enrollLectureStmt.Exec(learnerId, lecture.Id, lecture.AbsoluteDate); err != nil {
-				http.Error(w, err.Error(), http.StatusInternalServerError)
-				return
-			}
+		learnerIds = append(learnerIds, learnerId)
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	defer tx.Rollback()
+
+	// Learners transferred in from a cohort on another version keep their progress
+	if err := remapLearnerContent(tx, cohort.Module, cohort.ContentVersion, learnerIds); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	for _, learnerId := range learnerIds {
+		if err := enrollLearnerSchedule(tx, learnerId, lectureDates, tutorialDates); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
 		}
+	}
 
-		// Enrolling them into the tutorials
-		for _, tutorial := range tutorialDates {
-			if _, err := enrollTutorialStmt.Exec(learnerId, tutorial.Id, tutorial.AbsoluteDateTime); err != nil {
-				http.Error(w, err.Error(), http.StatusInternalServerError)
-				return
+	// Mark the cohort as ongoing, so late joiners can still come in
+	// The cohort stays on the content version it started with until an admin upgrades it
+	sqlquery := `UPDATE cohort SET status=2, content_version=$2 WHERE cohort_id=$1`
+	if _, err := tx.Exec(sqlquery, cohort.Id, cohort.ContentVersion); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	if err := tx.Commit(); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+}
+
+// Number of missed lectures a late joiner catches up on per day
+const catchUpPerDay = 2
+
+// Joins a cohort that has already started, materializing the learner's schedule
+// mode "catchup" compresses the missed lectures from today onwards, mode "today" skips them
+func joinCohortLate(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	cohortId := query.Get("cohort")
+	mode := query.Get("mode")
+	lemail := r.Header.Get("X-User-Claim")
+	timezone := r.Header.Get("X-Timezone-Claim")
+
+	if cohortId == "" || (mode != "catchup" && mode != "today") {
+		http.Error(w, "Invalid query parameters", http.StatusBadRequest)
+		return
+	}
+
+	location, err := time.LoadLocation(timezone)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	cohort, err := getCohort(cohortId)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if cohort.Status != 2 {
+		http.Error(w, "Cohort is not ongoing", http.StatusBadRequest)
+		return
+	}
+
+	if selfPaced, err := isSelfPaced(lemail, cohort.Module); err != nil || selfPaced {
+		if err == nil {
+			http.Error(w, "Already enrolled in the module at your own pace", http.StatusBadRequest)
+		} else {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+		}
+		return
+	}
+
+	var dummy string
+	// Check if learner is already enrolled in a cohort for the module
+	sqlquery := `SELECT cohort FROM learner_cohort INNER JOIN cohort ON learner_cohort.cohort = cohort.cohort_id
+								WHERE learner_cohort.learner=$1 AND cohort.module=$2`
+	if err := db.QueryRow(sqlquery, lemail, cohort.Module).Scan(&dummy); err != sql.ErrNoRows {
+		if err == nil {
+			http.Error(w, "Already enrolled in a cohort for the module", http.StatusBadRequest)
+		} else {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+		}
+		return
+	}
+
+	var cohortLearnerCount int
+	sqlquery = `SELECT COUNT(learner) FROM learner_cohort WHERE cohort = $1`
+	if err := db.QueryRow(sqlquery, cohort.Id).Scan(&cohortLearnerCount); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	if cohortLearnerCount >= cohortCapacity {
+		http.Error(w, "Cohort is full", http.StatusBadRequest)
+		return
+	}
+
+	lectureDates, err := calculateLectureDates(cohort)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	tutorialDates, err := calculateTutorialDates(cohort)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	// Lecture dates are plain dates, so compare against the learner's local date
+	now := time.Now().UTC().In(location)
+	today := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, time.UTC)
+
+	var lectures []lectureDate
+	missed := 0
+	for _, lecture := range lectureDates {
+		if lecture.AbsoluteDate.Before(today) {
+			if mode == "today" {
+				continue
 			}
+
+			lecture.AbsoluteDate = today.AddDate(0, 0, missed/catchUpPerDay)
+			missed++
 		}
+
+		lectures = append(lectures, lecture)
+	}
+
+	// Tutorials that already happened can't be caught up on
+	var tutorials []tutorialDate
+	for _, tutorial := range tutorialDates {
+		if tutorial.AbsoluteDateTime.After(now) {
+			tutorials = append(tutorials, tutorial)
+		}
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
 	}
+
+	defer tx.Rollback()
+
+	sqlquery = `INSERT INTO learner_cohort(learner, cohort) VALUES ($1, $2)`
+	if _, err := tx.Exec(sqlquery, lemail, cohort.Id); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	if err := enrollLearnerSchedule(tx, lemail, lectures, tutorials); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	if err := removeFromWaitlist(tx, lemail, cohort.Module); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	if err := tx.Commit(); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+}
+
+// Moves the remaining schedule of a cohort by a number of days, e.g. for a public holiday
+// Everything scheduled on or after the from date (defaults to today) is shifted, completed lectures stay put
+func rescheduleCohort(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	cohortId := query.Get("cohort")
+
+	days, err := strconv.Atoi(query.Get("days"))
+	if cohortId == "" || err != nil || days == 0 {
+		http.Error(w, "Invalid query parameters", http.StatusBadRequest)
+		return
+	}
+
+	fromDate := time.Now().UTC()
+	if from := query.Get("from"); from != "" {
+		fromDate, err = time.Parse("2006-01-02", from)
+		if err != nil {
+			http.Error(w, "Invalid from date", http.StatusBadRequest)
+			return
+		}
+	}
+
+	cohort, err := getCohort(cohortId)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if cohort.Status != 2 {
+		http.Error(w, "Cohort is not ongoing", http.StatusBadRequest)
+		return
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	defer tx.Rollback()
+
+	// Record the shift so that late joiners get the same schedule
+	sqlquery := `INSERT INTO cohort_shift(cohort, from_date, days) VALUES ($1, $2, $3)`
+	if _, err := tx.Exec(sqlquery, cohort.Id, fromDate.Format("2006-01-02"), days); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	sqlquery = `UPDATE learner_lecture SET scheduled_date = scheduled_date + $1::int, sequence = sequence + 1
+							FROM learner_cohort, lecture
+							WHERE learner_cohort.cohort = $2 AND learner_lecture.learner = learner_cohort.learner
+							AND learner_lecture.lecture = lecture.lecture_id AND lecture.module = $3
+							AND learner_lecture.completed = false AND learner_lecture.scheduled_date >= $4`
+	if _, err := tx.Exec(sqlquery, days, cohort.Id, cohort.Module, fromDate.Format("2006-01-02")); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	// Tutorials are shifted in the cohort's timezone so the local time of day is kept over DST changes
+	sqlquery = `UPDATE learner_tutorial
+							SET scheduled_datetime = ((scheduled_datetime AT TIME ZONE $5) + make_interval(days => $1)) AT TIME ZONE $5,
+							sequence = sequence + 1
+							FROM learner_cohort, tutorial
+							WHERE learner_cohort.cohort = $2 AND learner_tutorial.learner = learner_cohort.learner
+							AND learner_tutorial.tutorial = tutorial.tutorial_id AND tutorial.module = $3
+							AND (learner_tutorial.scheduled_datetime AT TIME ZONE $5)::date >= $4`
+	if _, err := tx.Exec(sqlquery, days, cohort.Id, cohort.Module, fromDate.Format("2006-01-02"), cohort.Timezone); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	if err := tx.Commit(); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+}
+
+type cohortShift struct {
+	FromDate time.Time
+	Days     int
+}
+
+func getCohort(cohortId string) (cohortData, error) {
+	var cohort cohortData
+	cohort.Id = cohortId
+
+	// Cohorts that haven't started yet follow the published version of the module
+	sqlquery := `SELECT cohort.module, status, start_date, weekly_tutorial_day, weekly_tutorial_time, timezone, COALESCE(content_version, published_version, 0)
+							FROM cohort INNER JOIN module ON module.module_id = cohort.module WHERE cohort_id=$1`
+	err := db.QueryRow(sqlquery, cohort.Id).Scan(&cohort.Module, &cohort.Status, &cohort.StartDate, &cohort.WeeklyTutorialDay, &cohort.WeeklyTutorialTime, &cohort.Timezone, &cohort.ContentVersion)
+
+	return cohort, err
+}
+
+func getCohortShifts(cohortId string) ([]cohortShift, error) {
+	var shifts []cohortShift
+
+	sqlquery := `SELECT from_date, days FROM cohort_shift WHERE cohort = $1 ORDER BY created_at`
+	result, err := db.Query(sqlquery, cohortId)
+	if err != nil {
+		return nil, err
+	}
+
+	defer result.Close()
+
+	for result.Next() {
+		var shift cohortShift
+		if err := result.Scan(&shift.FromDate, &shift.Days); err != nil {
+			return nil, err
+		}
+
+		shifts = append(shifts, shift)
+	}
+
+	return shifts, result.Err()
+}
+
+// Applies the recorded reschedules of a cohort to an absolute time
+func applyCohortShifts(t time.Time, shifts []cohortShift) time.Time {
+	for _, shift := range shifts {
+		date := time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, time.UTC)
+		if !date.Before(shift.FromDate) {
+			t = t.AddDate(0, 0, shift.Days)
+		}
+	}
+
+	return t
+}
+
+// Calculates the absolute lecture dates of a cohort, ordered by date
+func calculateLectureDates(cohort cohortData) ([]lectureDate, error) {
+	var lectureDates []lectureDate
+
+	shifts, err := getCohortShifts(cohort.Id)
+	if err != nil {
+		return nil, err
+	}
+
+	lectureQuery := `SELECT lecture_id, date_offset FROM lecture WHERE module=$1 AND version=$2 ORDER BY date_offset`
+	result, err := db.Query(lectureQuery, cohort.Module, cohort.ContentVersion)
+	if err != nil {
+		return nil, err
+	}
+
+	defer result.Close()
+
+	for result.Next() {
+		var lDate lectureDate
+		if err := result.Scan(&lDate.Id, &lDate.RelativeDate); err != nil {
+			return nil, err
+		}
+
+		// Calculate the absolute date
+		lDate.AbsoluteDate = applyCohortShifts(cohort.StartDate.AddDate(0, 0, lDate.RelativeDate), shifts)
+
+		lectureDates = append(lectureDates, lDate)
+	}
+
+	return lectureDates, result.Err()
+}
+
+// Calculates the absolute tutorial times of a cohort, ordered by week
+func calculateTutorialDates(cohort cohortData) ([]tutorialDate, error) {
+	var tutorialDates []tutorialDate
+
+	shifts, err := getCohortShifts(cohort.Id)
+	if err != nil {
+		return nil, err
+	}
+
+	location, err := time.LoadLocation(cohort.Timezone)
+	if err != nil {
+		return nil, err
+	}
+
+	tutorialQuery := `SELECT tutorial_id, week FROM tutorial WHERE module=$1 AND version=$2 ORDER BY week`
+	result, err := db.Query(tutorialQuery, cohort.Module, cohort.ContentVersion)
+	if err != nil {
+		return nil, err
+	}
+
+	defer result.Close()
+
+	for result.Next() {
+		var tDate tutorialDate
+		if err := result.Scan(&tDate.Id, &tDate.Week); err != nil {
+			return nil, err
+		}
+
+		// Shift the tutorial's own date first, since a shift can start between Monday and the tutorial day
+		// and the time of day then stays put in the cohort's timezone
+		tutorialDay := applyCohortShifts(cohort.StartDate.AddDate(0, 0, tDate.Week*7+cohort.WeeklyTutorialDay), shifts)
+		tDate.AbsoluteDateTime = tutorialDateTime(tutorialDay, 0, cohort.WeeklyTutorialTime, location)
+		tutorialDates = append(tutorialDates, tDate)
+	}
+
+	return tutorialDates, result.Err()
+}
+
+// Calculates the tutorial time in the week starting on weekStart
+// The day is relative to Monday and the time is in minutes from midnight, both in the cohort's timezone
+// Building the time from its local fields keeps it correct across DST changes
+func tutorialDateTime(weekStart time.Time, day int, minutes int, location *time.Location) time.Time {
+	return time.Date(weekStart.Year(), weekStart.Month(), weekStart.Day()+day, minutes/60, minutes%60, 0, 0, location)
+}
+
+// Materializes the learner_lecture and learner_tutorial rows of a learner
+// Existing rows are rescheduled, except for completed lectures and tutorials that already happened
+func enrollLearnerSchedule(tx *sql.Tx, learnerId string, lectureDates []lectureDate, tutorialDates []tutorialDate) error {
+	enrollLectureQuery := `INSERT INTO learner_lecture(learner, lecture, scheduled_date) VALUES ($1, $2, $3)
+													ON CONFLICT (learner, lecture) DO UPDATE SET scheduled_date = EXCLUDED.scheduled_date, sequence = learner_lecture.sequence + 1
+													WHERE learner_lecture.completed = false`
+	enrollTutorialQuery := `INSERT INTO learner_tutorial(learner, tutorial, scheduled_datetime) VALUES ($1, $2, $3)
+													ON CONFLICT (learner, tutorial) DO UPDATE SET scheduled_datetime = EXCLUDED.scheduled_datetime, sequence = learner_tutorial.sequence + 1
+													WHERE learner_tutorial.scheduled_datetime > NOW()`
+
+	// Enrolling them into the lecture
+	for _, lecture := range lectureDates {
+		if _, err := tx.Exec(enrollLectureQuery, learnerId, lecture.Id, lecture.AbsoluteDate); err != nil {
+			return err
+		}
+	}
+
+	// Enrolling them into the tutorials
+	for _, tutorial := range tutorialDates {
+		if _, err := tx.Exec(enrollTutorialQuery, learnerId, tutorial.Id, tutorial.AbsoluteDateTime); err != nil {
+			return err
+		}
+	}
+
+	return nil
 }
 
 /*************** LECTURE HANDLERS ****************************/
@@ -668,50 +1636,224 @@ type lectureResponse struct {
 	ScheduledDate string `json:"scheduled_date"`
 	Module        string `json:"module"`
 	Completed     bool   `json:"completed"`
+	Locked        bool   `json:"locked"`
+	LockedReason  string `json:"locked_reason,omitempty"`
 }
 
-func enrollModule(w http.ResponseWriter, r *http.Request) {
+// Start date defaults to the learner's local today, and pace days to a lecture every day
+type selfPacedRequest struct {
+	StartDate string `json:"start_date"`
+	PaceDays  int    `json:"pace_days"`
+}
+
+// Enrolls the learner into a module without a cohort, lectures follow their own start date and pace
+// The lectures are scheduled in order of their date offset, one every pace days, and there are no tutorials
+func enrollSelfPaced(w http.ResponseWriter, r *http.Request) {
+	lemail := r.Header.Get("X-User-Claim")
+	timezone := r.Header.Get("X-Timezone-Claim")
+
+	query := r.URL.Query()
+	moduleId := query.Get("module")
+
+	if moduleId == "" {
+		http.Error(w, "Invalid query parameters", http.StatusBadRequest)
+		return
+	}
+
+	startDate, paceDays, err := parseSelfPacedRequest(r, timezone)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	var dummy string
+	var version sql.NullInt32
+	sqlquery := `SELECT module_id, published_version FROM module WHERE module_id = $1`
+	if err := db.QueryRow(sqlquery, moduleId).Scan(&dummy, &version); err != nil || !version.Valid {
+		if err == sql.ErrNoRows || err == nil {
+			http.Error(w, "Invalid module id", http.StatusBadRequest)
+		} else {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+		}
+		return
+	}
+
+	// Check if learner is already enrolled in a cohort for the module
+	sqlquery = `SELECT cohort FROM learner_cohort INNER JOIN cohort ON learner_cohort.cohort = cohort.cohort_id
+								WHERE learner_cohort.learner=$1 AND cohort.module=$2`
+	if err := db.QueryRow(sqlquery, lemail, moduleId).Scan(&dummy); err != sql.ErrNoRows {
+		if err == nil {
+			http.Error(w, "Already enrolled in a cohort for the module", http.StatusBadRequest)
+		} else {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+		}
+		return
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	defer tx.Rollback()
+
+	sqlquery = `INSERT INTO self_paced_enrollment(learner, module, start_date, pace_days, content_version) VALUES ($1, $2, $3, $4, $5)
+							ON CONFLICT DO NOTHING`
+	result, err := tx.Exec(sqlquery, lemail, moduleId, startDate.Format("2006-01-02"), paceDays, version.Int32)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	if affected, err := result.RowsAffected(); err != nil || affected == 0 {
+		http.Error(w, "Already enrolled in the module", http.StatusBadRequest)
+		return
+	}
+
+	if err := scheduleSelfPaced(tx, lemail, moduleId, startDate, paceDays); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	if err := removeFromWaitlist(tx, lemail, moduleId); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	if err := tx.Commit(); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+}
+
+// Changes the pace of a self paced module, the remaining lectures are rescheduled from the given start date
+// The start date is stored as well, so it always matches the schedule the learner is on
+func updateSelfPaced(w http.ResponseWriter, r *http.Request) {
+	lemail := r.Header.Get("X-User-Claim")
+	timezone := r.Header.Get("X-Timezone-Claim")
+
+	query := r.URL.Query()
+	moduleId := query.Get("module")
+
+	if moduleId == "" {
+		http.Error(w, "Invalid query parameters", http.StatusBadRequest)
+		return
+	}
+
+	startDate, paceDays, err := parseSelfPacedRequest(r, timezone)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	defer tx.Rollback()
+
+	sqlquery := `UPDATE self_paced_enrollment SET start_date = $1, pace_days = $2 WHERE learner = $3 AND module = $4`
+	result, err := tx.Exec(sqlquery, startDate.Format("2006-01-02"), paceDays, lemail, moduleId)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	if affected, err := result.RowsAffected(); err != nil || affected == 0 {
+		http.Error(w, "Not enrolled in the module at your own pace", http.StatusBadRequest)
+		return
+	}
+
+	if err := scheduleSelfPaced(tx, lemail, moduleId, startDate, paceDays); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	if err := tx.Commit(); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusAccepted)
+}
+
+func parseSelfPacedRequest(r *http.Request, timezone string) (time.Time, int, error) {
+	req := selfPacedRequest{PaceDays: 1}
+
+	// An empty body keeps the defaults
+	decoder := json.NewDecoder(r.Body)
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(&req); err != nil && err != io.EOF {
+		return time.Time{}, 0, err
+	}
+
+	if req.PaceDays < 1 {
+		return time.Time{}, 0, fmt.Errorf("Pace has to be at least a day")
+	}
 
-	// Get lecture id from query params
-	query := r.URL.Query()
-	module := query.Get("module")
-	lemail := query.Get("email")
+	if req.StartDate != "" {
+		startDate, err := time.Parse("2006-01-02", req.StartDate)
+		return startDate, req.PaceDays, err
+	}
+
+	location, err := time.LoadLocation(timezone)
+	if err != nil {
+		return time.Time{}, 0, err
+	}
+
+	local := time.Now().UTC().In(location)
+	return time.Date(local.Year(), local.Month(), local.Day(), 0, 0, 0, 0, time.UTC), req.PaceDays, nil
+}
 
-	// Get all of the lectures
-	sql := `SELECT lecture_id, title, description, video_link, scheduled_date, module from lecture 
-					WHERE module = $1`
+// Schedules the incomplete lectures of a module one every paceDays from startDate, in date offset order
+// Only the content version the learner enrolled on is scheduled
+func scheduleSelfPaced(tx *sql.Tx, learnerId string, moduleId string, startDate time.Time, paceDays int) error {
+	var lectureDates []lectureDate
 
-	result, err := db.Query(sql, module)
+	sqlquery := `SELECT lecture_id, date_offset FROM lecture
+							INNER JOIN self_paced_enrollment ON self_paced_enrollment.module = lecture.module AND self_paced_enrollment.learner = $1
+							LEFT JOIN learner_lecture ON learner_lecture.lecture = lecture.lecture_id AND learner_lecture.learner = $1
+							WHERE lecture.module = $2 AND lecture.version = self_paced_enrollment.content_version AND learner_lecture.completed IS NOT TRUE
+							ORDER BY date_offset`
+	result, err := tx.Query(sqlquery, learnerId, moduleId)
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
-		return
+		return err
 	}
 
 	defer result.Close()
 
 	for result.Next() {
-		var lecture lectureResponse
-		if err := result.Scan(&lecture.Id, &lecture.Title, &lecture.Description, &lecture.VideoLink, &lecture.ScheduledDate, &lecture.Module); err != nil {
-			http.Error(w, err.Error(), http.StatusInternalServerError)
-			return
+		var lDate lectureDate
+		if err := result.Scan(&lDate.Id, &lDate.RelativeDate); err != nil {
+			return err
 		}
 
-		// Create the learner_lecture
-		sql = `INSERT INTO learner_lecture(learner, lecture, completed) VALUES ($1, $2, $3)`
-		stmt, err := db.Prepare(sql)
-		if err != nil {
-			http.Error(w, err.Error(), http.StatusInternalServerError)
-			return
-		}
+		lDate.AbsoluteDate = startDate.AddDate(0, 0, len(lectureDates)*paceDays)
+		lectureDates = append(lectureDates, lDate)
+	}
 
-		_, err = stmt.Exec(lemail, lecture.Id, false)
-		if err != nil {
-			http.Error(w, err.Error(), http.StatusInternalServerError)
-			return
-		}
+	if err := result.Err(); err != nil {
+		return err
 	}
 
-	w.WriteHeader(http.StatusOK)
+	return enrollLearnerSchedule(tx, learnerId, lectureDates, nil)
+}
+
+// Returns whether the learner takes the module at their own pace
+func isSelfPaced(learnerId string, moduleId string) (bool, error) {
+	var dummy string
+	sqlquery := `SELECT module FROM self_paced_enrollment WHERE learner = $1 AND module = $2`
+	err := db.QueryRow(sqlquery, learnerId, moduleId).Scan(&dummy)
+	if err == sql.ErrNoRows {
+		return false, nil
+	}
+
+	return err == nil, err
 }
 
 func getLectureToday(w http.ResponseWriter, r *http.Request) {
@@ -749,6 +1891,108 @@ func getLectureToday(w http.ResponseWriter, r *http.Request) {
 		}
 	}
 
+	if err := applyLectureLocks(lemail, []*lectureResponse{&res}); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	dres, err := json.Marshal(res)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Write(dres)
+}
+
+// Days late is how many days ago the lecture was scheduled, 0 for today's lecture
+type lectureQueueEntry struct {
+	lectureResponse
+	DaysLate int `json:"days_late"`
+}
+
+// Overdue lectures returned by the queue, unless the catchup query parameter asks for another amount
+const defaultCatchUpLimit = 5
+const maxCatchUpLimit = 20
+
+// Returns today's lectures preceded by the oldest overdue incomplete lectures, optionally for a single module
+func getLectureQueue(w http.ResponseWriter, r *http.Request) {
+	lemail := r.Header.Get("X-User-Claim")
+	timezone := r.Header.Get("X-Timezone-Claim")
+
+	query := r.URL.Query()
+	moduleId := query.Get("module")
+
+	catchUp := defaultCatchUpLimit
+	if c := query.Get("catchup"); c != "" {
+		var err error
+		catchUp, err = strconv.Atoi(c)
+		if err != nil || catchUp < 0 || catchUp > maxCatchUpLimit {
+			http.Error(w, "Invalid catchup limit", http.StatusBadRequest)
+			return
+		}
+	}
+
+	location, err := time.LoadLocation(timezone)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	local := time.Now().UTC().In(location)
+	today := time.Date(local.Year(), local.Month(), local.Day(), 0, 0, 0, 0, time.UTC)
+
+	sqlquery := `SELECT lecture_id, title, description, video_link, scheduled_date, completed, module from lecture
+	INNER JOIN learner_lecture ON learner_lecture.lecture=lecture.lecture_id AND learner_lecture.learner=$1
+	WHERE scheduled_date <= $2 AND completed = false AND ($3 = '' OR module = $3)
+	ORDER BY scheduled_date, date_offset`
+
+	result, err := db.Query(sqlquery, lemail, today.Format("2006-01-02"), moduleId)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	defer result.Close()
+
+	var overdue []lectureQueueEntry
+	var due []lectureQueueEntry
+
+	for result.Next() {
+		var entry lectureQueueEntry
+		var scheduled time.Time
+		if err := result.Scan(&entry.Id, &entry.Title, &entry.Description, &entry.VideoLink, &scheduled, &entry.Completed, &entry.Module); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		entry.ScheduledDate = scheduled.Format(time.RFC3339)
+		entry.DaysLate = int(today.Sub(scheduled).Hours() / 24)
+
+		if entry.DaysLate == 0 {
+			due = append(due, entry)
+		} else if len(overdue) < catchUp {
+			overdue = append(overdue, entry)
+		}
+	}
+
+	res := append(overdue, due...)
+
+	if len(res) == 0 {
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+
+	var lectures []*lectureResponse
+	for i := range res {
+		lectures = append(lectures, &res[i].lectureResponse)
+	}
+
+	if err := applyLectureLocks(lemail, lectures); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
 	dres, err := json.Marshal(res)
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
@@ -816,6 +2060,16 @@ func getLecturesPast(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	var lectures []*lectureResponse
+	for i := range res {
+		lectures = append(lectures, &res[i])
+	}
+
+	if err := applyLectureLocks(lemail, lectures); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
 	// Marshal to JSON and return
 	dres, err := json.Marshal(res)
 	if err != nil {
@@ -826,6 +2080,12 @@ func getLecturesPast(w http.ResponseWriter, r *http.Request) {
 	w.Write(dres)
 }
 
+type completeLectureRes struct {
+	AddedCards int64 `json:"added_cards"`
+}
+
+// Completes a lecture and adds its flashcards to the learner's deck
+// Completing a lecture twice is harmless, the response counts only the newly added cards
 func completeLecture(w http.ResponseWriter, r *http.Request) {
 	lemail := r.Header.Get("X-User-Claim")
 
@@ -838,57 +2098,153 @@ func completeLecture(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	// Get all the flashcards associated to this lecture
-	var flashcardIds []string
-	sql := `SELECT flashcard_id FROM flashcard WHERE lecture = $1`
-	result, err := db.Query(sql, lectureId)
+	tx, err := db.Begin()
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
 
-	defer result.Close()
+	defer tx.Rollback()
 
-	for result.Next() {
-		var flashcardId string
-		if err := result.Scan(&flashcardId); err != nil {
+	// Only lectures the learner is enrolled in can be completed, lock the row against concurrent completions
+	var completed bool
+	sqlquery := `SELECT completed FROM learner_lecture WHERE learner = $1 AND lecture = $2 FOR UPDATE`
+	if err := tx.QueryRow(sqlquery, lemail, lectureId).Scan(&completed); err != nil {
+		if err == sql.ErrNoRows {
+			http.Error(w, "Not enrolled in the lecture", http.StatusForbidden)
+		} else {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+		}
+		return
+	}
+
+	if !completed {
+		// Locked lectures can't be completed yet
+		locks, err := getLectureLocks(lemail, []string{lectureId})
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		if reason, locked := locks[lectureId]; locked {
+			http.Error(w, reason, http.StatusForbidden)
+			return
+		}
+
+		// Lectures can require a share of the video to be watched
+		reason, err := checkWatchRequirement(tx, lemail, lectureId)
+		if err != nil {
 			http.Error(w, err.Error(), http.StatusInternalServerError)
 			return
 		}
 
-		flashcardIds = append(flashcardIds, flashcardId)
+		if reason != "" {
+			http.Error(w, reason, http.StatusForbidden)
+			return
+		}
 	}
 
-	// Create the new learner_flashcard entries
-	sql = `INSERT INTO learner_flashcard(learner, flashcard) VALUES ($1, $2)`
-	stmt, err := db.Prepare(sql)
+	// Add the lecture's flashcards, cards the learner already has keep their progress
+	sqlquery = `INSERT INTO learner_flashcard(learner, flashcard)
+							SELECT $1, flashcard_id FROM flashcard WHERE lecture = $2
+							ON CONFLICT (learner, flashcard) DO NOTHING`
+	result, err := tx.Exec(sqlquery, lemail, lectureId)
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
 
-	for _, flashcardId := range flashcardIds {
-		_, err = stmt.Exec(lemail, flashcardId)
-		if err != nil {
-			http.Error(w, err.Error(), http.StatusInternalServerError)
-			return
-		}
-
+	var res completeLectureRes
+	res.AddedCards, err = result.RowsAffected()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
 	}
 
 	// Update the learner_lecture data
-	sql = `UPDATE learner_lecture SET completed = true WHERE learner_lecture.learner = $1 AND learner_lecture.lecture = $2`
-	stmt, err = db.Prepare(sql)
+	sqlquery = `UPDATE learner_lecture SET completed = true WHERE learner_lecture.learner = $1 AND learner_lecture.lecture = $2`
+	if _, err := tx.Exec(sqlquery, lemail, lectureId); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	if err := tx.Commit(); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	dres, err := json.Marshal(res)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Write(dres)
+}
+
+type uncompleteLectureRes struct {
+	RemovedCards int64 `json:"removed_cards"`
+}
+
+// Reverts a learner's lecture completion, the lecture's flashcards leave their deck again
+func uncompleteLecture(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	lectureId := query.Get("id")
+	learnerId := query.Get("learner")
+
+	if lectureId == "" || learnerId == "" {
+		http.Error(w, "Invalid query parameters", http.StatusBadRequest)
+		return
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	defer tx.Rollback()
+
+	sqlquery := `UPDATE learner_lecture SET completed = false WHERE learner = $1 AND lecture = $2`
+	result, err := tx.Exec(sqlquery, learnerId, lectureId)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	if affected, err := result.RowsAffected(); err != nil || affected == 0 {
+		http.Error(w, "Learner is not enrolled in the lecture", http.StatusBadRequest)
+		return
+	}
+
+	sqlquery = `DELETE FROM learner_flashcard USING flashcard
+							WHERE learner_flashcard.flashcard = flashcard.flashcard_id
+							AND learner_flashcard.learner = $1 AND flashcard.lecture = $2`
+	result, err = tx.Exec(sqlquery, learnerId, lectureId)
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
 
-	_, err = stmt.Exec(lemail, lectureId)
+	var res uncompleteLectureRes
+	res.RemovedCards, err = result.RowsAffected()
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
+
+	if err := tx.Commit(); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	dres, err := json.Marshal(res)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Write(dres)
 }
 
 type flashcardResponse struct {
@@ -942,14 +2298,24 @@ func getLectureFlashcards(w http.ResponseWriter, r *http.Request) {
 
 /******************* TUTORIAL HANDLERS **********************/
 type tutorialResponse struct {
-	Id            string    `json:"id"`
-	Title         string    `json:"title"`
-	Description   string    `json:"description"`
-	ScheduledTime time.Time `json:"scheduled_time"`
-	Module        string    `json:"module"`
+	Id              string    `json:"id"`
+	Title           string    `json:"title"`
+	Description     string    `json:"description"`
+	ScheduledTime   time.Time `json:"scheduled_time"`
+	Module          string    `json:"module"`
+	MeetingProvider string    `json:"meeting_provider"`
+	Attendance      *int      `json:"attendance"`
+	RecordingURL    string    `json:"recording_url"`
 }
 
-func getUpcomingTutorials(w http.ResponseWriter, r *http.Request) {
+// Page size of the tutorial listing, unless the limit query parameter asks for less
+const maxTutorialPage = 100
+const defaultTutorialPage = 20
+
+// Lists the learner's tutorials of a module ordered by time
+// filter is upcoming (default), past or all, past tutorials are listed latest first
+// from and to bound the scheduled time, and the X-Next-Cursor header holds the cursor for the next page
+func getTutorials(w http.ResponseWriter, r *http.Request) {
 	var res []tutorialResponse
 
 	lemail := r.Header.Get("X-User-Claim")
@@ -961,10 +2327,92 @@ func getUpcomingTutorials(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	sqlquery := `SELECT tutorial_id, title, description, scheduled_datetime, module FROM tutorial
+	filter := query.Get("filter")
+	if filter == "" {
+		filter = "upcoming"
+	}
+
+	if filter != "upcoming" && filter != "past" && filter != "all" {
+		http.Error(w, "Invalid filter", http.StatusBadRequest)
+		return
+	}
+
+	limit := defaultTutorialPage
+	if l := query.Get("limit"); l != "" {
+		var err error
+		limit, err = strconv.Atoi(l)
+		if err != nil || limit <= 0 || limit > maxTutorialPage {
+			http.Error(w, "Invalid limit", http.StatusBadRequest)
+			return
+		}
+	}
+
+	// Recordings are attached to the tutorials of the learner's cohort
+	var cohortId sql.NullString
+	sqlquery := `SELECT cohort FROM learner_cohort INNER JOIN cohort ON learner_cohort.cohort = cohort.cohort_id
+								WHERE learner_cohort.learner = $1 AND cohort.module = $2`
+	if err := db.QueryRow(sqlquery, lemail, moduleId).Scan(&cohortId); err != nil && err != sql.ErrNoRows {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	args := []interface{}{lemail, moduleId, cohortId}
+	conditions := []string{"module = $2"}
+
+	switch filter {
+	case "upcoming":
+		conditions = append(conditions, "scheduled_datetime > NOW()")
+	case "past":
+		conditions = append(conditions, "scheduled_datetime <= NOW()")
+	}
+
+	for _, bound := range []struct {
+		param    string
+		operator string
+	}{{"from", ">="}, {"to", "<"}} {
+		value := query.Get(bound.param)
+		if value == "" {
+			continue
+		}
+
+		t, err := parseTimeParam(value)
+		if err != nil {
+			http.Error(w, "Invalid "+bound.param+" time", http.StatusBadRequest)
+			return
+		}
+
+		args = append(args, t)
+		conditions = append(conditions, fmt.Sprintf("scheduled_datetime %s $%d", bound.operator, len(args)))
+	}
+
+	// Past tutorials are read backwards from the latest one
+	order := "ASC"
+	comparison := ">"
+	if filter == "past" {
+		order = "DESC"
+		comparison = "<"
+	}
+
+	if cursor := query.Get("cursor"); cursor != "" {
+		cursorTime, cursorId, err := decodeTutorialCursor(cursor)
+		if err != nil {
+			http.Error(w, "Invalid cursor", http.StatusBadRequest)
+			return
+		}
+
+		args = append(args, cursorTime, cursorId)
+		conditions = append(conditions, fmt.Sprintf("(scheduled_datetime, tutorial_id) %s ($%d, $%d)", comparison, len(args)-1, len(args)))
+	}
+
+	// Fetch one extra to know if there is a next page
+	args = append(args, limit+1)
+
+	sqlquery = fmt.Sprintf(`SELECT tutorial_id, title, description, scheduled_datetime, module, meeting_provider, attendance, COALESCE(recording_url, '') FROM tutorial
 		INNER JOIN learner_tutorial ON learner_tutorial.tutorial=tutorial.tutorial_id AND learner_tutorial.learner=$1
-		WHERE scheduled_datetime > NOW() AND module = $2 LIMIT 5`
-	result, err := db.Query(sqlquery, lemail, moduleId)
+		LEFT JOIN cohort_tutorial ON cohort_tutorial.tutorial = tutorial.tutorial_id AND cohort_tutorial.cohort = $3
+		WHERE %s
+		ORDER BY scheduled_datetime %s, tutorial_id %s LIMIT $%d`, strings.Join(conditions, " AND "), order, order, len(args))
+	result, err := db.Query(sqlquery, args...)
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
@@ -974,16 +2422,25 @@ func getUpcomingTutorials(w http.ResponseWriter, r *http.Request) {
 
 	for result.Next() {
 		var tutorial tutorialResponse
-		if err := result.Scan(&tutorial.Id, &tutorial.Title, &tutorial.Description, &tutorial.ScheduledTime, &tutorial.Module); err != nil {
+		var attendance sql.NullInt32
+		if err := result.Scan(&tutorial.Id, &tutorial.Title, &tutorial.Description, &tutorial.ScheduledTime, &tutorial.Module, &tutorial.MeetingProvider, &attendance, &tutorial.RecordingURL); err != nil {
 			http.Error(w, err.Error(), http.StatusInternalServerError)
 			return
 		}
 
+		tutorial.Attendance = nullIntPtr(attendance)
 		res = append(res, tutorial)
 	}
 
+	if len(res) > limit {
+		res = res[:limit]
+		last := res[limit-1]
+		w.Header().Set("X-Next-Cursor", encodeTutorialCursor(last.ScheduledTime, last.Id))
+	}
+
 	if len(res) == 0 {
 		w.WriteHeader(http.StatusNoContent)
+		return
 	}
 
 	// Marshal to JSON and return
@@ -996,6 +2453,36 @@ func getUpcomingTutorials(w http.ResponseWriter, r *http.Request) {
 	w.Write(dres)
 }
 
+// Cursors point at the last tutorial of a page, by its time and id
+func encodeTutorialCursor(t time.Time, id string) string {
+	return base64.RawURLEncoding.EncodeToString([]byte(t.UTC().Format(time.RFC3339Nano) + "|" + id))
+}
+
+func decodeTutorialCursor(cursor string) (time.Time, string, error) {
+	raw, err := base64.RawURLEncoding.DecodeString(cursor)
+	if err != nil {
+		return time.Time{}, "", err
+	}
+
+	// The id goes into the query as a uuid, so anything else would fail there instead of here
+	parts := strings.SplitN(string(raw), "|", 2)
+	if len(parts) != 2 || !uuidRegex.MatchString(parts[1]) {
+		return time.Time{}, "", fmt.Errorf("malformed cursor")
+	}
+
+	t, err := time.Parse(time.RFC3339Nano, parts[0])
+	return t, parts[1], err
+}
+
+// Accepts either a full RFC3339 time or a plain date, which is taken as midnight UTC
+func parseTimeParam(value string) (time.Time, error) {
+	if t, err := time.Parse(time.RFC3339, value); err == nil {
+		return t, nil
+	}
+
+	return time.Parse("2006-01-02", value)
+}
+
 /******************* DAILY REVIEW HANDLERS ******************/
 func getDailyReview(w http.ResponseWriter, r *http.Request) {
 	lemail := r.Header.Get("X-User-Claim")
@@ -1185,7 +2672,7 @@ func passFlashcard(w http.ResponseWriter, r *http.Request) {
 		repeat -= 1
 	}
 
-	sql = `UPDATE learner_flashcard SET repeat = $1, selected = NULL WHERE learner = $2 AND flashcard = $3`
+	sql = `UPDATE learner_flashcard SET repeat = $1, selected = NULL, passes = passes + 1 WHERE learner = $2 AND flashcard = $3`
 	stmt, err := db.Prepare(sql)
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
@@ -1211,7 +2698,7 @@ func failFlashcard(w http.ResponseWriter, r *http.Request) {
 	// set repeat to 3 no matter what
 	repeat := 3
 
-	sql := `UPDATE learner_flashcard SET repeat = $1, selected = NULL WHERE learner = $2 AND flashcard = $3`
+	sql := `UPDATE learner_flashcard SET repeat = $1, selected = NULL, fails = fails + 1 WHERE learner = $2 AND flashcard = $3`
 	stmt, err := db.Prepare(sql)
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
@@ -1259,6 +2746,7 @@ func corsMiddleware(next http.Handler) http.Handler {
 		w.Header().Set("Access-Control-Allow-Origin", "*")
 		w.Header().Set("Access-Control-Allow-Methods", "GET,POST,PUT,DELETE")
 		w.Header().Set("Access-Control-Allow-Headers", "Origin, Content-Type, Authorization")
+		w.Header().Set("Access-Control-Expose-Headers", "X-Next-Cursor")
 
 		if r.Method == "OPTIONS" {
 			w.WriteHeader(200)
@@ -1293,11 +2781,12 @@ func authMiddleware(next http.Handler) http.Handler {
 
 		// Valid auth token received check if user exists
 		email := token.Claims["email"].(string)
-		var timezone string
+		timezone := "Asia/Singapore"
+		role := ROLE_LEARNER
 
 		// Get the user associated to the email if it exists
-		sqlquery := `SELECT email, timezone FROM learner WHERE email = $1`
-		err = db.QueryRow(sqlquery, email).Scan(&email, &timezone)
+		sqlquery := `SELECT email, timezone, role FROM learner WHERE email = $1`
+		err = db.QueryRow(sqlquery, email).Scan(&email, &timezone, &role)
 
 		if err == sql.ErrNoRows {
 			// Means that the user is new and has to be created
@@ -1323,6 +2812,33 @@ func authMiddleware(next http.Handler) http.Handler {
 
 		r.Header.Set("X-User-Claim", email)
 		r.Header.Set("X-Timezone-Claim", timezone)
+		r.Header.Set("X-Role-Claim", strconv.Itoa(role))
+		next.ServeHTTP(w, r)
+	})
+}
+
+// Has to run after the authMiddleware, which sets the role claim
+func instructorMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		role, err := strconv.Atoi(r.Header.Get("X-Role-Claim"))
+		if err != nil || role < ROLE_INSTRUCTOR {
+			http.Error(w, "Instructor access required", http.StatusForbidden)
+			return
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+// Has to run after the authMiddleware, which sets the role claim
+func adminMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		role, err := strconv.Atoi(r.Header.Get("X-Role-Claim"))
+		if err != nil || role < ROLE_ADMIN {
+			http.Error(w, "Admin access required", http.StatusForbidden)
+			return
+		}
+
 		next.ServeHTTP(w, r)
 	})
 }
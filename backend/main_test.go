@@ -0,0 +1,119 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func date(year int, month time.Month, day int) time.Time {
+	return time.Date(year, month, day, 0, 0, 0, 0, time.UTC)
+}
+
+func TestApplyCohortShifts(t *testing.T) {
+	tests := []struct {
+		name   string
+		t      time.Time
+		shifts []cohortShift
+		want   time.Time
+	}{
+		{"no shifts", date(2021, 3, 10), nil, date(2021, 3, 10)},
+		{"before the shift", date(2021, 3, 9), []cohortShift{{date(2021, 3, 10), 7}}, date(2021, 3, 9)},
+		{"on the shift date", date(2021, 3, 10), []cohortShift{{date(2021, 3, 10), 7}}, date(2021, 3, 17)},
+		{"after the shift", date(2021, 3, 12), []cohortShift{{date(2021, 3, 10), 2}}, date(2021, 3, 14)},
+		{"shifted back", date(2021, 3, 12), []cohortShift{{date(2021, 3, 10), -1}}, date(2021, 3, 11)},
+		{"shifts add up", date(2021, 3, 12), []cohortShift{{date(2021, 3, 10), 2}, {date(2021, 3, 14), 3}}, date(2021, 3, 17)},
+		{"later shift only applies to shifted dates", date(2021, 3, 12), []cohortShift{{date(2021, 3, 20), 3}, {date(2021, 3, 10), 2}}, date(2021, 3, 14)},
+		{"time of day stays", time.Date(2021, 3, 12, 18, 30, 0, 0, time.UTC), []cohortShift{{date(2021, 3, 10), 1}}, time.Date(2021, 3, 13, 18, 30, 0, 0, time.UTC)},
+	}
+
+	for _, test := range tests {
+		if got := applyCohortShifts(test.t, test.shifts); !got.Equal(test.want) {
+			t.Errorf("%s: got %v, want %v", test.name, got, test.want)
+		}
+	}
+}
+
+func TestTutorialDateTime(t *testing.T) {
+	newYork, err := time.LoadLocation("America/New_York")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	london, err := time.LoadLocation("Europe/London")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name      string
+		weekStart time.Time
+		day       int
+		minutes   int
+		location  *time.Location
+		want      time.Time
+	}{
+		{"before spring forward", date(2021, 3, 1), 6, 18 * 60, newYork, time.Date(2021, 3, 7, 23, 0, 0, 0, time.UTC)},
+		{"on spring forward", date(2021, 3, 8), 6, 18 * 60, newYork, time.Date(2021, 3, 14, 22, 0, 0, 0, time.UTC)},
+		{"week of spring forward before the change", date(2021, 3, 8), 0, 9*60 + 30, newYork, time.Date(2021, 3, 8, 14, 30, 0, 0, time.UTC)},
+		{"before fall back", date(2021, 10, 25), 0, 19 * 60, london, time.Date(2021, 10, 25, 18, 0, 0, 0, time.UTC)},
+		{"after fall back", date(2021, 11, 1), 0, 19 * 60, london, time.Date(2021, 11, 1, 19, 0, 0, 0, time.UTC)},
+		{"day rolls into the next month", date(2021, 3, 29), 4, 0, time.UTC, date(2021, 4, 2)},
+	}
+
+	for _, test := range tests {
+		got := tutorialDateTime(test.weekStart, test.day, test.minutes, test.location)
+		if !got.Equal(test.want) {
+			t.Errorf("%s: got %v, want %v", test.name, got.UTC(), test.want)
+		}
+
+		if local := got.In(test.location); local.Hour()*60+local.Minute() != test.minutes {
+			t.Errorf("%s: local time is %v, want %d minutes from midnight", test.name, local, test.minutes)
+		}
+	}
+}
+
+func TestCatalogCursor(t *testing.T) {
+	tests := []struct {
+		sort  string
+		id    string
+		value string
+		want  interface{}
+	}{
+		{"title", "CS0001", "Intro to Go", "Intro to Go"},
+		{"title", "CS0001", "A | B", "A | B"},
+		{"duration", "CS0003", "28", 28},
+		{"relevance", "CS0004", "0.5", 0.5},
+	}
+
+	for _, test := range tests {
+		cursor := encodeCatalogCursor(test.id, test.value)
+		id, value, err := decodeCatalogCursor(cursor, test.sort)
+		if err != nil {
+			t.Errorf("%s %q: unexpected error %v", test.sort, test.value, err)
+			continue
+		}
+
+		if id != test.id || value != test.want {
+			t.Errorf("%s %q: got %q and %#v, want %q and %#v", test.sort, test.value, id, value, test.id, test.want)
+		}
+	}
+}
+
+func TestDecodeCatalogCursorErrors(t *testing.T) {
+	tests := []struct {
+		name   string
+		cursor string
+		sort   string
+	}{
+		{"not base64", "not a cursor!", "title"},
+		{"no separator", "Q1MwMDAx", "title"},
+		{"duration from another sort", encodeCatalogCursor("CS0001", "Intro to Go"), "duration"},
+		{"relevance from another sort", encodeCatalogCursor("CS0001", "Intro to Go"), "relevance"},
+	}
+
+	for _, test := range tests {
+		if _, _, err := decodeCatalogCursor(test.cursor, test.sort); err == nil {
+			t.Errorf("%s: expected an error", test.name)
+		}
+	}
+}
@@ -0,0 +1,293 @@
+package main
+
+import (
+	"crypto/rand"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"net/url"
+	"path/filepath"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// Material kinds, stored in tutorial_material.kind
+const (
+	MATERIAL_SLIDES = iota
+	MATERIAL_OTHER
+)
+
+// Uploads larger than maxMaterialSize are rejected
+const maxMaterialSize = 100 << 20
+
+type materialResponse struct {
+	Id          string    `json:"id"`
+	Kind        int       `json:"kind"`
+	Filename    string    `json:"filename"`
+	ContentType string    `json:"content_type"`
+	Size        int64     `json:"size"`
+	CreatedAt   time.Time `json:"created_at"`
+}
+
+type tutorialMaterialsRes struct {
+	RecordingURL string             `json:"recording_url"`
+	Materials    []materialResponse `json:"materials"`
+}
+
+type updateRecordingRequest struct {
+	RecordingURL string `json:"recording_url"`
+}
+
+// Attaches the recording of a tutorial that ran for a cohort
+func updateTutorialRecording(w http.ResponseWriter, r *http.Request) {
+	tutorialId := mux.Vars(r)["id"]
+	cohortId := r.URL.Query().Get("cohort")
+
+	if cohortId == "" {
+		http.Error(w, "Invalid query parameters", http.StatusBadRequest)
+		return
+	}
+
+	var req updateRecordingRequest
+
+	// Parsing request body
+	decoder := json.NewDecoder(r.Body)
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(&req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if req.RecordingURL != "" {
+		if _, err := url.ParseRequestURI(req.RecordingURL); err != nil {
+			http.Error(w, "Invalid recording url", http.StatusBadRequest)
+			return
+		}
+	}
+
+	if err := checkCohortTutorial(cohortId, tutorialId); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	sqlquery := `INSERT INTO cohort_tutorial(cohort, tutorial, recording_url) VALUES ($1, $2, $3)
+							ON CONFLICT (cohort, tutorial) DO UPDATE SET recording_url = EXCLUDED.recording_url`
+	if _, err := db.Exec(sqlquery, cohortId, tutorialId, req.RecordingURL); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusAccepted)
+}
+
+// Uploads a file for a tutorial that ran for a cohort, as the multipart field "file"
+func uploadTutorialMaterial(w http.ResponseWriter, r *http.Request) {
+	tutorialId := mux.Vars(r)["id"]
+	query := r.URL.Query()
+	cohortId := query.Get("cohort")
+
+	kind, err := strconv.Atoi(query.Get("kind"))
+	if cohortId == "" || err != nil || kind < MATERIAL_SLIDES || kind > MATERIAL_OTHER {
+		http.Error(w, "Invalid query parameters", http.StatusBadRequest)
+		return
+	}
+
+	if err := checkCohortTutorial(cohortId, tutorialId); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	r.Body = http.MaxBytesReader(w, r.Body, maxMaterialSize)
+	file, header, err := r.FormFile("file")
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	defer file.Close()
+
+	res := materialResponse{Kind: kind, Filename: filepath.Base(header.Filename), ContentType: header.Header.Get("Content-Type")}
+	if res.ContentType == "" {
+		res.ContentType = "application/octet-stream"
+	}
+
+	buf := make([]byte, 16)
+	if _, err := rand.Read(buf); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	storageKey := fmt.Sprintf("tutorials/%s/%s/%s", cohortId, tutorialId, hex.EncodeToString(buf))
+
+	res.Size, err = files.Save(storageKey, file)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	sqlquery := `INSERT INTO tutorial_material(cohort, tutorial, kind, filename, content_type, size, storage_key)
+							VALUES ($1, $2, $3, $4, $5, $6, $7) RETURNING material_id, created_at`
+	if err := db.QueryRow(sqlquery, cohortId, tutorialId, res.Kind, res.Filename, res.ContentType, res.Size, storageKey).Scan(&res.Id, &res.CreatedAt); err != nil {
+		files.Delete(storageKey)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	dres, err := json.Marshal(res)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusCreated)
+	w.Write(dres)
+}
+
+func deleteTutorialMaterial(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+
+	var storageKey string
+	sqlquery := `DELETE FROM tutorial_material WHERE material_id = $1 AND tutorial = $2 RETURNING storage_key`
+	if err := db.QueryRow(sqlquery, vars["material"], vars["id"]).Scan(&storageKey); err != nil {
+		if err == sql.ErrNoRows {
+			http.Error(w, "Invalid material id", http.StatusNotFound)
+		} else {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+		}
+		return
+	}
+
+	if err := files.Delete(storageKey); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+}
+
+// Lists the recording and files of a tutorial for the learner's cohort
+func getTutorialMaterials(w http.ResponseWriter, r *http.Request) {
+	lemail := r.Header.Get("X-User-Claim")
+	tutorialId := mux.Vars(r)["id"]
+
+	cohortId, err := getLearnerTutorialCohort(lemail, tutorialId)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			http.Error(w, "Not enrolled in the tutorial", http.StatusForbidden)
+		} else {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+		}
+		return
+	}
+
+	var res tutorialMaterialsRes
+
+	sqlquery := `SELECT recording_url FROM cohort_tutorial WHERE cohort = $1 AND tutorial = $2`
+	if err := db.QueryRow(sqlquery, cohortId, tutorialId).Scan(&res.RecordingURL); err != nil && err != sql.ErrNoRows {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	sqlquery = `SELECT material_id, kind, filename, content_type, size, created_at FROM tutorial_material
+							WHERE cohort = $1 AND tutorial = $2 ORDER BY created_at`
+	result, err := db.Query(sqlquery, cohortId, tutorialId)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	defer result.Close()
+
+	for result.Next() {
+		var material materialResponse
+		if err := result.Scan(&material.Id, &material.Kind, &material.Filename, &material.ContentType, &material.Size, &material.CreatedAt); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		res.Materials = append(res.Materials, material)
+	}
+
+	dres, err := json.Marshal(res)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Write(dres)
+}
+
+// Streams a tutorial file to a learner of the cohort it was uploaded for
+func downloadTutorialMaterial(w http.ResponseWriter, r *http.Request) {
+	lemail := r.Header.Get("X-User-Claim")
+	vars := mux.Vars(r)
+
+	cohortId, err := getLearnerTutorialCohort(lemail, vars["id"])
+	if err != nil {
+		if err == sql.ErrNoRows {
+			http.Error(w, "Not enrolled in the tutorial", http.StatusForbidden)
+		} else {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+		}
+		return
+	}
+
+	var filename, contentType, storageKey string
+	var size int64
+	sqlquery := `SELECT filename, content_type, size, storage_key FROM tutorial_material
+							WHERE material_id = $1 AND tutorial = $2 AND cohort = $3`
+	if err := db.QueryRow(sqlquery, vars["material"], vars["id"], cohortId).Scan(&filename, &contentType, &size, &storageKey); err != nil {
+		if err == sql.ErrNoRows {
+			http.Error(w, "Invalid material id", http.StatusNotFound)
+		} else {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+		}
+		return
+	}
+
+	file, err := files.Open(storageKey)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	defer file.Close()
+
+	w.Header().Set("Content-Type", contentType)
+	w.Header().Set("Content-Length", strconv.FormatInt(size, 10))
+	w.Header().Set("Content-Disposition", mime.FormatMediaType("attachment", map[string]string{"filename": filename}))
+	io.Copy(w, file)
+}
+
+// Checks that the tutorial belongs to the module of the cohort
+func checkCohortTutorial(cohortId string, tutorialId string) error {
+	var dummy string
+	sqlquery := `SELECT tutorial_id FROM tutorial INNER JOIN cohort ON cohort.module = tutorial.module AND cohort.content_version = tutorial.version
+							WHERE cohort.cohort_id = $1 AND tutorial.tutorial_id = $2`
+	if err := db.QueryRow(sqlquery, cohortId, tutorialId).Scan(&dummy); err != nil {
+		if err == sql.ErrNoRows {
+			return fmt.Errorf("Tutorial is not part of the cohort's module")
+		}
+		return err
+	}
+
+	return nil
+}
+
+// Returns the cohort through which the learner takes the tutorial
+func getLearnerTutorialCohort(learnerId string, tutorialId string) (string, error) {
+	var cohortId string
+	sqlquery := `SELECT cohort.cohort_id FROM learner_cohort
+							INNER JOIN cohort ON cohort.cohort_id = learner_cohort.cohort
+							INNER JOIN tutorial ON tutorial.module = cohort.module AND tutorial.version = cohort.content_version
+							WHERE learner_cohort.learner = $1 AND tutorial.tutorial_id = $2`
+	err := db.QueryRow(sqlquery, learnerId, tutorialId).Scan(&cohortId)
+
+	return cohortId, err
+}
@@ -0,0 +1,226 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"path"
+	"sync"
+	"time"
+
+	"github.com/dgrijalva/jwt-go"
+	"github.com/gorilla/mux"
+)
+
+// Learners can join from joinWindowBefore the tutorial starts until joinWindowAfter it started
+const joinWindowBefore = 15 * time.Minute
+const joinWindowAfter = 90 * time.Minute
+
+// Join links stop working after joinLinkLifetime, or at the end of the window if that's earlier
+const joinLinkLifetime = 10 * time.Minute
+
+type meetingRoom struct {
+	Provider string
+	RoomURL  string
+	Passcode string
+}
+
+// meetingProvider hands out join links for a tutorial's room
+type meetingProvider interface {
+	// JoinLink returns a link the learner can use to join the room until expiry
+	JoinLink(room meetingRoom, learner string, expiry time.Time) (string, error)
+}
+
+// Providers by the name stored in tutorial.meeting_provider, local is added by main when LOCAL_MEETINGS is set
+var meetingProviders = map[string]meetingProvider{
+	"jitsi": jitsiProvider{},
+	"link":  linkProvider{},
+}
+
+// jitsiProvider signs a Jitsi JWT for the room with the app secret shared with the Jitsi server,
+// so the link can't be reused once it expires
+type jitsiProvider struct{}
+
+func (jitsiProvider) JoinLink(room meetingRoom, learner string, expiry time.Time) (string, error) {
+	if JITSI_APP_SECRET == "" {
+		return "", fmt.Errorf("Jitsi rooms are not configured")
+	}
+
+	roomURL, err := url.Parse(room.RoomURL)
+	if err != nil {
+		return "", err
+	}
+
+	claims := jwt.MapClaims{
+		"aud":  "jitsi",
+		"iss":  "microuniversity",
+		"sub":  roomURL.Host,
+		"room": path.Base(roomURL.Path),
+		"exp":  expiry.Unix(),
+		"context": map[string]interface{}{
+			"user": map[string]string{"email": learner},
+		},
+	}
+
+	token, err := jwt.NewWithClaims(jwt.SigningMethodHS256, claims).SignedString([]byte(JITSI_APP_SECRET))
+	if err != nil {
+		return "", err
+	}
+
+	query := roomURL.Query()
+	query.Set("jwt", token)
+	roomURL.RawQuery = query.Encode()
+
+	return roomURL.String(), nil
+}
+
+// linkProvider is for rooms with a fixed link, such as Zoom or Google Meet, protected by the passcode
+type linkProvider struct{}
+
+func (linkProvider) JoinLink(room meetingRoom, learner string, expiry time.Time) (string, error) {
+	return room.RoomURL, nil
+}
+
+// localMeetingProvider is a fake for local development and tests, it remembers every link it handed out
+type localMeetingProvider struct {
+	mu     sync.Mutex
+	Issued []string
+}
+
+func (p *localMeetingProvider) JoinLink(room meetingRoom, learner string, expiry time.Time) (string, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	link := fmt.Sprintf("local://%s?learner=%s&expiry=%d", url.PathEscape(room.RoomURL), url.QueryEscape(learner), expiry.Unix())
+	p.Issued = append(p.Issued, link)
+
+	return link, nil
+}
+
+type joinTutorialRes struct {
+	JoinURL   string    `json:"join_url"`
+	Passcode  string    `json:"passcode"`
+	ExpiresAt time.Time `json:"expires_at"`
+}
+
+// Returns a short lived join link for a tutorial the learner is scheduled for
+func joinTutorial(w http.ResponseWriter, r *http.Request) {
+	lemail := r.Header.Get("X-User-Claim")
+	tutorialId := mux.Vars(r)["id"]
+
+	var room meetingRoom
+	var scheduled time.Time
+
+	sqlquery := `SELECT meeting_provider, room_url, passcode, scheduled_datetime FROM tutorial
+							INNER JOIN learner_tutorial ON learner_tutorial.tutorial = tutorial.tutorial_id AND learner_tutorial.learner = $1
+							WHERE tutorial_id = $2`
+	if err := db.QueryRow(sqlquery, lemail, tutorialId).Scan(&room.Provider, &room.RoomURL, &room.Passcode, &scheduled); err != nil {
+		if err == sql.ErrNoRows {
+			http.Error(w, "Not enrolled in the tutorial", http.StatusForbidden)
+		} else {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+		}
+		return
+	}
+
+	res, ok := issueJoinLink(w, room, lemail, scheduled, time.Now())
+	if !ok {
+		return
+	}
+
+	dres, err := json.Marshal(res)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Write(dres)
+}
+
+// Hands out a join link when the tutorial is open for joining at now, errors are written to the response
+func issueJoinLink(w http.ResponseWriter, room meetingRoom, learner string, scheduled time.Time, now time.Time) (joinTutorialRes, bool) {
+	var res joinTutorialRes
+
+	windowEnd := scheduled.Add(joinWindowAfter)
+	if now.Before(scheduled.Add(-joinWindowBefore)) || now.After(windowEnd) {
+		http.Error(w, "Tutorial is not open for joining", http.StatusForbidden)
+		return res, false
+	}
+
+	provider, ok := meetingProviders[room.Provider]
+	if !ok || room.RoomURL == "" {
+		http.Error(w, "Tutorial has no meeting room", http.StatusNotFound)
+		return res, false
+	}
+
+	expiry := now.Add(joinLinkLifetime)
+	if expiry.After(windowEnd) {
+		expiry = windowEnd
+	}
+
+	link, err := provider.JoinLink(room, learner, expiry)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return res, false
+	}
+
+	return joinTutorialRes{JoinURL: link, Passcode: room.Passcode, ExpiresAt: expiry}, true
+}
+
+type updateMeetingRequest struct {
+	Provider string `json:"provider"`
+	RoomURL  string `json:"room_url"`
+	Passcode string `json:"passcode"`
+}
+
+// Sets the meeting room of a tutorial
+func updateTutorialMeeting(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	tutorialId := query.Get("tutorial")
+
+	if tutorialId == "" {
+		http.Error(w, "Invalid query parameters", http.StatusBadRequest)
+		return
+	}
+
+	var req updateMeetingRequest
+
+	// Parsing request body
+	decoder := json.NewDecoder(r.Body)
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(&req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if _, ok := meetingProviders[req.Provider]; !ok {
+		http.Error(w, "Unknown meeting provider", http.StatusBadRequest)
+		return
+	}
+
+	if req.Provider == "jitsi" && JITSI_APP_SECRET == "" {
+		http.Error(w, "Jitsi rooms are not configured", http.StatusConflict)
+		return
+	}
+
+	if _, err := url.ParseRequestURI(req.RoomURL); err != nil {
+		http.Error(w, "Invalid room url", http.StatusBadRequest)
+		return
+	}
+
+	sqlquery := `UPDATE tutorial SET meeting_provider = $1, room_url = $2, passcode = $3 WHERE tutorial_id = $4`
+	result, err := db.Exec(sqlquery, req.Provider, req.RoomURL, req.Passcode, tutorialId)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	if affected, err := result.RowsAffected(); err != nil || affected == 0 {
+		http.Error(w, "Invalid tutorial id", http.StatusBadRequest)
+		return
+	}
+
+	w.WriteHeader(http.StatusAccepted)
+}
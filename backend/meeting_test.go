@@ -0,0 +1,59 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestIssueJoinLink(t *testing.T) {
+	fake := &localMeetingProvider{}
+	meetingProviders["local"] = fake
+	defer delete(meetingProviders, "local")
+
+	scheduled := time.Date(2021, 6, 1, 12, 0, 0, 0, time.UTC)
+	room := meetingRoom{Provider: "local", RoomURL: "room-1", Passcode: "1234"}
+
+	tests := []struct {
+		name       string
+		room       meetingRoom
+		now        time.Time
+		wantStatus int
+		wantExpiry time.Time
+	}{
+		{"too early", room, scheduled.Add(-joinWindowBefore - time.Second), http.StatusForbidden, time.Time{}},
+		{"window opens", room, scheduled.Add(-joinWindowBefore), http.StatusOK, scheduled.Add(-joinWindowBefore + joinLinkLifetime)},
+		{"running", room, scheduled.Add(time.Hour), http.StatusOK, scheduled.Add(time.Hour + joinLinkLifetime)},
+		{"link ends with the window", room, scheduled.Add(joinWindowAfter - time.Minute), http.StatusOK, scheduled.Add(joinWindowAfter)},
+		{"too late", room, scheduled.Add(joinWindowAfter + time.Second), http.StatusForbidden, time.Time{}},
+		{"no room", meetingRoom{Provider: "local"}, scheduled, http.StatusNotFound, time.Time{}},
+		{"unknown provider", meetingRoom{Provider: "zoom", RoomURL: "room-1"}, scheduled, http.StatusNotFound, time.Time{}},
+	}
+
+	for _, test := range tests {
+		issued := len(fake.Issued)
+		recorder := httptest.NewRecorder()
+
+		res, ok := issueJoinLink(recorder, test.room, "ada@example.com", scheduled, test.now)
+		if ok != (test.wantStatus == http.StatusOK) || recorder.Code != test.wantStatus {
+			t.Errorf("%s: got status %d, want %d", test.name, recorder.Code, test.wantStatus)
+			continue
+		}
+
+		if !ok {
+			if len(fake.Issued) != issued {
+				t.Errorf("%s: a link was handed out", test.name)
+			}
+			continue
+		}
+
+		if !res.ExpiresAt.Equal(test.wantExpiry) {
+			t.Errorf("%s: link expires at %v, want %v", test.name, res.ExpiresAt, test.wantExpiry)
+		}
+
+		if len(fake.Issued) != issued+1 || fake.Issued[issued] != res.JoinURL || res.Passcode != room.Passcode {
+			t.Errorf("%s: got link %q, the provider issued %v", test.name, res.JoinURL, fake.Issued[issued:])
+		}
+	}
+}
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"net/http"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+type notificationResponse struct {
+	Id        string          `json:"id"`
+	Kind      string          `json:"kind"`
+	Message   string          `json:"message"`
+	Payload   json.RawMessage `json:"payload"`
+	CreatedAt time.Time       `json:"created_at"`
+	Read      bool            `json:"read"`
+}
+
+// Lists the latest notifications of the learner, only the unread ones with unread=true
+func getNotifications(w http.ResponseWriter, r *http.Request) {
+	lemail := r.Header.Get("X-User-Claim")
+	unread := r.URL.Query().Get("unread") == "true"
+
+	var res []notificationResponse
+
+	sqlquery := `SELECT notification_id, kind, message, payload, created_at, read_at IS NOT NULL FROM notification
+							WHERE learner = $1 AND (NOT $2 OR read_at IS NULL)
+							ORDER BY created_at DESC LIMIT 50`
+	result, err := db.Query(sqlquery, lemail, unread)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	defer result.Close()
+
+	for result.Next() {
+		var notification notificationResponse
+		var payload []byte
+		if err := result.Scan(&notification.Id, &notification.Kind, &notification.Message, &payload, &notification.CreatedAt, &notification.Read); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		notification.Payload = payload
+		res = append(res, notification)
+	}
+
+	if len(res) == 0 {
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+
+	dres, err := json.Marshal(res)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Write(dres)
+}
+
+// Marks a notification as read, or all of them without the id query parameter
+func readNotifications(w http.ResponseWriter, r *http.Request) {
+	lemail := r.Header.Get("X-User-Claim")
+	notificationId := r.URL.Query().Get("id")
+
+	sqlquery := `UPDATE notification SET read_at = NOW() WHERE learner = $1 AND read_at IS NULL AND ($2 = '' OR notification_id::text = $2)`
+	if _, err := db.Exec(sqlquery, lemail, notificationId); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+}
+
+// Sends the same notification to every learner in the list
+func notifyLearners(tx *sql.Tx, learnerIds []string, kind string, message string, payload interface{}) error {
+	if len(learnerIds) == 0 {
+		return nil
+	}
+
+	dpayload, err := json.Marshal(payload)
+	if err != nil {
+		return err
+	}
+
+	sqlquery := `INSERT INTO notification(learner, kind, message, payload) SELECT learner, $2, $3, $4 FROM unnest($1::varchar[]) AS learner`
+	_, err = tx.Exec(sqlquery, pq.Array(learnerIds), kind, message, string(dpayload))
+
+	return err
+}
@@ -0,0 +1,207 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"net/http"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+type progressLecture struct {
+	Id            string    `json:"id"`
+	Title         string    `json:"title"`
+	ScheduledDate time.Time `json:"scheduled_date"`
+}
+
+// Next is the first lecture scheduled from today on, overdue lists the incomplete lectures before today
+type lectureProgress struct {
+	Total     int               `json:"total"`
+	Completed int               `json:"completed"`
+	Upcoming  int               `json:"upcoming"`
+	Overdue   int               `json:"overdue"`
+	Next      *progressLecture  `json:"next"`
+	Late      []progressLecture `json:"overdue_lectures"`
+}
+
+// New cards were never reviewed, mastered ones were passed with no repeats left and the rest are still being learned
+type deckProgress struct {
+	Total    int `json:"total"`
+	New      int `json:"new"`
+	Learning int `json:"learning"`
+	Mastered int `json:"mastered"`
+}
+
+type selfPacedProgress struct {
+	StartDate time.Time `json:"start_date"`
+	PaceDays  int       `json:"pace_days"`
+}
+
+// Exactly one of cohort and self_paced is set, projected completion is nil once every lecture is done
+type moduleProgressRes struct {
+	Module              string              `json:"module"`
+	Lectures            lectureProgress     `json:"lectures"`
+	Flashcards          deckProgress        `json:"flashcards"`
+	NextTutorial        *tutorialResponse   `json:"next_tutorial"`
+	Cohort              *getModuleCohortRes `json:"cohort"`
+	SelfPaced           *selfPacedProgress  `json:"self_paced"`
+	Quizzes             []quizResult        `json:"quizzes"`
+	ProjectedCompletion *time.Time          `json:"projected_completion"`
+}
+
+// Returns everything the module page shows about the learner's progress in one response
+func getModuleProgress(w http.ResponseWriter, r *http.Request) {
+	lemail := r.Header.Get("X-User-Claim")
+	timezone := r.Header.Get("X-Timezone-Claim")
+	moduleId := mux.Vars(r)["id"]
+
+	location, err := time.LoadLocation(timezone)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	local := time.Now().UTC().In(location)
+	today := time.Date(local.Year(), local.Month(), local.Day(), 0, 0, 0, 0, time.UTC)
+
+	res := moduleProgressRes{Module: moduleId}
+
+	// Cohort learners see their cohort, the others have to be taking the module at their own pace
+	var cohort getModuleCohortRes
+	sqlquery := `SELECT cohort_id, module, status, start_date, weekly_tutorial_day, weekly_tutorial_time, timezone,
+								(SELECT COUNT(*) FROM learner_cohort AS members WHERE members.cohort = cohort.cohort_id)
+							FROM learner_cohort INNER JOIN cohort ON learner_cohort.cohort = cohort.cohort_id
+							WHERE learner_cohort.learner = $1 AND cohort.module = $2`
+	err = db.QueryRow(sqlquery, lemail, moduleId).Scan(&cohort.Id, &cohort.Module, &cohort.Status, &cohort.StartDate,
+		&cohort.WeeklyTutorialDay, &cohort.WeeklyTutorialTime, &cohort.Timezone, &cohort.LearnerCount)
+	switch {
+	case err == nil:
+		res.Cohort = &cohort
+	case err == sql.ErrNoRows:
+		var selfPaced selfPacedProgress
+		sqlquery = `SELECT start_date, pace_days FROM self_paced_enrollment WHERE learner = $1 AND module = $2`
+		if err := db.QueryRow(sqlquery, lemail, moduleId).Scan(&selfPaced.StartDate, &selfPaced.PaceDays); err != nil {
+			if err == sql.ErrNoRows {
+				http.Error(w, "Not enrolled in the module", http.StatusNotFound)
+			} else {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+			}
+			return
+		}
+		res.SelfPaced = &selfPaced
+	default:
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	res.Lectures.Late = []progressLecture{}
+
+	var lastScheduled time.Time
+	sqlquery = `SELECT lecture_id, title, scheduled_date, completed FROM lecture
+							INNER JOIN learner_lecture ON learner_lecture.lecture = lecture.lecture_id AND learner_lecture.learner = $1
+							WHERE lecture.module = $2
+							ORDER BY scheduled_date, date_offset`
+	result, err := db.Query(sqlquery, lemail, moduleId)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	defer result.Close()
+
+	for result.Next() {
+		var lecture progressLecture
+		var completed bool
+		if err := result.Scan(&lecture.Id, &lecture.Title, &lecture.ScheduledDate, &completed); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		res.Lectures.Total++
+		switch {
+		case completed:
+			res.Lectures.Completed++
+			continue
+		case lecture.ScheduledDate.Before(today):
+			res.Lectures.Overdue++
+			res.Lectures.Late = append(res.Lectures.Late, lecture)
+		default:
+			res.Lectures.Upcoming++
+			if res.Lectures.Next == nil {
+				next := lecture
+				res.Lectures.Next = &next
+			}
+		}
+
+		lastScheduled = lecture.ScheduledDate
+	}
+
+	if err := result.Err(); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	// Overdue lectures still have to be caught up on, one a day for cohorts or at the learner's own pace
+	if remaining := res.Lectures.Overdue + res.Lectures.Upcoming; remaining > 0 {
+		paceDays := 1
+		if res.SelfPaced != nil {
+			paceDays = res.SelfPaced.PaceDays
+		}
+
+		projected := today.AddDate(0, 0, (remaining-1)*paceDays)
+		if lastScheduled.After(projected) {
+			projected = lastScheduled
+		}
+		res.ProjectedCompletion = &projected
+	}
+
+	sqlquery = `SELECT COUNT(*),
+								COUNT(*) FILTER (WHERE learner_flashcard.passes = 0 AND learner_flashcard.fails = 0),
+								COUNT(*) FILTER (WHERE learner_flashcard.passes > 0 AND learner_flashcard.repeat <= 0)
+							FROM learner_flashcard
+							INNER JOIN flashcard ON flashcard.flashcard_id = learner_flashcard.flashcard
+							INNER JOIN lecture ON lecture.lecture_id = flashcard.lecture
+							WHERE learner_flashcard.learner = $1 AND lecture.module = $2`
+	if err := db.QueryRow(sqlquery, lemail, moduleId).Scan(&res.Flashcards.Total, &res.Flashcards.New, &res.Flashcards.Mastered); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	res.Flashcards.Learning = res.Flashcards.Total - res.Flashcards.New - res.Flashcards.Mastered
+
+	var tutorial tutorialResponse
+	var attendance sql.NullInt32
+	sqlquery = `SELECT tutorial_id, title, description, scheduled_datetime, module, meeting_provider, attendance FROM tutorial
+							INNER JOIN learner_tutorial ON learner_tutorial.tutorial = tutorial.tutorial_id AND learner_tutorial.learner = $1
+							WHERE tutorial.module = $2 AND scheduled_datetime > NOW()
+							ORDER BY scheduled_datetime LIMIT 1`
+	err = db.QueryRow(sqlquery, lemail, moduleId).Scan(&tutorial.Id, &tutorial.Title, &tutorial.Description, &tutorial.ScheduledTime,
+		&tutorial.Module, &tutorial.MeetingProvider, &attendance)
+	if err != nil && err != sql.ErrNoRows {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	if err == nil {
+		tutorial.Attendance = nullIntPtr(attendance)
+		res.NextTutorial = &tutorial
+	}
+
+	res.Quizzes, err = getQuizSummary(lemail, moduleId)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	if res.Quizzes == nil {
+		res.Quizzes = []quizResult{}
+	}
+
+	dres, err := json.Marshal(res)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Write(dres)
+}
@@ -0,0 +1,643 @@
+package main
+
+import (
+	"crypto/sha1"
+	"database/sql"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/lib/pq"
+	"gopkg.in/yaml.v3"
+)
+
+/*
+A module package keeps the content of a module in files, so it can live in git
+
+	<dir>/module.yaml           module metadata and tutorials
+	<dir>/lectures/<any>.yaml   one lecture with its flashcards per file
+
+JSON files (.json) work the same way. Lectures, tutorials and flashcards carry a key that
+stays the same across imports. Keys that are UUIDs are used as content keys directly, other
+keys are turned into a name based UUID within the module, so renaming a key is a remove and an add.
+Importing syncs the package into the module's draft, nothing changes for learners until it is published.
+*/
+
+type modulePackage struct {
+	Id            string            `json:"id" yaml:"id"`
+	Title         string            `json:"title" yaml:"title"`
+	Image         string            `json:"image" yaml:"image"`
+	Description   string            `json:"description" yaml:"description"`
+	Duration      int               `json:"duration" yaml:"duration"`
+	MinAttendance int               `json:"min_attendance" yaml:"min_attendance"`
+	MinLectures   int               `json:"min_lectures" yaml:"min_lectures"`
+	MinMastery    int               `json:"min_mastery" yaml:"min_mastery"`
+	Tags          []string          `json:"tags" yaml:"tags"`
+	Difficulty    string            `json:"difficulty" yaml:"difficulty"`
+	Language      string            `json:"language" yaml:"language"`
+	Tutorials     []packageTutorial `json:"tutorials" yaml:"tutorials"`
+	Lectures      []packageLecture  `json:"-" yaml:"-"`
+}
+
+type packageLecture struct {
+	Key             string             `json:"key" yaml:"key"`
+	Title           string             `json:"title" yaml:"title"`
+	Description     string             `json:"description" yaml:"description"`
+	VideoLink       string             `json:"video_link" yaml:"video_link"`
+	DateOffset      int                `json:"date_offset" yaml:"date_offset"`
+	DurationSeconds int                `json:"duration_seconds" yaml:"duration_seconds"`
+	MinWatchPercent int                `json:"min_watch_percent" yaml:"min_watch_percent"`
+	Flashcards      []packageFlashcard `json:"flashcards" yaml:"flashcards"`
+}
+
+type packageTutorial struct {
+	Key         string `json:"key" yaml:"key"`
+	Week        int    `json:"week" yaml:"week"`
+	Title       string `json:"title" yaml:"title"`
+	Description string `json:"description" yaml:"description"`
+}
+
+type packageFlashcard struct {
+	Key        string `json:"key" yaml:"key"`
+	TopSide    string `json:"top_side" yaml:"top_side"`
+	BottomSide string `json:"bottom_side" yaml:"bottom_side"`
+}
+
+var uuidRegex = regexp.MustCompile(`^[0-9a-fA-F]{8}-[0-9a-fA-F]{4}-[0-9a-fA-F]{4}-[0-9a-fA-F]{4}-[0-9a-fA-F]{12}$`)
+
+// RFC 4122 URL namespace, content keys are derived from names within it
+var packageNamespace = []byte{0x6b, 0xa7, 0xb8, 0x11, 0x9d, 0xad, 0x11, 0xd1, 0x80, 0xb4, 0x00, 0xc0, 0x4f, 0xd4, 0x30, 0xc8}
+
+// Runs a command line subcommand instead of the server, returns the exit code
+func runCommand(args []string) int {
+	var err error
+	switch args[0] {
+	case "import-module":
+		err = importModuleCommand(args[1:])
+	case "export-module":
+		err = exportModuleCommand(args[1:])
+	default:
+		err = fmt.Errorf("Unknown command %s, use import-module or export-module", args[0])
+	}
+
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+
+	return 0
+}
+
+func openCommandDatabase() error {
+	DB_URL = os.Getenv("DB_URL")
+	checkEnvVariable(DB_URL)
+
+	var err error
+	db, err = sql.Open("postgres", DB_URL)
+	if err != nil {
+		return err
+	}
+
+	return db.Ping()
+}
+
+/******************* IMPORT *********************************/
+
+func importModuleCommand(args []string) error {
+	flags := flag.NewFlagSet("import-module", flag.ContinueOnError)
+	actor := flags.String("actor", "", "email of the admin the import is audited as")
+	publish := flags.Bool("publish", false, "publish the draft when the import changed anything")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+
+	if flags.NArg() != 1 {
+		return fmt.Errorf("Usage: import-module [-actor email] [-publish] <dir>")
+	}
+
+	pkg, err := readModulePackage(flags.Arg(0))
+	if err != nil {
+		return err
+	}
+
+	if err := validateModulePackage(&pkg); err != nil {
+		return err
+	}
+
+	if err := openCommandDatabase(); err != nil {
+		return err
+	}
+
+	defer db.Close()
+
+	version, err := importModulePackage(pkg, *actor)
+	if err != nil {
+		return err
+	}
+
+	// Without a published version everything in the draft counts as a change
+	var published sql.NullInt32
+	sqlquery := `SELECT published_version FROM module WHERE module_id = $1`
+	if err := db.QueryRow(sqlquery, pkg.Id).Scan(&published); err != nil {
+		return err
+	}
+
+	changes, err := diffModuleVersions(pkg.Id, int(published.Int32), version)
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("Imported %s into draft version %d, %d changes from the published version\n", pkg.Id, version, len(changes))
+	for _, change := range changes {
+		fmt.Printf("  %s %s %s\n", change.Change, change.Entity, change.Title)
+	}
+
+	if !*publish || len(changes) == 0 {
+		return nil
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+
+	defer tx.Rollback()
+
+	for _, sqlquery := range []string{
+		`UPDATE module_version SET published_at = NOW() WHERE module = $1 AND version = $2 AND published_at IS NULL`,
+		`UPDATE module SET published_version = $2 WHERE module_id = $1`,
+	} {
+		if _, err := tx.Exec(sqlquery, pkg.Id, version); err != nil {
+			return err
+		}
+	}
+
+	if *actor != "" {
+		if err := writeAudit(tx, *actor, "publish", "module", pkg.Id, map[string]int{"version": version}); err != nil {
+			return err
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+
+	fmt.Printf("Published version %d of %s\n", version, pkg.Id)
+	return nil
+}
+
+func readModulePackage(dir string) (modulePackage, error) {
+	var pkg modulePackage
+
+	moduleFile := filepath.Join(dir, "module.yaml")
+	for _, name := range []string{"module.yaml", "module.yml", "module.json"} {
+		if _, err := os.Stat(filepath.Join(dir, name)); err == nil {
+			moduleFile = filepath.Join(dir, name)
+			break
+		}
+	}
+
+	if err := readPackageFile(moduleFile, &pkg); err != nil {
+		return pkg, err
+	}
+
+	lectureFiles, err := ioutil.ReadDir(filepath.Join(dir, "lectures"))
+	if err != nil && !os.IsNotExist(err) {
+		return pkg, err
+	}
+
+	for _, file := range lectureFiles {
+		switch filepath.Ext(file.Name()) {
+		case ".yaml", ".yml", ".json":
+		default:
+			continue
+		}
+
+		var lecture packageLecture
+		if err := readPackageFile(filepath.Join(dir, "lectures", file.Name()), &lecture); err != nil {
+			return pkg, err
+		}
+
+		pkg.Lectures = append(pkg.Lectures, lecture)
+	}
+
+	return pkg, nil
+}
+
+// YAML is a superset of JSON, so both kinds of files go through the YAML decoder
+func readPackageFile(path string, out interface{}) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+
+	defer file.Close()
+
+	decoder := yaml.NewDecoder(file)
+	decoder.KnownFields(true)
+	if err := decoder.Decode(out); err != nil {
+		return fmt.Errorf("%s: %v", path, err)
+	}
+
+	return nil
+}
+
+// Checks the whole package up front, so an import either applies completely or not at all
+func validateModulePackage(pkg *modulePackage) error {
+	if !moduleIdRegex.MatchString(pkg.Id) {
+		return fmt.Errorf("Module id has to be a code like CS0001")
+	}
+
+	module := adminModule{Title: pkg.Title, Duration: pkg.Duration, MinAttendance: pkg.MinAttendance, MinLectures: pkg.MinLectures, MinMastery: pkg.MinMastery,
+		Tags: pkg.Tags, Difficulty: pkg.Difficulty, Language: pkg.Language}
+	module.normalize()
+	if msg := validateModule(module); msg != "" {
+		return fmt.Errorf("Module %s: %s", pkg.Id, msg)
+	}
+	pkg.Tags, pkg.Difficulty, pkg.Language = module.Tags, module.Difficulty, module.Language
+
+	keys := make(map[string]bool)
+	checkKey := func(kind string, key string) error {
+		if strings.TrimSpace(key) == "" {
+			return fmt.Errorf("Every %s needs a key", kind)
+		}
+
+		if keys[kind+"/"+key] {
+			return fmt.Errorf("Duplicate %s key %s", kind, key)
+		}
+
+		keys[kind+"/"+key] = true
+		return nil
+	}
+
+	offsets := make(map[int]string)
+	for _, lecture := range pkg.Lectures {
+		if err := checkKey("lecture", lecture.Key); err != nil {
+			return err
+		}
+
+		switch {
+		case strings.TrimSpace(lecture.Title) == "":
+			return fmt.Errorf("Lecture %s: title can't be empty", lecture.Key)
+		case lecture.DateOffset < 0 || lecture.DateOffset >= pkg.Duration:
+			return fmt.Errorf("Lecture %s: date offset has to fall within the module's duration", lecture.Key)
+		case lecture.DurationSeconds < 0:
+			return fmt.Errorf("Lecture %s: duration can't be negative", lecture.Key)
+		case lecture.MinWatchPercent < 0 || lecture.MinWatchPercent > 100:
+			return fmt.Errorf("Lecture %s: minimum watch percent has to be a percentage", lecture.Key)
+		case lecture.MinWatchPercent > 0 && lecture.DurationSeconds == 0:
+			return fmt.Errorf("Lecture %s: minimum watch percent needs the duration of the video", lecture.Key)
+		}
+
+		if _, err := url.ParseRequestURI(lecture.VideoLink); err != nil {
+			return fmt.Errorf("Lecture %s: invalid video link", lecture.Key)
+		}
+
+		if other, ok := offsets[lecture.DateOffset]; ok {
+			return fmt.Errorf("Lectures %s and %s have the same date offset", other, lecture.Key)
+		}
+		offsets[lecture.DateOffset] = lecture.Key
+
+		for _, card := range lecture.Flashcards {
+			if err := checkKey("flashcard", card.Key); err != nil {
+				return err
+			}
+
+			if msg := validateFlashcard(adminFlashcard{TopSide: card.TopSide, BottomSide: card.BottomSide}); msg != "" {
+				return fmt.Errorf("Flashcard %s: %s", card.Key, msg)
+			}
+		}
+	}
+
+	for _, tutorial := range pkg.Tutorials {
+		if err := checkKey("tutorial", tutorial.Key); err != nil {
+			return err
+		}
+
+		switch {
+		case strings.TrimSpace(tutorial.Title) == "":
+			return fmt.Errorf("Tutorial %s: title can't be empty", tutorial.Key)
+		case tutorial.Week < 0 || tutorial.Week*7 >= pkg.Duration:
+			return fmt.Errorf("Tutorial %s: week has to fall within the module's duration", tutorial.Key)
+		}
+	}
+
+	return nil
+}
+
+// Syncs the package into the module's draft, matching content by key
+// Returns the draft version, running it again with the same package changes nothing
+func importModulePackage(pkg modulePackage, actor string) (int, error) {
+	tx, err := db.Begin()
+	if err != nil {
+		return 0, err
+	}
+
+	defer tx.Rollback()
+
+	// New modules stay hidden until their first publish
+	sqlquery := `INSERT INTO module(module_id, title, image, description, duration, min_attendance, min_lectures, min_mastery, tags, difficulty, language, published_version)
+							VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, NULL)
+							ON CONFLICT (module_id) DO UPDATE SET title = EXCLUDED.title, image = EXCLUDED.image, description = EXCLUDED.description,
+								duration = EXCLUDED.duration, min_attendance = EXCLUDED.min_attendance, min_lectures = EXCLUDED.min_lectures,
+								min_mastery = EXCLUDED.min_mastery, tags = EXCLUDED.tags, difficulty = EXCLUDED.difficulty, language = EXCLUDED.language`
+	if _, err := tx.Exec(sqlquery, pkg.Id, pkg.Title, pkg.Image, pkg.Description, pkg.Duration, pkg.MinAttendance, pkg.MinLectures, pkg.MinMastery,
+		pq.Array(pkg.Tags), pkg.Difficulty, pkg.Language); err != nil {
+		return 0, err
+	}
+
+	version, err := ensureDraftVersion(tx, pkg.Id)
+	if err != nil {
+		return 0, err
+	}
+
+	// Lectures swapping date offsets would clash halfway through
+	sqlquery = `SET CONSTRAINTS unique_lecture_date_offset DEFERRED`
+	if _, err := tx.Exec(sqlquery); err != nil {
+		return 0, err
+	}
+
+	// Empty lists instead of nil, so the deletes below compare against an empty array rather than NULL
+	lectureKeys, tutorialKeys := []string{}, []string{}
+	for _, lecture := range pkg.Lectures {
+		lectureKeys = append(lectureKeys, packageContentKey(pkg.Id, "lecture", lecture.Key))
+	}
+
+	for _, tutorial := range pkg.Tutorials {
+		tutorialKeys = append(tutorialKeys, packageContentKey(pkg.Id, "tutorial", tutorial.Key))
+	}
+
+	// Drafts have no learners yet, so removed content can go along with everything hanging off it
+	for _, sqlquery := range []string{
+		`DELETE FROM flashcard USING lecture WHERE flashcard.lecture = lecture.lecture_id
+			AND lecture.module = $1 AND lecture.version = $2 AND lecture.content_key <> ALL($3::uuid[])`,
+		`DELETE FROM quiz_question USING lecture WHERE quiz_question.lecture = lecture.lecture_id
+			AND lecture.module = $1 AND lecture.version = $2 AND lecture.content_key <> ALL($3::uuid[])`,
+		`DELETE FROM quiz USING lecture WHERE quiz.lecture = lecture.lecture_id
+			AND lecture.module = $1 AND lecture.version = $2 AND lecture.content_key <> ALL($3::uuid[])`,
+		`DELETE FROM lecture_prerequisite USING lecture WHERE (lecture_prerequisite.lecture = lecture.lecture_id OR lecture_prerequisite.prerequisite = lecture.lecture_id)
+			AND lecture.module = $1 AND lecture.version = $2 AND lecture.content_key <> ALL($3::uuid[])`,
+		`DELETE FROM lecture WHERE module = $1 AND version = $2 AND content_key <> ALL($3::uuid[])`,
+	} {
+		if _, err := tx.Exec(sqlquery, pkg.Id, version, pq.Array(lectureKeys)); err != nil {
+			return 0, err
+		}
+	}
+
+	sqlquery = `DELETE FROM tutorial WHERE module = $1 AND version = $2 AND content_key <> ALL($3::uuid[])`
+	if _, err := tx.Exec(sqlquery, pkg.Id, version, pq.Array(tutorialKeys)); err != nil {
+		return 0, err
+	}
+
+	lectureQuery := `INSERT INTO lecture(title, description, video_link, date_offset, module, duration_seconds, min_watch_percent, version, content_key)
+							VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9)
+							ON CONFLICT (module, version, content_key) DO UPDATE SET title = EXCLUDED.title, description = EXCLUDED.description,
+								video_link = EXCLUDED.video_link, date_offset = EXCLUDED.date_offset, duration_seconds = EXCLUDED.duration_seconds,
+								min_watch_percent = EXCLUDED.min_watch_percent
+							RETURNING lecture_id`
+	flashcardQuery := `INSERT INTO flashcard(top_side, bottom_side, lecture, content_key) VALUES ($1, $2, $3, $4)
+							ON CONFLICT (lecture, content_key) DO UPDATE SET top_side = EXCLUDED.top_side, bottom_side = EXCLUDED.bottom_side`
+	for i, lecture := range pkg.Lectures {
+		var lectureId string
+		if err := tx.QueryRow(lectureQuery, lecture.Title, lecture.Description, lecture.VideoLink, lecture.DateOffset, pkg.Id,
+			lecture.DurationSeconds, lecture.MinWatchPercent, version, lectureKeys[i]).Scan(&lectureId); err != nil {
+			return 0, err
+		}
+
+		cardKeys := []string{}
+		for _, card := range lecture.Flashcards {
+			cardKey := packageContentKey(pkg.Id, "flashcard", card.Key)
+			if _, err := tx.Exec(flashcardQuery, card.TopSide, card.BottomSide, lectureId, cardKey); err != nil {
+				return 0, err
+			}
+
+			cardKeys = append(cardKeys, cardKey)
+		}
+
+		sqlquery = `DELETE FROM flashcard WHERE lecture = $1 AND content_key <> ALL($2::uuid[])`
+		if _, err := tx.Exec(sqlquery, lectureId, pq.Array(cardKeys)); err != nil {
+			return 0, err
+		}
+	}
+
+	tutorialQuery := `INSERT INTO tutorial(week, title, description, module, version, content_key) VALUES ($1, $2, $3, $4, $5, $6)
+							ON CONFLICT (module, version, content_key) DO UPDATE SET week = EXCLUDED.week, title = EXCLUDED.title, description = EXCLUDED.description`
+	for i, tutorial := range pkg.Tutorials {
+		if _, err := tx.Exec(tutorialQuery, tutorial.Week, tutorial.Title, tutorial.Description, pkg.Id, version, tutorialKeys[i]); err != nil {
+			return 0, err
+		}
+	}
+
+	// The package's duration goes onto the live module, so it still has to fit the published lectures and tutorials
+	var lastOffset, lastWeek sql.NullInt32
+	sqlquery = `SELECT (SELECT MAX(date_offset) FROM lecture WHERE module = $1), (SELECT MAX(week) FROM tutorial WHERE module = $1)`
+	if err := tx.QueryRow(sqlquery, pkg.Id).Scan(&lastOffset, &lastWeek); err != nil {
+		return 0, err
+	}
+
+	if (lastOffset.Valid && int(lastOffset.Int32) >= pkg.Duration) || (lastWeek.Valid && int(lastWeek.Int32)*7 >= pkg.Duration) {
+		return 0, fmt.Errorf("Duration is too short for the module's lectures and tutorials")
+	}
+
+	if actor != "" {
+		if err := writeAudit(tx, actor, "import", "module", pkg.Id, map[string]int{"version": version, "lectures": len(pkg.Lectures), "tutorials": len(pkg.Tutorials)}); err != nil {
+			return 0, err
+		}
+	}
+
+	return version, tx.Commit()
+}
+
+// Turns a package key into the content key stored in the database
+func packageContentKey(moduleId string, kind string, key string) string {
+	if uuidRegex.MatchString(key) {
+		return strings.ToLower(key)
+	}
+
+	// Name based UUID (version 5) as described in RFC 4122
+	hash := sha1.New()
+	hash.Write(packageNamespace)
+	hash.Write([]byte(moduleId + "/" + kind + "/" + key))
+	sum := hash.Sum(nil)
+	sum[6] = sum[6]&0x0f | 0x50
+	sum[8] = sum[8]&0x3f | 0x80
+
+	return fmt.Sprintf("%x-%x-%x-%x-%x", sum[0:4], sum[4:6], sum[6:8], sum[8:10], sum[10:16])
+}
+
+/******************* EXPORT *********************************/
+
+func exportModuleCommand(args []string) error {
+	flags := flag.NewFlagSet("export-module", flag.ContinueOnError)
+	out := flags.String("out", "", "directory to write the package to, defaults to the module id, old lecture files in it are replaced")
+	format := flags.String("format", "yaml", "file format, yaml or json")
+	version := flags.Int("version", 0, "version to export, defaults to the draft or else the published version")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+
+	if flags.NArg() != 1 || (*format != "yaml" && *format != "json") {
+		return fmt.Errorf("Usage: export-module [-out dir] [-format yaml|json] [-version n] <id>")
+	}
+
+	moduleId := flags.Arg(0)
+	if *out == "" {
+		*out = moduleId
+	}
+
+	if err := openCommandDatabase(); err != nil {
+		return err
+	}
+
+	defer db.Close()
+
+	pkg, err := loadModulePackage(moduleId, *version)
+	if err != nil {
+		return err
+	}
+
+	if err := os.MkdirAll(filepath.Join(*out, "lectures"), 0755); err != nil {
+		return err
+	}
+
+	// Lectures that were removed since the last export shouldn't linger in the package
+	oldFiles, err := ioutil.ReadDir(filepath.Join(*out, "lectures"))
+	if err != nil {
+		return err
+	}
+
+	for _, file := range oldFiles {
+		switch filepath.Ext(file.Name()) {
+		case ".yaml", ".yml", ".json":
+			if err := os.Remove(filepath.Join(*out, "lectures", file.Name())); err != nil {
+				return err
+			}
+		}
+	}
+
+	if err := writePackageFile(filepath.Join(*out, "module."+*format), *format, pkg); err != nil {
+		return err
+	}
+
+	// Lecture files are named by date offset, so the directory lists in schedule order
+	for _, lecture := range pkg.Lectures {
+		path := filepath.Join(*out, "lectures", fmt.Sprintf("%03d.%s", lecture.DateOffset, *format))
+		if err := writePackageFile(path, *format, lecture); err != nil {
+			return err
+		}
+	}
+
+	fmt.Printf("Exported %s with %d lectures and %d tutorials to %s\n", moduleId, len(pkg.Lectures), len(pkg.Tutorials), *out)
+	return nil
+}
+
+// Loads a version of a module as a package, version 0 picks the draft or else the published version
+func loadModulePackage(moduleId string, version int) (modulePackage, error) {
+	var pkg modulePackage
+	var latest int
+
+	sqlquery := `SELECT module_id, title, image, description, duration, min_attendance, min_lectures, min_mastery, tags, difficulty, language,
+								COALESCE((SELECT MAX(version) FROM module_version WHERE module = module_id AND published_at IS NULL), published_version, 1)
+							FROM module WHERE module_id = $1`
+	if err := db.QueryRow(sqlquery, moduleId).Scan(&pkg.Id, &pkg.Title, &pkg.Image, &pkg.Description, &pkg.Duration, &pkg.MinAttendance, &pkg.MinLectures, &pkg.MinMastery, pq.Array(&pkg.Tags), &pkg.Difficulty, &pkg.Language, &latest); err != nil {
+		if err == sql.ErrNoRows {
+			return pkg, fmt.Errorf("Invalid module id")
+		}
+		return pkg, err
+	}
+
+	if version == 0 {
+		version = latest
+	}
+
+	sqlquery = `SELECT lecture_id, content_key, title, description, video_link, date_offset, duration_seconds, min_watch_percent FROM lecture
+							WHERE module = $1 AND version = $2 ORDER BY date_offset`
+	result, err := db.Query(sqlquery, moduleId, version)
+	if err != nil {
+		return pkg, err
+	}
+
+	defer result.Close()
+
+	lectureIndex := make(map[string]int)
+	for result.Next() {
+		var lectureId string
+		var lecture packageLecture
+		if err := result.Scan(&lectureId, &lecture.Key, &lecture.Title, &lecture.Description, &lecture.VideoLink, &lecture.DateOffset, &lecture.DurationSeconds, &lecture.MinWatchPercent); err != nil {
+			return pkg, err
+		}
+
+		lectureIndex[lectureId] = len(pkg.Lectures)
+		pkg.Lectures = append(pkg.Lectures, lecture)
+	}
+
+	sqlquery = `SELECT flashcard.lecture, flashcard.content_key, top_side, bottom_side FROM flashcard
+							INNER JOIN lecture ON lecture.lecture_id = flashcard.lecture
+							WHERE lecture.module = $1 AND lecture.version = $2`
+	result, err = db.Query(sqlquery, moduleId, version)
+	if err != nil {
+		return pkg, err
+	}
+
+	defer result.Close()
+
+	for result.Next() {
+		var lectureId string
+		var card packageFlashcard
+		if err := result.Scan(&lectureId, &card.Key, &card.TopSide, &card.BottomSide); err != nil {
+			return pkg, err
+		}
+
+		lecture := &pkg.Lectures[lectureIndex[lectureId]]
+		lecture.Flashcards = append(lecture.Flashcards, card)
+	}
+
+	// Keep the files stable between exports
+	for i := range pkg.Lectures {
+		cards := pkg.Lectures[i].Flashcards
+		sort.Slice(cards, func(a, b int) bool { return cards[a].Key < cards[b].Key })
+	}
+
+	sqlquery = `SELECT content_key, week, title, description FROM tutorial WHERE module = $1 AND version = $2 ORDER BY week, content_key`
+	result, err = db.Query(sqlquery, moduleId, version)
+	if err != nil {
+		return pkg, err
+	}
+
+	defer result.Close()
+
+	for result.Next() {
+		var tutorial packageTutorial
+		if err := result.Scan(&tutorial.Key, &tutorial.Week, &tutorial.Title, &tutorial.Description); err != nil {
+			return pkg, err
+		}
+
+		pkg.Tutorials = append(pkg.Tutorials, tutorial)
+	}
+
+	return pkg, result.Err()
+}
+
+func writePackageFile(path string, format string, content interface{}) error {
+	var data []byte
+	var err error
+	if format == "json" {
+		data, err = json.MarshalIndent(content, "", "  ")
+		data = append(data, '\n')
+	} else {
+		data, err = yaml.Marshal(content)
+	}
+
+	if err != nil {
+		return err
+	}
+
+	return ioutil.WriteFile(path, data, 0644)
+}
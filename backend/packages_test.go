@@ -0,0 +1,24 @@
+package main
+
+import "testing"
+
+func TestPackageContentKey(t *testing.T) {
+	tests := []struct {
+		module string
+		kind   string
+		key    string
+		want   string
+	}{
+		{"CS0001", "lecture", "intro", "a2ff34c6-d94b-587a-9f57-95b5bdcd1369"},
+		{"CS0001", "tutorial", "intro", "2a66548b-30b2-5a95-a27d-fdbede2cbcc8"},
+		{"CS0002", "lecture", "intro", "97cea684-8942-514b-ad65-dd69602e36e9"},
+		{"CS0001", "lecture", "0B7C3B9E-4D7C-4A53-9A51-2F4F8F0E6B11", "0b7c3b9e-4d7c-4a53-9a51-2f4f8f0e6b11"},
+		{"CS0002", "flashcard", "0b7c3b9e-4d7c-4a53-9a51-2f4f8f0e6b11", "0b7c3b9e-4d7c-4a53-9a51-2f4f8f0e6b11"},
+	}
+
+	for _, test := range tests {
+		if got := packageContentKey(test.module, test.kind, test.key); got != test.want {
+			t.Errorf("packageContentKey(%q, %q, %q) = %s, want %s", test.module, test.kind, test.key, got, test.want)
+		}
+	}
+}
@@ -0,0 +1,214 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/gorilla/mux"
+	"github.com/lib/pq"
+)
+
+// Mastery threshold is the percentage of the prerequisite's flashcards the learner has to master
+// Without a threshold completing the prerequisite lecture is enough
+type prerequisiteRequest struct {
+	Prerequisite     string `json:"prerequisite"`
+	MasteryThreshold *int   `json:"mastery_threshold"`
+}
+
+// Returns why each of the given lectures is still locked for the learner, unlocked lectures are left out
+// A flashcard counts as mastered once it has been passed and isn't due for a repeat
+func getLectureLocks(learnerId string, lectureIds []string) (map[string]string, error) {
+	reasons := make(map[string][]string)
+
+	sqlquery := `SELECT lecture_prerequisite.lecture, prerequisite.title, lecture_prerequisite.mastery_threshold,
+								COALESCE(learner_lecture.completed, false),
+								COUNT(flashcard.flashcard_id),
+								COUNT(learner_flashcard.flashcard) FILTER (WHERE learner_flashcard.passes > 0 AND learner_flashcard.repeat = 0)
+							FROM lecture_prerequisite
+							INNER JOIN lecture prerequisite ON prerequisite.lecture_id = lecture_prerequisite.prerequisite
+							LEFT JOIN learner_lecture ON learner_lecture.lecture = lecture_prerequisite.prerequisite AND learner_lecture.learner = $1
+							LEFT JOIN flashcard ON flashcard.lecture = lecture_prerequisite.prerequisite
+							LEFT JOIN learner_flashcard ON learner_flashcard.flashcard = flashcard.flashcard_id AND learner_flashcard.learner = $1
+							WHERE lecture_prerequisite.lecture = ANY($2::uuid[])
+							GROUP BY lecture_prerequisite.lecture, prerequisite.title, lecture_prerequisite.mastery_threshold, learner_lecture.completed
+							ORDER BY prerequisite.title`
+	result, err := db.Query(sqlquery, learnerId, pq.Array(lectureIds))
+	if err != nil {
+		return nil, err
+	}
+
+	defer result.Close()
+
+	for result.Next() {
+		var lectureId, title string
+		var threshold sql.NullInt32
+		var completed bool
+		var total, mastered int
+		if err := result.Scan(&lectureId, &title, &threshold, &completed, &total, &mastered); err != nil {
+			return nil, err
+		}
+
+		if !completed {
+			reasons[lectureId] = append(reasons[lectureId], fmt.Sprintf("Complete \"%s\" first", title))
+			continue
+		}
+
+		if threshold.Valid && total > 0 && 100*mastered/total < int(threshold.Int32) {
+			reasons[lectureId] = append(reasons[lectureId], fmt.Sprintf("Master %d%% of the flashcards of \"%s\" first, currently at %d%%", threshold.Int32, title, 100*mastered/total))
+		}
+	}
+
+	if err := result.Err(); err != nil {
+		return nil, err
+	}
+
+	locks := make(map[string]string)
+	for lectureId, lectureReasons := range reasons {
+		locks[lectureId] = strings.Join(lectureReasons, "; ")
+	}
+
+	return locks, nil
+}
+
+// Fills in the locked state of the lectures for the learner
+func applyLectureLocks(learnerId string, lectures []*lectureResponse) error {
+	var lectureIds []string
+	for _, lecture := range lectures {
+		lectureIds = append(lectureIds, lecture.Id)
+	}
+
+	locks, err := getLectureLocks(learnerId, lectureIds)
+	if err != nil {
+		return err
+	}
+
+	for _, lecture := range lectures {
+		lecture.LockedReason, lecture.Locked = locks[lecture.Id]
+	}
+
+	return nil
+}
+
+// Replaces the prerequisites of the lecture's copy in the draft, they have to be lectures of the same module
+// Prerequisites can be given by the id of any version of the lecture, they are stored as the draft's copy
+func updateLecturePrerequisites(w http.ResponseWriter, r *http.Request) {
+	lemail := r.Header.Get("X-User-Claim")
+
+	var req []prerequisiteRequest
+	if !decodeAdminRequest(w, r, &req) {
+		return
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	defer tx.Rollback()
+
+	lectureId, moduleId, version, err := draftLecture(tx, mux.Vars(r)["id"])
+	if err != nil {
+		if err == sql.ErrNoRows {
+			http.Error(w, "Invalid lecture id", http.StatusNotFound)
+		} else {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+		}
+		return
+	}
+
+	// Load the other edges of the draft to check for cycles
+	edges := make(map[string][]string)
+	sqlquery := `SELECT lecture_prerequisite.lecture, lecture_prerequisite.prerequisite FROM lecture_prerequisite
+							INNER JOIN lecture ON lecture.lecture_id = lecture_prerequisite.lecture
+							WHERE lecture.module = $1 AND lecture.version = $2 AND lecture_prerequisite.lecture <> $3`
+	result, err := tx.Query(sqlquery, moduleId, version, lectureId)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	for result.Next() {
+		var from, to string
+		if err := result.Scan(&from, &to); err != nil {
+			result.Close()
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		edges[from] = append(edges[from], to)
+	}
+	result.Close()
+
+	sqlquery = `SELECT draft.lecture_id FROM lecture
+							INNER JOIN lecture draft ON draft.module = lecture.module AND draft.content_key = lecture.content_key AND draft.version = $3
+							WHERE lecture.lecture_id::text = $1 AND lecture.module = $2`
+	for i, prerequisite := range req {
+		if prerequisite.MasteryThreshold != nil && (*prerequisite.MasteryThreshold < 0 || *prerequisite.MasteryThreshold > 100) {
+			http.Error(w, "Invalid mastery threshold", http.StatusBadRequest)
+			return
+		}
+
+		if err := tx.QueryRow(sqlquery, prerequisite.Prerequisite, moduleId, version).Scan(&req[i].Prerequisite); err != nil {
+			if err == sql.ErrNoRows {
+				http.Error(w, "Prerequisite has to be a lecture of the same module", http.StatusBadRequest)
+			} else {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+			}
+			return
+		}
+
+		edges[lectureId] = append(edges[lectureId], req[i].Prerequisite)
+	}
+
+	if hasPrerequisiteCycle(edges, lectureId) {
+		http.Error(w, "Prerequisites would form a cycle", http.StatusBadRequest)
+		return
+	}
+
+	sqlquery = `DELETE FROM lecture_prerequisite WHERE lecture = $1`
+	if _, err := tx.Exec(sqlquery, lectureId); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	sqlquery = `INSERT INTO lecture_prerequisite(lecture, prerequisite, mastery_threshold) VALUES ($1, $2, $3)`
+	for _, prerequisite := range req {
+		if _, err := tx.Exec(sqlquery, lectureId, prerequisite.Prerequisite, prerequisite.MasteryThreshold); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+
+	if !commitAudited(w, tx, lemail, "update", "prerequisites", lectureId, req) {
+		return
+	}
+
+	writeAdminRes(w, http.StatusOK, req)
+}
+
+// Checks if the lecture can reach itself through its prerequisites
+func hasPrerequisiteCycle(edges map[string][]string, lectureId string) bool {
+	visited := make(map[string]bool)
+	stack := append([]string{}, edges[lectureId]...)
+
+	for len(stack) > 0 {
+		current := stack[len(stack)-1]
+		stack = stack[:len(stack)-1]
+
+		if current == lectureId {
+			return true
+		}
+
+		if visited[current] {
+			continue
+		}
+
+		visited[current] = true
+		stack = append(stack, edges[current]...)
+	}
+
+	return false
+}
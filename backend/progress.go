@@ -0,0 +1,193 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+)
+
+// A single heartbeat never credits more than maxHeartbeatCredit seconds of watching
+// The first heartbeat only starts the clock, the total watched never goes past the time since it
+const maxHeartbeatCredit = 60
+
+type heartbeatRequest struct {
+	PositionSeconds int `json:"position_seconds"`
+	ElapsedSeconds  int `json:"elapsed_seconds"`
+}
+
+// Watched percent is 100 for lectures without a known duration
+type watchProgressRes struct {
+	PositionSeconds int  `json:"position_seconds"`
+	WatchedSeconds  int  `json:"watched_seconds"`
+	DurationSeconds int  `json:"duration_seconds"`
+	WatchedPercent  int  `json:"watched_percent"`
+	RequiredPercent int  `json:"required_percent"`
+	CanComplete     bool `json:"can_complete"`
+}
+
+// Returns the learner's playback position and watched time of a lecture, to resume from
+func getWatchProgress(w http.ResponseWriter, r *http.Request) {
+	lemail := r.Header.Get("X-User-Claim")
+	lectureId := r.URL.Query().Get("id")
+
+	if lectureId == "" {
+		http.Error(w, "No valid lecture id provided", http.StatusBadRequest)
+		return
+	}
+
+	res, err := loadWatchProgress(db, lemail, lectureId)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			http.Error(w, "Not enrolled in the lecture", http.StatusForbidden)
+		} else {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+		}
+		return
+	}
+
+	writeWatchProgress(w, res)
+}
+
+// Records a playback heartbeat, elapsed seconds is how long the video played since the previous one
+func recordHeartbeat(w http.ResponseWriter, r *http.Request) {
+	lemail := r.Header.Get("X-User-Claim")
+	lectureId := r.URL.Query().Get("id")
+
+	if lectureId == "" {
+		http.Error(w, "No valid lecture id provided", http.StatusBadRequest)
+		return
+	}
+
+	var req heartbeatRequest
+
+	// Parsing request body
+	decoder := json.NewDecoder(r.Body)
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(&req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if req.PositionSeconds < 0 || req.ElapsedSeconds < 0 {
+		http.Error(w, "Invalid heartbeat", http.StatusBadRequest)
+		return
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	defer tx.Rollback()
+
+	// Locking the row, so concurrent heartbeats are credited one after the other
+	var firstHeartbeat sql.NullTime
+	sqlquery := `SELECT first_heartbeat FROM learner_lecture WHERE learner = $1 AND lecture = $2 FOR UPDATE`
+	if err := tx.QueryRow(sqlquery, lemail, lectureId).Scan(&firstHeartbeat); err != nil {
+		if err == sql.ErrNoRows {
+			http.Error(w, "Not enrolled in the lecture", http.StatusForbidden)
+		} else {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+		}
+		return
+	}
+
+	res, err := loadWatchProgress(tx, lemail, lectureId)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	// Clients can't claim more watching than the wall clock allows since they started
+	now := time.Now()
+	if !firstHeartbeat.Valid {
+		firstHeartbeat = sql.NullTime{Time: now, Valid: true}
+	}
+
+	credit := req.ElapsedSeconds
+	if credit > maxHeartbeatCredit {
+		credit = maxHeartbeatCredit
+	}
+
+	res.WatchedSeconds += credit
+	if sinceFirst := int(now.Sub(firstHeartbeat.Time).Seconds()); res.WatchedSeconds > sinceFirst {
+		res.WatchedSeconds = sinceFirst
+	}
+
+	res.PositionSeconds = req.PositionSeconds
+	if res.DurationSeconds > 0 {
+		if res.WatchedSeconds > res.DurationSeconds {
+			res.WatchedSeconds = res.DurationSeconds
+		}
+		if res.PositionSeconds > res.DurationSeconds {
+			res.PositionSeconds = res.DurationSeconds
+		}
+	}
+
+	sqlquery = `UPDATE learner_lecture SET position_seconds = $1, watched_seconds = $2, first_heartbeat = $3, last_heartbeat = $4
+							WHERE learner = $5 AND lecture = $6`
+	if _, err := tx.Exec(sqlquery, res.PositionSeconds, res.WatchedSeconds, firstHeartbeat, now, lemail, lectureId); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	if err := tx.Commit(); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	fillWatchPercent(&res)
+	writeWatchProgress(w, res)
+}
+
+type queryRower interface {
+	QueryRow(query string, args ...interface{}) *sql.Row
+}
+
+func loadWatchProgress(q queryRower, learnerId string, lectureId string) (watchProgressRes, error) {
+	var res watchProgressRes
+
+	sqlquery := `SELECT position_seconds, watched_seconds, duration_seconds, min_watch_percent FROM learner_lecture
+							INNER JOIN lecture ON lecture.lecture_id = learner_lecture.lecture
+							WHERE learner_lecture.learner = $1 AND learner_lecture.lecture = $2`
+	err := q.QueryRow(sqlquery, learnerId, lectureId).Scan(&res.PositionSeconds, &res.WatchedSeconds, &res.DurationSeconds, &res.RequiredPercent)
+
+	fillWatchPercent(&res)
+	return res, err
+}
+
+func fillWatchPercent(res *watchProgressRes) {
+	res.WatchedPercent = 100
+	if res.DurationSeconds > 0 {
+		res.WatchedPercent = 100 * res.WatchedSeconds / res.DurationSeconds
+	}
+
+	res.CanComplete = res.WatchedPercent >= res.RequiredPercent
+}
+
+// Returns why the learner can't complete the lecture yet, empty when they watched enough of it
+func checkWatchRequirement(q queryRower, learnerId string, lectureId string) (string, error) {
+	progress, err := loadWatchProgress(q, learnerId, lectureId)
+	if err != nil {
+		return "", err
+	}
+
+	if !progress.CanComplete {
+		return fmt.Sprintf("Watch at least %d%% of the lecture first, currently at %d%%", progress.RequiredPercent, progress.WatchedPercent), nil
+	}
+
+	return "", nil
+}
+
+func writeWatchProgress(w http.ResponseWriter, res watchProgressRes) {
+	dres, err := json.Marshal(res)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Write(dres)
+}
@@ -0,0 +1,555 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"math"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/lib/pq"
+)
+
+// Question kinds, stored in quiz_question.kind
+const (
+	QUESTION_MULTIPLE_CHOICE = iota
+	QUESTION_NUMERIC
+	QUESTION_SHORT_TEXT
+)
+
+// Answers are only part of the instructor's view of a question
+type quizQuestion struct {
+	Id              string   `json:"id"`
+	Kind            int      `json:"kind"`
+	Prompt          string   `json:"prompt"`
+	Choices         []string `json:"choices"`
+	CorrectChoice   *int     `json:"correct_choice,omitempty"`
+	NumericAnswer   *float64 `json:"numeric_answer,omitempty"`
+	Tolerance       float64  `json:"tolerance,omitempty"`
+	AcceptedAnswers []string `json:"accepted_answers,omitempty"`
+}
+
+// Max attempts of 0 allows unlimited attempts
+type quizRequest struct {
+	PassPercent int            `json:"pass_percent"`
+	MaxAttempts int            `json:"max_attempts"`
+	Questions   []quizQuestion `json:"questions"`
+}
+
+type learnerQuizRes struct {
+	LectureId    string         `json:"lecture_id"`
+	PassPercent  int            `json:"pass_percent"`
+	MaxAttempts  int            `json:"max_attempts"`
+	AttemptsUsed int            `json:"attempts_used"`
+	BestPercent  *int           `json:"best_percent"`
+	Passed       bool           `json:"passed"`
+	Questions    []quizQuestion `json:"questions"`
+}
+
+// Only the field matching the question kind is used
+type quizAnswer struct {
+	Question string   `json:"question"`
+	Choice   *int     `json:"choice,omitempty"`
+	Number   *float64 `json:"number,omitempty"`
+	Text     *string  `json:"text,omitempty"`
+}
+
+type quizAttemptRes struct {
+	Score        int             `json:"score"`
+	MaxScore     int             `json:"max_score"`
+	Percent      int             `json:"percent"`
+	Passed       bool            `json:"passed"`
+	AttemptsUsed int             `json:"attempts_used"`
+	Correct      map[string]bool `json:"correct"`
+}
+
+type quizResult struct {
+	LectureId    string `json:"lecture_id"`
+	Title        string `json:"title"`
+	AttemptsUsed int    `json:"attempts_used"`
+	MaxAttempts  int    `json:"max_attempts"`
+	BestPercent  *int   `json:"best_percent"`
+	Passed       bool   `json:"passed"`
+}
+
+/******************* INSTRUCTOR AUTHORING *******************/
+
+// Returns a lecture's quiz including the answers
+func getQuiz(w http.ResponseWriter, r *http.Request) {
+	lectureId := r.URL.Query().Get("id")
+
+	if lectureId == "" {
+		http.Error(w, "No valid lecture id provided", http.StatusBadRequest)
+		return
+	}
+
+	var res quizRequest
+	sqlquery := `SELECT pass_percent, max_attempts FROM quiz WHERE lecture = $1`
+	if err := db.QueryRow(sqlquery, lectureId).Scan(&res.PassPercent, &res.MaxAttempts); err != nil {
+		if err == sql.ErrNoRows {
+			w.WriteHeader(http.StatusNoContent)
+		} else {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+		}
+		return
+	}
+
+	questions, err := getQuizQuestions(lectureId)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	res.Questions = questions
+
+	dres, err := json.Marshal(res)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Write(dres)
+}
+
+// Replaces the quiz of the lecture's copy in the draft, an empty question list removes it
+// Learners only see the change once the draft is published
+func updateQuiz(w http.ResponseWriter, r *http.Request) {
+	lemail := r.Header.Get("X-User-Claim")
+
+	var req quizRequest
+	if !decodeAdminRequest(w, r, &req) {
+		return
+	}
+
+	if req.PassPercent < 0 || req.PassPercent > 100 || req.MaxAttempts < 0 {
+		http.Error(w, "Invalid pass percent or attempt limit", http.StatusBadRequest)
+		return
+	}
+
+	for _, question := range req.Questions {
+		if msg := validateQuizQuestion(question); msg != "" {
+			http.Error(w, msg, http.StatusBadRequest)
+			return
+		}
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	defer tx.Rollback()
+
+	lectureId, _, _, err := draftLecture(tx, mux.Vars(r)["id"])
+	if err != nil {
+		if err == sql.ErrNoRows {
+			http.Error(w, "Invalid lecture id", http.StatusNotFound)
+		} else {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+		}
+		return
+	}
+
+	if err := saveQuiz(tx, lectureId, req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if !commitAudited(w, tx, lemail, "update", "quiz", lectureId, req) {
+		return
+	}
+
+	// Answering with the saved questions, so the ids kept or given out are known
+	req.Questions, err = getQuizQuestions(lectureId)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	writeAdminRes(w, http.StatusOK, req)
+}
+
+// Returns what is wrong with a question, empty when it is valid
+func validateQuizQuestion(question quizQuestion) string {
+	if strings.TrimSpace(question.Prompt) == "" {
+		return "Question prompt can't be empty"
+	}
+
+	switch question.Kind {
+	case QUESTION_MULTIPLE_CHOICE:
+		if len(question.Choices) < 2 || question.CorrectChoice == nil || *question.CorrectChoice < 0 || *question.CorrectChoice >= len(question.Choices) {
+			return "Multiple choice questions need at least two choices and a valid correct choice"
+		}
+	case QUESTION_NUMERIC:
+		if question.NumericAnswer == nil || question.Tolerance < 0 {
+			return "Numeric questions need an answer and a non-negative tolerance"
+		}
+	case QUESTION_SHORT_TEXT:
+		if len(question.AcceptedAnswers) == 0 {
+			return "Short text questions need at least one accepted answer"
+		}
+	default:
+		return "Invalid question kind"
+	}
+
+	return ""
+}
+
+// Questions whose content didn't change keep their id and content key, so the answers of earlier attempts still point at them
+// The old questions are parked at negative positions first, the ones still parked at the end were removed or edited
+func saveQuiz(tx *sql.Tx, lectureId string, quiz quizRequest) error {
+	if len(quiz.Questions) == 0 {
+		sqlquery := `DELETE FROM quiz_question WHERE lecture = $1`
+		if _, err := tx.Exec(sqlquery, lectureId); err != nil {
+			return err
+		}
+
+		sqlquery = `DELETE FROM quiz WHERE lecture = $1`
+		_, err := tx.Exec(sqlquery, lectureId)
+		return err
+	}
+
+	sqlquery := `INSERT INTO quiz(lecture, pass_percent, max_attempts) VALUES ($1, $2, $3)
+							ON CONFLICT (lecture) DO UPDATE SET pass_percent = EXCLUDED.pass_percent, max_attempts = EXCLUDED.max_attempts`
+	if _, err := tx.Exec(sqlquery, lectureId, quiz.PassPercent, quiz.MaxAttempts); err != nil {
+		return err
+	}
+
+	sqlquery = `UPDATE quiz_question SET position = -1 - position WHERE lecture = $1`
+	if _, err := tx.Exec(sqlquery, lectureId); err != nil {
+		return err
+	}
+
+	keepQuery := `UPDATE quiz_question SET position = $2 WHERE question_id = (
+									SELECT question_id FROM quiz_question
+									WHERE lecture = $1 AND position < 0 AND kind = $3 AND prompt = $4 AND choices = $5
+										AND correct_choice IS NOT DISTINCT FROM $6 AND numeric_answer IS NOT DISTINCT FROM $7
+										AND tolerance = $8 AND accepted_answers = $9
+									ORDER BY position DESC LIMIT 1
+								)`
+	insertQuery := `INSERT INTO quiz_question(lecture, position, kind, prompt, choices, correct_choice, numeric_answer, tolerance, accepted_answers)
+									VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9)`
+	for position, question := range quiz.Questions {
+		if question.Choices == nil {
+			question.Choices = []string{}
+		}
+		if question.AcceptedAnswers == nil {
+			question.AcceptedAnswers = []string{}
+		}
+
+		args := []interface{}{lectureId, position, question.Kind, question.Prompt, pq.Array(question.Choices),
+			question.CorrectChoice, question.NumericAnswer, question.Tolerance, pq.Array(question.AcceptedAnswers)}
+
+		result, err := tx.Exec(keepQuery, args...)
+		if err != nil {
+			return err
+		}
+
+		kept, err := result.RowsAffected()
+		if err != nil {
+			return err
+		}
+
+		if kept > 0 {
+			continue
+		}
+
+		if _, err := tx.Exec(insertQuery, args...); err != nil {
+			return err
+		}
+	}
+
+	sqlquery = `DELETE FROM quiz_question WHERE lecture = $1 AND position < 0`
+	_, err := tx.Exec(sqlquery, lectureId)
+	return err
+}
+
+func getQuizQuestions(lectureId string) ([]quizQuestion, error) {
+	var questions []quizQuestion
+
+	sqlquery := `SELECT question_id, kind, prompt, choices, correct_choice, numeric_answer, tolerance, accepted_answers
+							FROM quiz_question WHERE lecture = $1 ORDER BY position`
+	result, err := db.Query(sqlquery, lectureId)
+	if err != nil {
+		return nil, err
+	}
+
+	defer result.Close()
+
+	for result.Next() {
+		var question quizQuestion
+		var correctChoice sql.NullInt32
+		var numericAnswer sql.NullFloat64
+		if err := result.Scan(&question.Id, &question.Kind, &question.Prompt, pq.Array(&question.Choices), &correctChoice,
+			&numericAnswer, &question.Tolerance, pq.Array(&question.AcceptedAnswers)); err != nil {
+			return nil, err
+		}
+
+		question.CorrectChoice = nullIntPtr(correctChoice)
+		if numericAnswer.Valid {
+			question.NumericAnswer = &numericAnswer.Float64
+		}
+
+		questions = append(questions, question)
+	}
+
+	return questions, result.Err()
+}
+
+/******************* LEARNER QUIZ ***************************/
+
+// Returns a lecture's quiz without the answers, along with the learner's attempts so far
+func getLearnerQuiz(w http.ResponseWriter, r *http.Request) {
+	lemail := r.Header.Get("X-User-Claim")
+	lectureId := r.URL.Query().Get("id")
+
+	if lectureId == "" {
+		http.Error(w, "No valid lecture id provided", http.StatusBadRequest)
+		return
+	}
+
+	res := learnerQuizRes{LectureId: lectureId}
+
+	sqlquery := `SELECT pass_percent, max_attempts FROM quiz
+							INNER JOIN learner_lecture ON learner_lecture.lecture = quiz.lecture AND learner_lecture.learner = $1
+							WHERE quiz.lecture = $2`
+	if err := db.QueryRow(sqlquery, lemail, lectureId).Scan(&res.PassPercent, &res.MaxAttempts); err != nil {
+		if err == sql.ErrNoRows {
+			w.WriteHeader(http.StatusNoContent)
+		} else {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+		}
+		return
+	}
+
+	var best sql.NullInt32
+	sqlquery = `SELECT COUNT(*), MAX(100 * score / GREATEST(max_score, 1)), COALESCE(BOOL_OR(passed), false)
+							FROM quiz_attempt WHERE learner = $1 AND lecture = $2`
+	if err := db.QueryRow(sqlquery, lemail, lectureId).Scan(&res.AttemptsUsed, &best, &res.Passed); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	res.BestPercent = nullIntPtr(best)
+
+	questions, err := getQuizQuestions(lectureId)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	// Strip the answers
+	for _, question := range questions {
+		res.Questions = append(res.Questions, quizQuestion{Id: question.Id, Kind: question.Kind, Prompt: question.Prompt, Choices: question.Choices})
+	}
+
+	dres, err := json.Marshal(res)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Write(dres)
+}
+
+// Grades a quiz attempt, every question is worth a point
+func submitQuiz(w http.ResponseWriter, r *http.Request) {
+	lemail := r.Header.Get("X-User-Claim")
+	lectureId := r.URL.Query().Get("id")
+
+	if lectureId == "" {
+		http.Error(w, "No valid lecture id provided", http.StatusBadRequest)
+		return
+	}
+
+	var answers []quizAnswer
+
+	// Parsing request body
+	decoder := json.NewDecoder(r.Body)
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(&answers); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	defer tx.Rollback()
+
+	// Locking the learner's lecture row keeps concurrent submissions from going over the attempt limit
+	var passPercent, maxAttempts int
+	sqlquery := `SELECT pass_percent, max_attempts FROM quiz
+							INNER JOIN learner_lecture ON learner_lecture.lecture = quiz.lecture AND learner_lecture.learner = $1
+							WHERE quiz.lecture = $2 FOR UPDATE OF learner_lecture`
+	if err := tx.QueryRow(sqlquery, lemail, lectureId).Scan(&passPercent, &maxAttempts); err != nil {
+		if err == sql.ErrNoRows {
+			http.Error(w, "No quiz for the lecture", http.StatusNotFound)
+		} else {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+		}
+		return
+	}
+
+	var res quizAttemptRes
+	sqlquery = `SELECT COUNT(*) FROM quiz_attempt WHERE learner = $1 AND lecture = $2`
+	if err := tx.QueryRow(sqlquery, lemail, lectureId).Scan(&res.AttemptsUsed); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	if maxAttempts > 0 && res.AttemptsUsed >= maxAttempts {
+		http.Error(w, "No attempts left", http.StatusForbidden)
+		return
+	}
+
+	questions, err := getQuizQuestions(lectureId)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	if len(questions) == 0 {
+		http.Error(w, "No quiz for the lecture", http.StatusNotFound)
+		return
+	}
+
+	byQuestion := make(map[string]quizAnswer)
+	for _, answer := range answers {
+		byQuestion[answer.Question] = answer
+	}
+
+	res.Correct = make(map[string]bool)
+	res.MaxScore = len(questions)
+	for _, question := range questions {
+		correct := gradeQuizAnswer(question, byQuestion[question.Id])
+		res.Correct[question.Id] = correct
+		if correct {
+			res.Score++
+		}
+	}
+
+	res.Percent = 100 * res.Score / res.MaxScore
+	res.Passed = res.Percent >= passPercent
+	res.AttemptsUsed++
+
+	danswers, err := json.Marshal(answers)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	sqlquery = `INSERT INTO quiz_attempt(learner, lecture, score, max_score, passed, answers, submitted_at) VALUES ($1, $2, $3, $4, $5, $6, $7)`
+	if _, err := tx.Exec(sqlquery, lemail, lectureId, res.Score, res.MaxScore, res.Passed, string(danswers), time.Now().UTC()); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	if err := tx.Commit(); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	dres, err := json.Marshal(res)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Write(dres)
+}
+
+func gradeQuizAnswer(question quizQuestion, answer quizAnswer) bool {
+	switch question.Kind {
+	case QUESTION_MULTIPLE_CHOICE:
+		return answer.Choice != nil && question.CorrectChoice != nil && *answer.Choice == *question.CorrectChoice
+	case QUESTION_NUMERIC:
+		return answer.Number != nil && question.NumericAnswer != nil && math.Abs(*answer.Number-*question.NumericAnswer) <= question.Tolerance
+	case QUESTION_SHORT_TEXT:
+		if answer.Text == nil {
+			return false
+		}
+
+		for _, accepted := range question.AcceptedAnswers {
+			if normalizeQuizText(accepted) == normalizeQuizText(*answer.Text) {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+// Short text answers are compared case insensitively and ignoring extra whitespace
+func normalizeQuizText(text string) string {
+	return strings.ToLower(strings.Join(strings.Fields(text), " "))
+}
+
+// Lists the learner's quiz results for the lectures of a module
+func getQuizResults(w http.ResponseWriter, r *http.Request) {
+	lemail := r.Header.Get("X-User-Claim")
+	moduleId := r.URL.Query().Get("module")
+
+	if moduleId == "" {
+		http.Error(w, "Invalid query parameters", http.StatusBadRequest)
+		return
+	}
+
+	res, err := getQuizSummary(lemail, moduleId)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	if len(res) == 0 {
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+
+	dres, err := json.Marshal(res)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Write(dres)
+}
+
+func getQuizSummary(learnerId string, moduleId string) ([]quizResult, error) {
+	var res []quizResult
+
+	sqlquery := `SELECT lecture.lecture_id, lecture.title, quiz.max_attempts, COUNT(quiz_attempt.attempt_id),
+								MAX(100 * quiz_attempt.score / GREATEST(quiz_attempt.max_score, 1)), COALESCE(BOOL_OR(quiz_attempt.passed), false)
+							FROM quiz
+							INNER JOIN lecture ON lecture.lecture_id = quiz.lecture
+							INNER JOIN learner_lecture ON learner_lecture.lecture = lecture.lecture_id AND learner_lecture.learner = $1
+							LEFT JOIN quiz_attempt ON quiz_attempt.lecture = quiz.lecture AND quiz_attempt.learner = $1
+							WHERE lecture.module = $2
+							GROUP BY lecture.lecture_id, lecture.title, lecture.date_offset, quiz.max_attempts
+							ORDER BY lecture.date_offset`
+	result, err := db.Query(sqlquery, learnerId, moduleId)
+	if err != nil {
+		return nil, err
+	}
+
+	defer result.Close()
+
+	for result.Next() {
+		var quiz quizResult
+		var best sql.NullInt32
+		if err := result.Scan(&quiz.LectureId, &quiz.Title, &quiz.MaxAttempts, &quiz.AttemptsUsed, &best, &quiz.Passed); err != nil {
+			return nil, err
+		}
+
+		quiz.BestPercent = nullIntPtr(best)
+		res = append(res, quiz)
+	}
+
+	return res, result.Err()
+}
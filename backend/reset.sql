@@ -0,0 +1,26 @@
+-- reset.sql drops every table, run it before define.sql to start from an empty database
+DROP TABLE IF EXISTS learner CASCADE;
+DROP TABLE IF EXISTS module CASCADE;
+DROP TABLE IF EXISTS module_version CASCADE;
+DROP TABLE IF EXISTS cohort CASCADE;
+DROP TABLE IF EXISTS learner_cohort CASCADE;
+DROP TABLE IF EXISTS lecture CASCADE;
+DROP TABLE IF EXISTS tutorial CASCADE;
+DROP TABLE IF EXISTS flashcard CASCADE;
+DROP TABLE IF EXISTS learner_flashcard CASCADE;
+DROP TABLE IF EXISTS learner_lecture CASCADE;
+DROP TABLE IF EXISTS learner_tutorial CASCADE;
+DROP TABLE IF EXISTS cohort_shift CASCADE;
+DROP TABLE IF EXISTS module_waitlist CASCADE;
+DROP TABLE IF EXISTS cohort_tutorial CASCADE;
+DROP TABLE IF EXISTS tutorial_material CASCADE;
+DROP TABLE IF EXISTS self_paced_enrollment CASCADE;
+DROP TABLE IF EXISTS lecture_prerequisite CASCADE;
+DROP TABLE IF EXISTS quiz CASCADE;
+DROP TABLE IF EXISTS quiz_question CASCADE;
+DROP TABLE IF EXISTS quiz_attempt CASCADE;
+DROP TABLE IF EXISTS audit_log CASCADE;
+DROP TABLE IF EXISTS notification CASCADE;
+DROP TABLE IF EXISTS learner_risk CASCADE;
+DROP TABLE IF EXISTS module_completion CASCADE;
+DROP TABLE IF EXISTS certificate CASCADE;
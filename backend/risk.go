@@ -0,0 +1,166 @@
+package main
+
+import (
+	"database/sql"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// Learners scoring at least this are flagged as at risk, scores go from 0 to 100
+const riskThreshold = 50
+
+// Failed reviews only count once the learner reviewed enough cards for the rate to mean something
+const riskMinReviews = 5
+
+type riskSignals struct {
+	MissedLectures int `json:"missed_lectures"`
+	DaysInactive   int `json:"days_inactive"`
+	Reviews        int `json:"reviews"`
+	FailedReviews  int `json:"failed_reviews"`
+}
+
+type learnerRiskRes struct {
+	Email      string      `json:"email"`
+	FirstName  string      `json:"first_name"`
+	LastName   string      `json:"last_name"`
+	Score      int         `json:"score"`
+	Flags      []string    `json:"flags"`
+	Signals    riskSignals `json:"signals"`
+	ComputedAt time.Time   `json:"computed_at"`
+}
+
+// Recomputes the risk of every learner in a running cohort
+// Missed lectures are worth 20 points each up to 60, a streak broken for over two days 25
+// and the share of failed reviews up to 40, the total is capped at 100
+// Inactivity counts from the later of the last review and the cohort start, last_completed starts out at sign up
+func scoreLearnerRisk() error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+
+	defer tx.Rollback()
+
+	sqlquery := `WITH roster AS (
+								SELECT learner_cohort.learner, cohort.cohort_id, cohort.module, cohort.start_date,
+									(NOW() AT TIME ZONE cohort.timezone)::date AS today
+								FROM learner_cohort
+								INNER JOIN cohort ON cohort.cohort_id = learner_cohort.cohort
+								WHERE cohort.status = 2
+							), signals AS (
+								SELECT roster.learner, roster.cohort_id,
+									(SELECT COUNT(*) FROM learner_lecture
+										INNER JOIN lecture ON lecture.lecture_id = learner_lecture.lecture
+										WHERE learner_lecture.learner = roster.learner AND lecture.module = roster.module
+											AND NOT learner_lecture.completed AND learner_lecture.scheduled_date < roster.today) AS missed,
+									GREATEST(EXTRACT(DAY FROM NOW() - GREATEST(learner.last_completed, roster.start_date::timestamptz)), 0)::int AS inactive,
+									COALESCE(cards.passes + cards.fails, 0) AS reviews,
+									COALESCE(cards.fails, 0) AS fails
+								FROM roster
+								INNER JOIN learner ON learner.email = roster.learner
+								LEFT JOIN LATERAL (
+									SELECT SUM(learner_flashcard.passes) AS passes, SUM(learner_flashcard.fails) AS fails
+									FROM learner_flashcard
+									INNER JOIN flashcard ON flashcard.flashcard_id = learner_flashcard.flashcard
+									INNER JOIN lecture ON lecture.lecture_id = flashcard.lecture
+									WHERE learner_flashcard.learner = roster.learner AND lecture.module = roster.module
+								) cards ON TRUE
+							)
+							INSERT INTO learner_risk(learner, cohort, score, missed_lectures, days_inactive, reviews, failed_reviews, computed_at)
+							SELECT learner, cohort_id,
+								LEAST(100, LEAST(missed, 3) * 20
+									+ CASE WHEN inactive >= 2 THEN 25 ELSE 0 END
+									+ CASE WHEN reviews >= $1 THEN 40 * fails / reviews ELSE 0 END),
+								missed, inactive, reviews, fails, NOW()
+							FROM signals
+							ON CONFLICT (learner, cohort) DO UPDATE SET score = EXCLUDED.score, missed_lectures = EXCLUDED.missed_lectures,
+								days_inactive = EXCLUDED.days_inactive, reviews = EXCLUDED.reviews, failed_reviews = EXCLUDED.failed_reviews,
+								computed_at = EXCLUDED.computed_at`
+	if _, err := tx.Exec(sqlquery, riskMinReviews); err != nil {
+		return err
+	}
+
+	// Learners that left or finished their cohort are not at risk anymore
+	sqlquery = `DELETE FROM learner_risk WHERE NOT EXISTS (
+								SELECT 1 FROM learner_cohort
+								INNER JOIN cohort ON cohort.cohort_id = learner_cohort.cohort
+								WHERE learner_cohort.learner = learner_risk.learner AND learner_cohort.cohort = learner_risk.cohort AND cohort.status = 2
+							)`
+	if _, err := tx.Exec(sqlquery); err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// Lists the at-risk learners of a cohort, riskiest first, min_score overrides the threshold
+func getCohortRisk(w http.ResponseWriter, r *http.Request) {
+	cohort, ok := getDashboardCohort(w, mux.Vars(r)["id"])
+	if !ok {
+		return
+	}
+
+	minScore := riskThreshold
+	if s := r.URL.Query().Get("min_score"); s != "" {
+		var err error
+		minScore, err = strconv.Atoi(s)
+		if err != nil {
+			http.Error(w, "Invalid query parameters", http.StatusBadRequest)
+			return
+		}
+	}
+
+	res := []learnerRiskRes{}
+
+	sqlquery := `SELECT learner.email, learner.first_name, learner.last_name, learner_risk.score, learner_risk.missed_lectures,
+								learner_risk.days_inactive, learner_risk.reviews, learner_risk.failed_reviews, learner_risk.computed_at
+							FROM learner_risk
+							INNER JOIN learner ON learner.email = learner_risk.learner
+							WHERE learner_risk.cohort = $1 AND learner_risk.score >= $2
+							ORDER BY learner_risk.score DESC, learner.email`
+	result, err := db.Query(sqlquery, cohort.Id, minScore)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	defer result.Close()
+
+	for result.Next() {
+		var learner learnerRiskRes
+		var firstName, lastName sql.NullString
+		if err := result.Scan(&learner.Email, &firstName, &lastName, &learner.Score, &learner.Signals.MissedLectures,
+			&learner.Signals.DaysInactive, &learner.Signals.Reviews, &learner.Signals.FailedReviews, &learner.ComputedAt); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		learner.FirstName, learner.LastName = firstName.String, lastName.String
+		learner.Flags = riskFlags(learner.Signals)
+		res = append(res, learner)
+	}
+
+	writeAdminRes(w, http.StatusOK, res)
+}
+
+// Names the signals that added to the score, matching the weights in scoreLearnerRisk
+func riskFlags(signals riskSignals) []string {
+	flags := []string{}
+
+	if signals.MissedLectures > 0 {
+		flags = append(flags, "missed_lectures")
+	}
+
+	if signals.DaysInactive >= 2 {
+		flags = append(flags, "broken_streak")
+	}
+
+	if signals.Reviews >= riskMinReviews && signals.FailedReviews > 0 {
+		flags = append(flags, "failed_reviews")
+	}
+
+	return flags
+}
@@ -0,0 +1,30 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestRiskFlags(t *testing.T) {
+	tests := []struct {
+		name    string
+		signals riskSignals
+		want    []string
+	}{
+		{"on track", riskSignals{}, []string{}},
+		{"missed a lecture", riskSignals{MissedLectures: 1}, []string{"missed_lectures"}},
+		{"inactive a day", riskSignals{DaysInactive: 1}, []string{}},
+		{"broken streak", riskSignals{DaysInactive: 2}, []string{"broken_streak"}},
+		{"too few reviews", riskSignals{Reviews: riskMinReviews - 1, FailedReviews: riskMinReviews - 1}, []string{}},
+		{"failed reviews", riskSignals{Reviews: riskMinReviews, FailedReviews: 1}, []string{"failed_reviews"}},
+		{"passed every review", riskSignals{Reviews: 20}, []string{}},
+		{"everything", riskSignals{MissedLectures: 3, DaysInactive: 5, Reviews: 10, FailedReviews: 8},
+			[]string{"missed_lectures", "broken_streak", "failed_reviews"}},
+	}
+
+	for _, test := range tests {
+		if got := riskFlags(test.signals); !reflect.DeepEqual(got, test.want) {
+			t.Errorf("%s: got %v, want %v", test.name, got, test.want)
+		}
+	}
+}
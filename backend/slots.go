@@ -0,0 +1,217 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"net/http"
+	"sort"
+	"strconv"
+	"time"
+)
+
+// Local waking hours in minutes from midnight, slots inside the core hours fit best
+const wakingStart = 7 * 60
+const coreStart = 9 * 60
+const coreEnd = 21 * 60
+const wakingEnd = 23 * 60
+
+// Scores how well a local time of day suits a learner, from 0 (asleep) to 100 (core waking hours)
+func slotFitScore(localMinutes int) int {
+	switch {
+	case localMinutes < wakingStart || localMinutes >= wakingEnd:
+		return 0
+	case localMinutes < coreStart:
+		return 100 * (localMinutes - wakingStart) / (coreStart - wakingStart)
+	case localMinutes > coreEnd:
+		return 100 * (wakingEnd - localMinutes) / (wakingEnd - coreEnd)
+	default:
+		return 100
+	}
+}
+
+// Orders the available cohorts with the best fitting tutorial slot first
+func rankCohortsByFit(cohorts []moduleCohortRes) {
+	sort.SliceStable(cohorts, func(i, j int) bool {
+		if cohorts[i].FitScore != cohorts[j].FitScore {
+			return cohorts[i].FitScore > cohorts[j].FitScore
+		}
+		return cohorts[i].StartDate.Before(cohorts[j].StartDate)
+	})
+}
+
+/******************* MODULE WAITLIST ************************/
+
+// Learners that couldn't find a fitting cohort can wait for a new one
+func joinModuleWaitlist(w http.ResponseWriter, r *http.Request) {
+	lemail := r.Header.Get("X-User-Claim")
+	query := r.URL.Query()
+	moduleId := query.Get("module")
+
+	if moduleId == "" {
+		http.Error(w, "Invalid query parameters", http.StatusBadRequest)
+		return
+	}
+
+	var dummy string
+	sqlquery := `SELECT module_id FROM module WHERE module_id = $1`
+	if err := db.QueryRow(sqlquery, moduleId).Scan(&dummy); err != nil {
+		if err == sql.ErrNoRows {
+			http.Error(w, "Invalid module id", http.StatusBadRequest)
+		} else {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+		}
+		return
+	}
+
+	sqlquery = `INSERT INTO module_waitlist(learner, module) VALUES ($1, $2) ON CONFLICT DO NOTHING`
+	if _, err := db.Exec(sqlquery, lemail, moduleId); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+}
+
+func leaveModuleWaitlist(w http.ResponseWriter, r *http.Request) {
+	lemail := r.Header.Get("X-User-Claim")
+	query := r.URL.Query()
+	moduleId := query.Get("module")
+
+	if moduleId == "" {
+		http.Error(w, "Invalid query parameters", http.StatusBadRequest)
+		return
+	}
+
+	if err := removeFromWaitlist(db, lemail, moduleId); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+}
+
+type execer interface {
+	Exec(query string, args ...interface{}) (sql.Result, error)
+}
+
+func removeFromWaitlist(e execer, learnerId string, moduleId string) error {
+	sqlquery := `DELETE FROM module_waitlist WHERE learner = $1 AND module = $2`
+	_, err := e.Exec(sqlquery, learnerId, moduleId)
+	return err
+}
+
+// Tutorial time is in minutes from midnight in the requested timezone
+type slotSuggestion struct {
+	TutorialTime int    `json:"tutorial_time"`
+	Timezone     string `json:"timezone"`
+	Score        int    `json:"score"`
+	FittingCount int    `json:"fitting_count"`
+	WaitingCount int    `json:"waiting_count"`
+}
+
+// Candidate tutorial times are tried every slotStep minutes
+const slotStep = 30
+
+// Suggests tutorial times for a new cohort of a module, based on the timezones of the waitlisted learners
+func suggestCohortSlots(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	moduleId := query.Get("module")
+
+	timezone := query.Get("timezone")
+	if timezone == "" {
+		timezone = "Asia/Singapore"
+	}
+
+	count := 3
+	if c := query.Get("count"); c != "" {
+		var err error
+		count, err = strconv.Atoi(c)
+		if err != nil || count <= 0 {
+			http.Error(w, "Invalid query parameters", http.StatusBadRequest)
+			return
+		}
+	}
+
+	if moduleId == "" {
+		http.Error(w, "Invalid query parameters", http.StatusBadRequest)
+		return
+	}
+
+	location, err := time.LoadLocation(timezone)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	// Waiting demand is grouped by timezone
+	demand := make(map[*time.Location]int)
+	waiting := 0
+
+	sqlquery := `SELECT learner.timezone, COUNT(*) FROM module_waitlist
+							INNER JOIN learner ON learner.email = module_waitlist.learner
+							WHERE module_waitlist.module = $1
+							GROUP BY learner.timezone`
+	result, err := db.Query(sqlquery, moduleId)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	defer result.Close()
+
+	for result.Next() {
+		var learnerTimezone string
+		var learnerCount int
+		if err := result.Scan(&learnerTimezone, &learnerCount); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		learnerLocation, err := time.LoadLocation(learnerTimezone)
+		if err != nil {
+			// Skip learners with a broken timezone rather than failing the whole suggestion
+			continue
+		}
+
+		demand[learnerLocation] += learnerCount
+		waiting += learnerCount
+	}
+
+	// Slots are compared on the coming Monday, so that the current DST offsets apply
+	now := time.Now().In(location)
+	monday := time.Date(now.Year(), now.Month(), now.Day()+(8-int(now.Weekday()))%7, 0, 0, 0, 0, time.UTC)
+
+	var res []slotSuggestion
+	for minutes := 0; minutes < 24*60; minutes += slotStep {
+		slot := slotSuggestion{TutorialTime: minutes, Timezone: timezone, WaitingCount: waiting}
+		slotTime := tutorialDateTime(monday, 0, minutes, location)
+
+		for learnerLocation, learnerCount := range demand {
+			local := slotTime.In(learnerLocation)
+			fit := slotFitScore(local.Hour()*60 + local.Minute())
+
+			slot.Score += fit * learnerCount
+			if fit > 0 {
+				slot.FittingCount += learnerCount
+			}
+		}
+
+		res = append(res, slot)
+	}
+
+	sort.SliceStable(res, func(i, j int) bool {
+		return res[i].Score > res[j].Score
+	})
+
+	if len(res) > count {
+		res = res[:count]
+	}
+
+	dres, err := json.Marshal(res)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Write(dres)
+}
@@ -0,0 +1,27 @@
+package main
+
+import "testing"
+
+func TestSlotFitScore(t *testing.T) {
+	tests := []struct {
+		minutes int
+		want    int
+	}{
+		{0, 0},
+		{6*60 + 59, 0},
+		{7 * 60, 0},
+		{8 * 60, 50},
+		{9 * 60, 100},
+		{14 * 60, 100},
+		{21 * 60, 100},
+		{22 * 60, 50},
+		{23 * 60, 0},
+		{23*60 + 59, 0},
+	}
+
+	for _, test := range tests {
+		if got := slotFitScore(test.minutes); got != test.want {
+			t.Errorf("slotFitScore(%d) = %d, want %d", test.minutes, got, test.want)
+		}
+	}
+}
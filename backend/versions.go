@@ -0,0 +1,564 @@
+package main
+
+import (
+	"database/sql"
+	"net/http"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/lib/pq"
+)
+
+type contentChange struct {
+	Entity     string   `json:"entity"`
+	ContentKey string   `json:"content_key"`
+	Title      string   `json:"title"`
+	Change     string   `json:"change"`
+	Fields     []string `json:"fields,omitempty"`
+}
+
+type versionDiffRes struct {
+	Module  string          `json:"module"`
+	From    int             `json:"from"`
+	To      int             `json:"to"`
+	Changes []contentChange `json:"changes"`
+}
+
+type versionItem struct {
+	Title  string
+	Fields map[string]string
+}
+
+// Each query returns the content key, a title and then the compared fields of a module version
+var versionContentQueries = []struct {
+	entity   string
+	sqlquery string
+	fields   []string
+}{
+	{"lecture", `SELECT content_key, title, title, description, video_link, date_offset::text, duration_seconds::text, min_watch_percent::text
+							FROM lecture WHERE module = $1 AND version = $2`,
+		[]string{"title", "description", "video_link", "date_offset", "duration_seconds", "min_watch_percent"}},
+	{"tutorial", `SELECT content_key, title, title, description, week::text FROM tutorial WHERE module = $1 AND version = $2`,
+		[]string{"title", "description", "week"}},
+	{"flashcard", `SELECT flashcard.content_key, top_side, top_side, bottom_side, lecture.content_key::text FROM flashcard
+							INNER JOIN lecture ON lecture.lecture_id = flashcard.lecture WHERE lecture.module = $1 AND lecture.version = $2`,
+		[]string{"top_side", "bottom_side", "lecture"}},
+	{"quiz", `SELECT lecture.content_key, lecture.title, quiz.pass_percent::text, quiz.max_attempts::text,
+								COALESCE((SELECT md5(string_agg(concat_ws('|', position, kind, prompt, choices::text, correct_choice, numeric_answer, tolerance, accepted_answers::text), ',' ORDER BY position))
+									FROM quiz_question WHERE quiz_question.lecture = quiz.lecture), '')
+							FROM quiz INNER JOIN lecture ON lecture.lecture_id = quiz.lecture WHERE lecture.module = $1 AND lecture.version = $2`,
+		[]string{"pass_percent", "max_attempts", "questions"}},
+}
+
+/******************* DRAFTS *********************************/
+
+// Returns the draft version of a module, copying the published content into a new draft when there is none
+// The module row is locked, so concurrent edits end up in the same draft
+func ensureDraftVersion(tx *sql.Tx, moduleId string) (int, error) {
+	var published sql.NullInt32
+	sqlquery := `SELECT published_version FROM module WHERE module_id = $1 FOR UPDATE`
+	if err := tx.QueryRow(sqlquery, moduleId).Scan(&published); err != nil {
+		return 0, err
+	}
+
+	draft := int(published.Int32) + 1
+
+	sqlquery = `INSERT INTO module_version(module, version) VALUES ($1, $2) ON CONFLICT DO NOTHING`
+	result, err := tx.Exec(sqlquery, moduleId, draft)
+	if err != nil {
+		return 0, err
+	}
+
+	affected, err := result.RowsAffected()
+	if err != nil {
+		return 0, err
+	}
+
+	if affected > 0 && published.Valid {
+		if err := copyModuleVersion(tx, moduleId, int(published.Int32), draft); err != nil {
+			return 0, err
+		}
+	}
+
+	return draft, nil
+}
+
+// Copies the content of a module version into another, keeping the content keys
+func copyModuleVersion(tx *sql.Tx, moduleId string, from int, to int) error {
+	sqlqueries := []string{
+		`INSERT INTO lecture(title, description, video_link, date_offset, module, duration_seconds, min_watch_percent, version, content_key)
+			SELECT title, description, video_link, date_offset, module, duration_seconds, min_watch_percent, $3, content_key
+			FROM lecture WHERE module = $1 AND version = $2`,
+		`INSERT INTO tutorial(week, title, description, module, meeting_provider, room_url, passcode, version, content_key)
+			SELECT week, title, description, module, meeting_provider, room_url, passcode, $3, content_key
+			FROM tutorial WHERE module = $1 AND version = $2`,
+		`INSERT INTO flashcard(top_side, bottom_side, lecture, content_key)
+			SELECT flashcard.top_side, flashcard.bottom_side, target.lecture_id, flashcard.content_key FROM flashcard
+			INNER JOIN lecture source ON source.lecture_id = flashcard.lecture
+			INNER JOIN lecture target ON target.module = source.module AND target.version = $3 AND target.content_key = source.content_key
+			WHERE source.module = $1 AND source.version = $2`,
+		`INSERT INTO quiz(lecture, pass_percent, max_attempts)
+			SELECT target.lecture_id, quiz.pass_percent, quiz.max_attempts FROM quiz
+			INNER JOIN lecture source ON source.lecture_id = quiz.lecture
+			INNER JOIN lecture target ON target.module = source.module AND target.version = $3 AND target.content_key = source.content_key
+			WHERE source.module = $1 AND source.version = $2`,
+		`INSERT INTO quiz_question(lecture, position, kind, prompt, choices, correct_choice, numeric_answer, tolerance, accepted_answers, content_key)
+			SELECT target.lecture_id, position, kind, prompt, choices, correct_choice, numeric_answer, tolerance, accepted_answers, quiz_question.content_key
+			FROM quiz_question
+			INNER JOIN lecture source ON source.lecture_id = quiz_question.lecture
+			INNER JOIN lecture target ON target.module = source.module AND target.version = $3 AND target.content_key = source.content_key
+			WHERE source.module = $1 AND source.version = $2`,
+		`INSERT INTO lecture_prerequisite(lecture, prerequisite, mastery_threshold)
+			SELECT target.lecture_id, target_prerequisite.lecture_id, lecture_prerequisite.mastery_threshold FROM lecture_prerequisite
+			INNER JOIN lecture source ON source.lecture_id = lecture_prerequisite.lecture
+			INNER JOIN lecture source_prerequisite ON source_prerequisite.lecture_id = lecture_prerequisite.prerequisite
+			INNER JOIN lecture target ON target.module = source.module AND target.version = $3 AND target.content_key = source.content_key
+			INNER JOIN lecture target_prerequisite ON target_prerequisite.module = source.module AND target_prerequisite.version = $3
+				AND target_prerequisite.content_key = source_prerequisite.content_key
+			WHERE source.module = $1 AND source.version = $2`,
+	}
+
+	for _, sqlquery := range sqlqueries {
+		if _, err := tx.Exec(sqlquery, moduleId, from, to); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Publishes the draft of a module, cohorts starting from now on use it
+func publishModule(w http.ResponseWriter, r *http.Request) {
+	lemail := r.Header.Get("X-User-Claim")
+	moduleId := mux.Vars(r)["id"]
+
+	tx, err := db.Begin()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	defer tx.Rollback()
+
+	var published sql.NullInt32
+	sqlquery := `SELECT published_version FROM module WHERE module_id = $1 FOR UPDATE`
+	if err := tx.QueryRow(sqlquery, moduleId).Scan(&published); err != nil {
+		if err == sql.ErrNoRows {
+			http.Error(w, "Invalid module id", http.StatusNotFound)
+		} else {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+		}
+		return
+	}
+
+	draft := int(published.Int32) + 1
+
+	sqlquery = `UPDATE module_version SET published_at = NOW() WHERE module = $1 AND version = $2 AND published_at IS NULL`
+	result, err := tx.Exec(sqlquery, moduleId, draft)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	if affected, err := result.RowsAffected(); err != nil || affected == 0 {
+		http.Error(w, "Module has no draft to publish", http.StatusConflict)
+		return
+	}
+
+	sqlquery = `UPDATE module SET published_version = $1 WHERE module_id = $2`
+	if _, err := tx.Exec(sqlquery, draft, moduleId); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	if !commitAudited(w, tx, lemail, "publish", "module", moduleId, map[string]int{"version": draft}) {
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+}
+
+/******************* DIFFS **********************************/
+
+// Compares two versions of a module, by default the published version against the draft
+func getModuleDiff(w http.ResponseWriter, r *http.Request) {
+	moduleId := mux.Vars(r)["id"]
+	query := r.URL.Query()
+
+	var published sql.NullInt32
+	sqlquery := `SELECT published_version FROM module WHERE module_id = $1`
+	if err := db.QueryRow(sqlquery, moduleId).Scan(&published); err != nil {
+		if err == sql.ErrNoRows {
+			http.Error(w, "Invalid module id", http.StatusNotFound)
+		} else {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+		}
+		return
+	}
+
+	from, to := int(published.Int32), int(published.Int32)+1
+	var err error
+	if value := query.Get("from"); value != "" {
+		if from, err = strconv.Atoi(value); err != nil {
+			http.Error(w, "Invalid query parameters", http.StatusBadRequest)
+			return
+		}
+	}
+
+	if value := query.Get("to"); value != "" {
+		if to, err = strconv.Atoi(value); err != nil {
+			http.Error(w, "Invalid query parameters", http.StatusBadRequest)
+			return
+		}
+	}
+
+	// Version 0 stands for a module that was never published, so everything in the other version is added
+	for _, version := range []int{from, to} {
+		if version == 0 {
+			continue
+		}
+
+		var exists bool
+		sqlquery = `SELECT EXISTS (SELECT 1 FROM module_version WHERE module = $1 AND version = $2)`
+		if err := db.QueryRow(sqlquery, moduleId, version).Scan(&exists); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		if !exists && query.Get("to") == "" && version == to {
+			http.Error(w, "Module has no draft", http.StatusConflict)
+			return
+		}
+
+		if !exists {
+			http.Error(w, "Invalid version", http.StatusNotFound)
+			return
+		}
+	}
+
+	res := versionDiffRes{Module: moduleId, From: from, To: to}
+	res.Changes, err = diffModuleVersions(moduleId, from, to)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	writeAdminRes(w, http.StatusOK, res)
+}
+
+// Lists what was added, removed or changed between two versions of a module, matched by content key
+func diffModuleVersions(moduleId string, from int, to int) ([]contentChange, error) {
+	changes := []contentChange{}
+
+	for _, content := range versionContentQueries {
+		before, err := loadVersionItems(content.sqlquery, content.fields, moduleId, from)
+		if err != nil {
+			return nil, err
+		}
+
+		after, err := loadVersionItems(content.sqlquery, content.fields, moduleId, to)
+		if err != nil {
+			return nil, err
+		}
+
+		var entityChanges []contentChange
+		for key, item := range after {
+			old, ok := before[key]
+			if !ok {
+				entityChanges = append(entityChanges, contentChange{Entity: content.entity, ContentKey: key, Title: item.Title, Change: "added"})
+				continue
+			}
+
+			var fields []string
+			for _, field := range content.fields {
+				if old.Fields[field] != item.Fields[field] {
+					fields = append(fields, field)
+				}
+			}
+
+			if len(fields) > 0 {
+				entityChanges = append(entityChanges, contentChange{Entity: content.entity, ContentKey: key, Title: item.Title, Change: "changed", Fields: fields})
+			}
+		}
+
+		for key, item := range before {
+			if _, ok := after[key]; !ok {
+				entityChanges = append(entityChanges, contentChange{Entity: content.entity, ContentKey: key, Title: item.Title, Change: "removed"})
+			}
+		}
+
+		sort.Slice(entityChanges, func(i, j int) bool {
+			if entityChanges[i].Title != entityChanges[j].Title {
+				return entityChanges[i].Title < entityChanges[j].Title
+			}
+			return entityChanges[i].ContentKey < entityChanges[j].ContentKey
+		})
+
+		changes = append(changes, entityChanges...)
+	}
+
+	return changes, nil
+}
+
+func loadVersionItems(sqlquery string, fields []string, moduleId string, version int) (map[string]versionItem, error) {
+	items := make(map[string]versionItem)
+
+	result, err := db.Query(sqlquery, moduleId, version)
+	if err != nil {
+		return nil, err
+	}
+
+	defer result.Close()
+
+	for result.Next() {
+		var key, title string
+		values := make([]sql.NullString, len(fields))
+		dest := []interface{}{&key, &title}
+		for i := range values {
+			dest = append(dest, &values[i])
+		}
+
+		if err := result.Scan(dest...); err != nil {
+			return nil, err
+		}
+
+		item := versionItem{Title: title, Fields: make(map[string]string)}
+		for i, field := range fields {
+			item.Fields[field] = values[i].String
+		}
+
+		items[key] = item
+	}
+
+	return items, result.Err()
+}
+
+/******************* COHORT UPGRADES ************************/
+
+// Shows what would change for a running cohort when it moves to the published version
+func getCohortUpgrade(w http.ResponseWriter, r *http.Request) {
+	cohort, published, ok := getUpgradableCohort(w, mux.Vars(r)["id"])
+	if !ok {
+		return
+	}
+
+	res := versionDiffRes{Module: cohort.Module, From: cohort.ContentVersion, To: published}
+
+	var err error
+	res.Changes, err = diffModuleVersions(cohort.Module, cohort.ContentVersion, published)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	writeAdminRes(w, http.StatusOK, res)
+}
+
+// Moves a running cohort onto the published version of its module
+// Learners keep their progress on content that carried over, new content is scheduled like the rest of the cohort
+func upgradeCohort(w http.ResponseWriter, r *http.Request) {
+	lemail := r.Header.Get("X-User-Claim")
+	cohortId := mux.Vars(r)["id"]
+
+	cohort, published, ok := getUpgradableCohort(w, cohortId)
+	if !ok {
+		return
+	}
+
+	from := cohort.ContentVersion
+	cohort.ContentVersion = published
+
+	lectureDates, err := calculateLectureDates(cohort)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	tutorialDates, err := calculateTutorialDates(cohort)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	var learnerIds []string
+	sqlquery := `SELECT learner FROM learner_cohort WHERE cohort = $1`
+	result, err := db.Query(sqlquery, cohortId)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	defer result.Close()
+
+	for result.Next() {
+		var learnerId string
+		if err := result.Scan(&learnerId); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		learnerIds = append(learnerIds, learnerId)
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	defer tx.Rollback()
+
+	// Guards against a concurrent upgrade of the same cohort
+	sqlquery = `UPDATE cohort SET content_version = $1 WHERE cohort_id = $2 AND content_version = $3`
+	if !execAdminUpdate(w, tx, sqlquery, published, cohortId, from) {
+		return
+	}
+
+	if err := remapLearnerContent(tx, cohort.Module, published, learnerIds); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	// Recordings and materials of the cohort's tutorials follow along
+	for _, sqlquery := range []string{
+		`UPDATE cohort_tutorial SET tutorial = target.tutorial_id FROM tutorial source, tutorial target
+			WHERE cohort_tutorial.cohort = $1 AND cohort_tutorial.tutorial = source.tutorial_id
+			AND target.module = source.module AND target.version = $2 AND target.content_key = source.content_key`,
+		`UPDATE tutorial_material SET tutorial = target.tutorial_id FROM tutorial source, tutorial target
+			WHERE tutorial_material.cohort = $1 AND tutorial_material.tutorial = source.tutorial_id
+			AND target.module = source.module AND target.version = $2 AND target.content_key = source.content_key`,
+	} {
+		if _, err := tx.Exec(sqlquery, cohortId, published); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+	}
+
+	// Only content that is new in the version gets scheduled, existing rows keep their dates
+	lectureQuery := `INSERT INTO learner_lecture(learner, lecture, scheduled_date) VALUES ($1, $2, $3) ON CONFLICT DO NOTHING`
+	tutorialQuery := `INSERT INTO learner_tutorial(learner, tutorial, scheduled_datetime) VALUES ($1, $2, $3) ON CONFLICT DO NOTHING`
+	for _, learnerId := range learnerIds {
+		for _, lecture := range lectureDates {
+			if _, err := tx.Exec(lectureQuery, learnerId, lecture.Id, lecture.AbsoluteDate); err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+		}
+
+		for _, tutorial := range tutorialDates {
+			if !tutorial.AbsoluteDateTime.After(time.Now()) {
+				continue
+			}
+
+			if _, err := tx.Exec(tutorialQuery, learnerId, tutorial.Id, tutorial.AbsoluteDateTime); err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+		}
+	}
+
+	if !commitAudited(w, tx, lemail, "upgrade", "cohort", cohortId, map[string]int{"from": from, "to": published}) {
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+}
+
+// Loads a running cohort that is behind the published version of its module, errors are written to the response
+func getUpgradableCohort(w http.ResponseWriter, cohortId string) (cohortData, int, bool) {
+	cohort, err := getCohort(cohortId)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			http.Error(w, "Invalid cohort id", http.StatusNotFound)
+		} else {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+		}
+		return cohort, 0, false
+	}
+
+	if cohort.Status != 2 {
+		http.Error(w, "Only running cohorts can be upgraded", http.StatusConflict)
+		return cohort, 0, false
+	}
+
+	var published sql.NullInt32
+	sqlquery := `SELECT published_version FROM module WHERE module_id = $1`
+	if err := db.QueryRow(sqlquery, cohort.Module).Scan(&published); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return cohort, 0, false
+	}
+
+	if !published.Valid || int(published.Int32) <= cohort.ContentVersion {
+		http.Error(w, "Cohort is already on the published version", http.StatusConflict)
+		return cohort, 0, false
+	}
+
+	return cohort, int(published.Int32), true
+}
+
+// Moves the learners' lectures, tutorials, flashcards and quiz attempts of a module onto a version, matched by content key
+// Completed lectures, past tutorials and quiz attempts on content that was removed stay as history
+// The answers of moved quiz attempts follow their questions by content key
+func remapLearnerContent(tx *sql.Tx, moduleId string, version int, learnerIds []string) error {
+	sqlqueries := []string{
+		`UPDATE learner_lecture SET lecture = target.lecture_id, sequence = learner_lecture.sequence + 1
+			FROM lecture source, lecture target
+			WHERE learner_lecture.learner = ANY($3) AND learner_lecture.lecture = source.lecture_id
+			AND source.module = $1 AND source.version <> $2
+			AND target.module = $1 AND target.version = $2 AND target.content_key = source.content_key
+			AND NOT EXISTS (SELECT 1 FROM learner_lecture moved WHERE moved.learner = learner_lecture.learner AND moved.lecture = target.lecture_id)`,
+		`DELETE FROM learner_lecture USING lecture
+			WHERE learner_lecture.learner = ANY($3) AND learner_lecture.lecture = lecture.lecture_id
+			AND lecture.module = $1 AND lecture.version <> $2 AND learner_lecture.completed = false`,
+		`UPDATE learner_tutorial SET tutorial = target.tutorial_id, sequence = learner_tutorial.sequence + 1
+			FROM tutorial source, tutorial target
+			WHERE learner_tutorial.learner = ANY($3) AND learner_tutorial.tutorial = source.tutorial_id
+			AND source.module = $1 AND source.version <> $2
+			AND target.module = $1 AND target.version = $2 AND target.content_key = source.content_key
+			AND NOT EXISTS (SELECT 1 FROM learner_tutorial moved WHERE moved.learner = learner_tutorial.learner AND moved.tutorial = target.tutorial_id)`,
+		`DELETE FROM learner_tutorial USING tutorial
+			WHERE learner_tutorial.learner = ANY($3) AND learner_tutorial.tutorial = tutorial.tutorial_id
+			AND tutorial.module = $1 AND tutorial.version <> $2 AND learner_tutorial.scheduled_datetime > NOW()`,
+		`UPDATE learner_flashcard SET flashcard = target.flashcard_id
+			FROM flashcard source
+			INNER JOIN lecture source_lecture ON source_lecture.lecture_id = source.lecture
+			INNER JOIN lecture target_lecture ON target_lecture.module = source_lecture.module AND target_lecture.content_key = source_lecture.content_key
+			INNER JOIN flashcard target ON target.lecture = target_lecture.lecture_id AND target.content_key = source.content_key
+			WHERE learner_flashcard.learner = ANY($3) AND learner_flashcard.flashcard = source.flashcard_id
+			AND source_lecture.module = $1 AND source_lecture.version <> $2 AND target_lecture.version = $2
+			AND NOT EXISTS (SELECT 1 FROM learner_flashcard moved WHERE moved.learner = learner_flashcard.learner AND moved.flashcard = target.flashcard_id)`,
+		`DELETE FROM learner_flashcard USING flashcard, lecture
+			WHERE learner_flashcard.learner = ANY($3) AND learner_flashcard.flashcard = flashcard.flashcard_id
+			AND flashcard.lecture = lecture.lecture_id AND lecture.module = $1 AND lecture.version <> $2`,
+		`INSERT INTO learner_flashcard(learner, flashcard)
+			SELECT learner_lecture.learner, flashcard.flashcard_id FROM learner_lecture
+			INNER JOIN lecture ON lecture.lecture_id = learner_lecture.lecture
+			INNER JOIN flashcard ON flashcard.lecture = lecture.lecture_id
+			WHERE learner_lecture.learner = ANY($3) AND learner_lecture.completed AND lecture.module = $1 AND lecture.version = $2
+			ON CONFLICT (learner, flashcard) DO NOTHING`,
+		`UPDATE quiz_attempt SET lecture = target.lecture_id,
+			answers = COALESCE((
+				SELECT jsonb_agg(CASE WHEN target_question.question_id IS NULL THEN element.answer
+					ELSE jsonb_set(element.answer, '{question}', to_jsonb(target_question.question_id::text)) END ORDER BY element.position)
+				FROM jsonb_array_elements(quiz_attempt.answers) WITH ORDINALITY AS element(answer, position)
+				LEFT JOIN quiz_question source_question ON source_question.lecture = source.lecture_id
+					AND source_question.question_id::text = element.answer->>'question'
+				LEFT JOIN quiz_question target_question ON target_question.lecture = target.lecture_id
+					AND target_question.content_key = source_question.content_key
+			), '[]'::jsonb)
+			FROM lecture source, lecture target
+			WHERE quiz_attempt.learner = ANY($3) AND quiz_attempt.lecture = source.lecture_id
+			AND source.module = $1 AND source.version <> $2
+			AND target.module = $1 AND target.version = $2 AND target.content_key = source.content_key`,
+	}
+
+	for _, sqlquery := range sqlqueries {
+		if _, err := tx.Exec(sqlquery, moduleId, version, pq.Array(learnerIds)); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}